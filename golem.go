@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"runtime"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -19,7 +20,8 @@ func TrainCommand() *cobra.Command {
 	var trainFile string
 	var testFile string
 	var outputFile string
-	var targetColumn string
+	var metricsFile string
+	var targetColumns []string
 	var trainingParameters pkg.TrainingParameters
 	var modelParameters model.TabNetConfig
 
@@ -28,7 +30,7 @@ func TrainCommand() *cobra.Command {
 		Short: "Trains a new model on the provided training data and saves the trained model",
 		Args:  cobra.ArbitraryArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			pkg.Train(trainFile, testFile, outputFile, targetColumn, modelParameters, trainingParameters)
+			pkg.Train(trainFile, testFile, outputFile, metricsFile, targetColumns, modelParameters, trainingParameters)
 			return nil
 		},
 	}
@@ -36,31 +38,205 @@ func TrainCommand() *cobra.Command {
 	cmd.Flags().StringVarP(&trainFile, "train-file", "i", "", "name of train file")
 	cmd.Flags().StringVarP(&testFile, "test-file", "", "", "name of test file")
 	cmd.Flags().StringVarP(&outputFile, "output-file", "o", "", "name of the file to save model to.")
+	cmd.Flags().StringVarP(&metricsFile, "metrics-output", "", "", "name of the JSON metrics output file (optional)")
+	addTrainingFlags(cmd, &trainingParameters, &modelParameters)
+	addWorkersFlag(cmd, &trainingParameters)
+
+	cmd.Flags().StringSliceVarP(&targetColumns, "target-column", "t", nil, "target column, repeated or comma separated for multi-target models")
+
+	_ = cmd.MarkFlagRequired("train-file")
+	_ = cmd.MarkFlagRequired("output-file")
+	_ = cmd.MarkFlagRequired("target-column")
+
+	return cmd
+}
+
+func CrossValidateCommand() *cobra.Command {
+
+	var dataFile string
+	var predictionsFile string
+	var targetColumns []string
+	var numFolds int
+	var trainingParameters pkg.TrainingParameters
+	var modelParameters model.TabNetConfig
+
+	var cmd = &cobra.Command{
+		Use:   "cv -i data -t targetColumn [--folds k] [-o predictionsFile]",
+		Short: "Evaluates a model configuration with k-fold cross-validation on the provided data",
+		Args:  cobra.ArbitraryArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return pkg.CrossValidate(dataFile, targetColumns, predictionsFile, numFolds, modelParameters, trainingParameters)
+		},
+	}
+
+	cmd.Flags().StringVarP(&dataFile, "input", "i", "", "name of data file")
+	cmd.Flags().StringVarP(&predictionsFile, "output", "o", "", "name of the out-of-fold predictions output file (optional)")
+	cmd.Flags().IntVarP(&numFolds, "folds", "", 5, "number of folds")
+	addTrainingFlags(cmd, &trainingParameters, &modelParameters)
+	addWorkersFlag(cmd, &trainingParameters)
+
+	cmd.Flags().StringSliceVarP(&targetColumns, "target-column", "t", nil, "target column, repeated or comma separated for multi-target models")
+
+	_ = cmd.MarkFlagRequired("input")
+	_ = cmd.MarkFlagRequired("target-column")
+
+	return cmd
+}
+
+func TuneCommand() *cobra.Command {
+
+	var dataFile string
+	var searchSpaceFile string
+	var outputFile string
+	var leaderboardFile string
+	var targetColumns []string
+	var tuningParameters pkg.TuningParameters
+	var trainingParameters pkg.TrainingParameters
+	var modelParameters model.TabNetConfig
+
+	var cmd = &cobra.Command{
+		Use:   "tune -i data -t targetColumn --search-space searchSpaceFile -o outputFile [--leaderboard leaderboardFile]",
+		Short: "Searches the model hyperparameters on a validation split and saves the best model",
+		Args:  cobra.ArbitraryArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return pkg.Tune(dataFile, targetColumns, searchSpaceFile, outputFile, leaderboardFile, tuningParameters, modelParameters, trainingParameters)
+		},
+	}
+
+	cmd.Flags().StringVarP(&dataFile, "input", "i", "", "name of data file")
+	cmd.Flags().StringVarP(&searchSpaceFile, "search-space", "", "", "name of the JSON file holding the range or choices of each tuned flag")
+	cmd.Flags().StringVarP(&outputFile, "output-file", "o", "", "name of the file to save the best model to")
+	cmd.Flags().StringVarP(&leaderboardFile, "leaderboard", "", "", "name of the leaderboard CSV output file (optional)")
+	cmd.Flags().StringVarP(&tuningParameters.Method, "method", "", "random", "search method: random or halving")
+	cmd.Flags().IntVarP(&tuningParameters.NumTrials, "trials", "", 10, "number of sampled configurations")
+	cmd.Flags().IntVarP(&tuningParameters.Workers, "workers", "", runtime.NumCPU(), "number of trials trained concurrently")
+	cmd.Flags().IntVarP(&tuningParameters.MinEpochs, "min-epochs", "", 1, "number of epochs of the first successive halving round")
+	cmd.Flags().IntVarP(&tuningParameters.ReductionFactor, "reduction-factor", "", 3, "fraction of trials discarded at each successive halving round")
+	addTrainingFlags(cmd, &trainingParameters, &modelParameters)
+
+	cmd.Flags().StringSliceVarP(&targetColumns, "target-column", "t", nil, "target column, repeated or comma separated for multi-target models")
+
+	_ = cmd.MarkFlagRequired("input")
+	_ = cmd.MarkFlagRequired("search-space")
+	_ = cmd.MarkFlagRequired("output-file")
+	_ = cmd.MarkFlagRequired("target-column")
+
+	return cmd
+}
+
+// PretrainCommand returns the command pretraining the encoder of a model on unlabeled data. It only accepts the
+// flags of the data, the optimization and the encoder, as it has no target.
+func PretrainCommand() *cobra.Command {
+	var dataFile string
+	var outputFile string
+	var maskingRatio float64
+	var trainingParameters pkg.TrainingParameters
+	var modelParameters model.TabNetConfig
+
+	var cmd = &cobra.Command{
+		Use:   "pretrain -i dataFile -o outputFile",
+		Short: "Pretrains the encoder of a model on unlabeled data by reconstructing randomly masked features",
+		Args:  cobra.ArbitraryArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return pkg.Pretrain(dataFile, outputFile, maskingRatio, modelParameters, trainingParameters)
+		},
+	}
+
+	cmd.Flags().StringVarP(&dataFile, "input", "i", "", "name of the unlabeled data file")
+	cmd.Flags().StringVarP(&outputFile, "output-file", "o", "", "name of the pretrained model file")
+	cmd.Flags().Float64VarP(&maskingRatio, "masking-ratio", "", 0.2, "probability of masking each feature")
+	addOptimizationFlags(cmd, &trainingParameters)
+	addDataFlags(cmd, &trainingParameters)
+	addEncoderFlags(cmd, &modelParameters)
+	addWorkersFlag(cmd, &trainingParameters)
+
+	_ = cmd.MarkFlagRequired("input")
+	_ = cmd.MarkFlagRequired("output-file")
+
+	return cmd
+}
+
+// addTrainingFlags adds the flags controlling the model configuration and supervised training
+func addTrainingFlags(cmd *cobra.Command, trainingParameters *pkg.TrainingParameters, modelParameters *model.TabNetConfig) {
+	addOptimizationFlags(cmd, trainingParameters)
+	addDataFlags(cmd, trainingParameters)
+	addEncoderFlags(cmd, modelParameters)
+
+	cmd.Flags().StringSliceVarP(&trainingParameters.MultiLabelColumns, "multi-label-columns", "", nil, "list of target columns holding sets of labels")
+	cmd.Flags().StringVarP(&trainingParameters.LabelSeparator, "label-separator", "", "|", "separator of the labels of multi-label target columns")
+	cmd.Flags().Float64VarP(&trainingParameters.InputDropout, "input-dropout-probability", "", 0.0, "probability of input dropout")
+	cmd.Flags().Float64VarP(&trainingParameters.ValidationSplit, "validation-split", "", 0.0, "fraction of the training data held out for validation (optional, the test file is used for validation if not present)")
+	cmd.Flags().IntVarP(&trainingParameters.Patience, "patience", "", 0, "number of epochs without validation loss improvement before stopping (0 disables early stopping)")
+	cmd.Flags().BoolVarP(&trainingParameters.Calibrate, "calibrate", "", false, "fit the temperature of class probabilities on the validation data, for single-target classification models")
+	cmd.Flags().StringVarP(&trainingParameters.PretrainedModel, "pretrained-model", "", "", "name of a model created by golem pretrain used to initialize the encoder (optional)")
+	cmd.Flags().Float64SliceVarP(&trainingParameters.TargetWeights, "target-weights", "", nil, "weight of the loss of each target of multi-target models, in the order of the target columns")
+	cmd.Flags().StringVarP(&trainingParameters.WeightColumn, "weight-column", "", "", "column holding the sample weight of each row, scaling its loss and its contribution to the metrics")
+	cmd.Flags().StringSliceVarP(&trainingParameters.ClassWeights, "class-weights", "", nil, "weights of the classes of the target in the loss, as class=weight pairs, or \"balanced\" to weight classes inversely to their frequency")
+	cmd.Flags().StringVarP(&trainingParameters.Loss, "loss", "", "mse", "loss of continuous targets: mse, huber, quantile, poisson or tweedie")
+	cmd.Flags().Float64VarP(&trainingParameters.HuberDelta, "huber-delta", "", 1.0, "residual, in standard deviations of the target, from which the Huber loss is linear")
+	cmd.Flags().Float64VarP(&trainingParameters.Quantile, "quantile", "", 0.5, "quantile of the target predicted with the quantile loss")
+	cmd.Flags().Float64SliceVarP(&trainingParameters.Quantiles, "quantiles", "", nil, "quantiles of the target predicted together with the quantile loss, including the median, giving prediction intervals, e.g. 0.05,0.5,0.95")
+	cmd.Flags().Float64VarP(&trainingParameters.TweediePower, "tweedie-power", "", 1.5, "power of the Tweedie deviance, between 1 and 2")
+	cmd.Flags().Float64VarP(&modelParameters.ReconstructionLossWeight, "reconstruction-loss-weight", "", 0.0000, "weight of the reconstruction loss in total loss")
+	cmd.Flags().Float64VarP(&modelParameters.TargetLossWeight, "target-loss-weight", "", 1.0000, "weight of the target loss in total loss")
+}
+
+// addOptimizationFlags adds the flags controlling the optimizer and the learning rate schedule, shared by training
+// and pretraining
+func addOptimizationFlags(cmd *cobra.Command, trainingParameters *pkg.TrainingParameters) {
 	cmd.Flags().IntVarP(&trainingParameters.BatchSize, "batch-size", "b", 16, "batch size")
 	cmd.Flags().Float64VarP(&trainingParameters.LearningRate, "learning-rate", "l", 0.01, "learning rate")
 	cmd.Flags().IntVarP(&trainingParameters.ReportInterval, "report-interval", "r", 10, "loss report interval")
 	cmd.Flags().IntVarP(&trainingParameters.NumEpochs, "num-epochs", "n", 10, "number of epochs to train")
 	cmd.Flags().Uint64VarP(&trainingParameters.RndSeed, "random-seed", "x", 42, "random seed")
+	cmd.Flags().StringVarP(&trainingParameters.LearningRateSchedule, "lr-schedule", "", "constant", "schedule of the learning rate: constant, step, exponential, cosine or onecycle")
+	cmd.Flags().Float64VarP(&trainingParameters.LearningRateDecay, "lr-decay", "", 0.95, "factor of the learning rate every --lr-decay-epochs epochs with the step schedule, and every epoch with the exponential schedule")
+	cmd.Flags().IntVarP(&trainingParameters.LearningRateDecayEpochs, "lr-decay-epochs", "", 10, "number of epochs between decays of the learning rate with the step schedule")
+	cmd.Flags().Float64VarP(&trainingParameters.CycleEpochs, "cycle-epochs", "", 0, "number of epochs of the first cycle of the cosine schedule, all the epochs when zero")
+	cmd.Flags().Float64VarP(&trainingParameters.CycleMultiplier, "cycle-multiplier", "", 1, "factor of the number of epochs of each cycle of the cosine schedule from the previous cycle")
+	cmd.Flags().Float64VarP(&trainingParameters.MinLearningRate, "min-learning-rate", "", 0, "learning rate at the end of the cycles of the cosine and onecycle schedules")
+	cmd.Flags().Float64VarP(&trainingParameters.WarmupEpochs, "warmup-epochs", "", 0, "number of epochs over which the learning rate increases linearly from zero at the start of training")
+	cmd.Flags().StringVarP(&trainingParameters.Optimizer, "optimizer", "", "adam", "gradient descent method: adam, radam, sgd, rmsprop or adagrad")
+	cmd.Flags().Float64VarP(&trainingParameters.Beta1, "beta1", "", 0.9, "decay rate of the first moment estimates of adam and radam")
+	cmd.Flags().Float64VarP(&trainingParameters.Beta2, "beta2", "", 0.999, "decay rate of the second moment estimates of adam and radam")
+	cmd.Flags().Float64VarP(&trainingParameters.Epsilon, "epsilon", "", 1e-8, "term added to the denominator of the updates of adam, radam, rmsprop and adagrad for numerical stability")
+	cmd.Flags().Float64VarP(&trainingParameters.Momentum, "momentum", "", 0.9, "momentum of sgd")
+	cmd.Flags().BoolVarP(&trainingParameters.Nesterov, "nesterov", "", false, "use Nesterov momentum with sgd")
+	cmd.Flags().Float64VarP(&trainingParameters.RMSPropDecay, "rmsprop-decay", "", 0.95, "decay rate of the average of the squared gradients of rmsprop")
+	cmd.Flags().Float64VarP(&trainingParameters.WeightDecay, "weight-decay", "", 0, "decoupled weight decay, shrinking the parameters by their product with the weight decay and the learning rate after each update; batch normalization and categorical embeddings are not decayed")
+	cmd.Flags().Float64VarP(&trainingParameters.L2Regularization, "l2-regularization", "", 0, "weight of the L2 regularization of the parameters, except batch normalization and categorical embeddings, added to the gradients after clipping")
+	cmd.Flags().Float64VarP(&trainingParameters.ClipValue, "clip-value", "", 2000, "maximum absolute value of the gradients, zero for no clipping by value")
+	cmd.Flags().Float64VarP(&trainingParameters.ClipNorm, "clip-norm", "", 0, "maximum L2 norm of all the gradients together, replacing the clipping by value when not zero")
+}
+
+// addDataFlags adds the flags controlling the parsing of the feature columns, shared by training and pretraining
+func addDataFlags(cmd *cobra.Command, trainingParameters *pkg.TrainingParameters) {
 	cmd.Flags().StringSliceVarP(&trainingParameters.CategoricalColumns, "categorical-columns", "", nil, "list of columns holding categorical data")
-	cmd.Flags().Float64VarP(&trainingParameters.InputDropout, "input-dropout-probability", "", 0.0, "probability of input dropout")
+	cmd.Flags().StringSliceVarP(&trainingParameters.MissingValues, "missing-values", "", nil, "list of values representing a missing value (e.g. \"NA,?\")")
+	cmd.Flags().StringVarP(&trainingParameters.Imputation, "imputation", "", "mean", "imputation strategy for missing values: mean, median, constant or most-frequent")
+	cmd.Flags().Float64VarP(&trainingParameters.ImputationConstant, "imputation-constant", "", 0.0, "value replacing missing continuous values with the constant imputation strategy")
+	cmd.Flags().BoolVarP(&trainingParameters.MissingIndicators, "missing-indicators", "", false, "add an is-missing indicator feature for each column with missing values")
+	cmd.Flags().IntVarP(&trainingParameters.MinCategoryFrequency, "min-category-frequency", "", 1, "categorical values seen less often than this are folded into the unknown category")
+	cmd.Flags().IntVarP(&trainingParameters.RareCategoryFrequency, "rare-category-frequency", "", 10, "categorical values seen less often than this are considered rare")
+	cmd.Flags().Float64VarP(&trainingParameters.UnknownCategoryProbability, "unknown-category-probability", "", 0.0, "probability of replacing a rare categorical value with the unknown category during training")
+}
 
+// addEncoderFlags adds the flags controlling the configuration of the encoder, shared by training and pretraining
+func addEncoderFlags(cmd *cobra.Command, modelParameters *model.TabNetConfig) {
 	cmd.Flags().IntVarP(&modelParameters.CategoricalEmbeddingDimension, "categorical-embedding-size", "c", 1, "size of categorical embeddings")
 	cmd.Flags().IntVarP(&modelParameters.NumDecisionSteps, "num-decision-steps", "s", 2, "number of decision steps")
 	cmd.Flags().IntVarP(&modelParameters.IntermediateFeatureDimension, "feature-dimension", "f", 4, "feature dimension")
 	cmd.Flags().IntVarP(&modelParameters.OutputDimension, "output-dimension", "k", 4, "output dimension")
 	cmd.Flags().Float64VarP(&modelParameters.RelaxationFactor, "relaxation-factor", "g", 1.5, "relaxation factor")
 	cmd.Flags().Float64VarP(&modelParameters.BatchMomentum, "batch-momentum", "", 0.9, "batch momentum")
+	cmd.Flags().IntVarP(&modelParameters.VirtualBatchSize, "virtual-batch-size", "", 0, "size of the virtual batches of ghost batch normalization (0 normalizes over the whole batch)")
 	cmd.Flags().Float64VarP(&modelParameters.SparsityLossWeight, "sparsity-loss-weight", "", 0.0001, "weight of the sparsity loss in total loss")
-	cmd.Flags().Float64VarP(&modelParameters.ReconstructionLossWeight, "reconstruction-loss-weight", "", 0.0000, "weight of the reconstruction loss in total loss")
-	cmd.Flags().Float64VarP(&modelParameters.TargetLossWeight, "target-loss-weight", "", 1.0000, "weight of the target loss in total loss")
-
-	cmd.Flags().StringVarP(&targetColumn, "target-column", "t", "", "target column")
-
-	_ = cmd.MarkFlagRequired("train-file")
-	_ = cmd.MarkFlagRequired("output-file")
-	_ = cmd.MarkFlagRequired("target-column")
+}
 
-	return cmd
+// addWorkersFlag adds the flag controlling the number of workers training each batch. The tune command trains
+// trials concurrently instead, with its own workers flag.
+func addWorkersFlag(cmd *cobra.Command, trainingParameters *pkg.TrainingParameters) {
+	cmd.Flags().IntVarP(&trainingParameters.Workers, "workers", "", 1, "number of goroutines training each batch concurrently, each on a shard of the batch; a given random seed and number of workers give reproducible weights")
 }
 
 func TestCommand() *cobra.Command {
@@ -68,20 +244,26 @@ func TestCommand() *cobra.Command {
 	var inputFile string
 	var outputFile string
 	var attentionMapFile string
+	var metricsFile string
+	var attributions bool
+	var exactMetrics bool
 
 	var cmd = &cobra.Command{
 		Use:   "test -m modelFile -i trainFile [-o outputFile] [-a attentionOutputFile]",
 		Short: "Runs the provided model on the specified data input and optionally writes the results and attention map",
 		Args:  cobra.ArbitraryArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return pkg.Test(modelFile, inputFile, outputFile, attentionMapFile)
+			return pkg.Test(modelFile, inputFile, outputFile, attentionMapFile, metricsFile, attributions, exactMetrics)
 		},
 	}
 
 	cmd.Flags().StringVarP(&modelFile, "model", "m", "", "name of model to test")
-	cmd.Flags().StringVarP(&inputFile, "input", "i", "", "name of data input file (optional, uses stdin if not present)")
-	cmd.Flags().StringVarP(&outputFile, "output", "o", "", "name of output file (optional)")
-	cmd.Flags().StringVarP(&attentionMapFile, "attentionMap", "a", "", "name of attention map output file (optional)")
+	cmd.Flags().StringVarP(&inputFile, "input", "i", "", "name of data input file (optional, uses stdin if not present or -)")
+	cmd.Flags().StringVarP(&outputFile, "output", "o", "", "name of output file (optional, - writes to stdout)")
+	cmd.Flags().StringVarP(&attentionMapFile, "attentionMap", "a", "", "name of attention map output file (optional, - writes to stdout)")
+	cmd.Flags().StringVarP(&metricsFile, "metrics-output", "", "", "name of the JSON metrics output file (optional)")
+	cmd.Flags().BoolVarP(&attributions, "attributions", "", false, "append the aggregate feature attributions of each prediction to the output file")
+	cmd.Flags().BoolVarP(&exactMetrics, "exact-metrics", "", false, "also compute the ROC and precision-recall AUCs, the median absolute error and the residuals by decile, which keeps the scores of every row in memory")
 
 	_ = cmd.MarkFlagRequired("model")
 
@@ -89,6 +271,150 @@ func TestCommand() *cobra.Command {
 
 }
 
+func ExplainCommand() *cobra.Command {
+	var modelFile string
+	var inputFile string
+	var outputFile string
+
+	var cmd = &cobra.Command{
+		Use:   "explain -m modelFile -i dataFile [-o outputFile]",
+		Short: "Computes the global feature importances of the model from its attention masks over the data",
+		Args:  cobra.ArbitraryArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return pkg.Explain(modelFile, inputFile, outputFile)
+		},
+	}
+
+	cmd.Flags().StringVarP(&modelFile, "model", "m", "", "name of model to explain")
+	cmd.Flags().StringVarP(&inputFile, "input", "i", "", "name of data input file")
+	cmd.Flags().StringVarP(&outputFile, "output", "o", "", "name of the ranked feature importance output file (optional)")
+
+	_ = cmd.MarkFlagRequired("model")
+	_ = cmd.MarkFlagRequired("input")
+
+	return cmd
+}
+
+func OODCommand() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "ood",
+		Short: "Detects out-of-distribution data from the reconstruction loss of a model",
+	}
+	cmd.AddCommand(OODCalibrateCommand())
+	cmd.AddCommand(OODScoreCommand())
+	return cmd
+}
+
+func OODCalibrateCommand() *cobra.Command {
+	var modelFile string
+	var inputFile string
+	var outputFile string
+	var percentile float64
+	var contamination float64
+
+	var cmd = &cobra.Command{
+		Use:   "calibrate -m modelFile -i trainData [-o outputFile]",
+		Short: "Calibrates the out-of-distribution threshold of the model on the training data and saves it in the model",
+		Args:  cobra.ArbitraryArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if outputFile == "" {
+				outputFile = modelFile
+			}
+			if contamination > 0 {
+				percentile = 100 * (1 - contamination)
+			}
+			return pkg.CalibrateOOD(modelFile, inputFile, outputFile, percentile)
+		},
+	}
+
+	cmd.Flags().StringVarP(&modelFile, "model", "m", "", "name of model to calibrate")
+	cmd.Flags().StringVarP(&inputFile, "input", "i", "", "name of data file drawn from the training distribution")
+	cmd.Flags().StringVarP(&outputFile, "output-file", "o", "", "name of the calibrated model file (optional, overwrites the model if not present)")
+	cmd.Flags().Float64VarP(&percentile, "percentile", "", 99, "percentile of the reconstruction loss on the data used as threshold")
+	cmd.Flags().Float64VarP(&contamination, "contamination", "", 0, "expected fraction of out-of-distribution rows in the data, overrides the percentile")
+
+	_ = cmd.MarkFlagRequired("model")
+	_ = cmd.MarkFlagRequired("input")
+
+	return cmd
+}
+
+func OODScoreCommand() *cobra.Command {
+	var modelFile string
+	var inputFile string
+	var outputFile string
+	var numFeatures int
+
+	var cmd = &cobra.Command{
+		Use:   "score -m modelFile -i dataFile -o outputFile",
+		Short: "Writes the out-of-distribution score of each row and the features with the largest reconstruction error",
+		Args:  cobra.ArbitraryArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return pkg.ScoreOOD(modelFile, inputFile, outputFile, numFeatures)
+		},
+	}
+
+	cmd.Flags().StringVarP(&modelFile, "model", "m", "", "name of calibrated model")
+	cmd.Flags().StringVarP(&inputFile, "input", "i", "", "name of data input file, which does not need to hold the target column")
+	cmd.Flags().StringVarP(&outputFile, "output", "o", "", "name of output file")
+	cmd.Flags().IntVarP(&numFeatures, "top-features", "", 3, "number of features with the largest reconstruction error written for each row")
+
+	_ = cmd.MarkFlagRequired("model")
+	_ = cmd.MarkFlagRequired("input")
+	_ = cmd.MarkFlagRequired("output")
+
+	return cmd
+}
+
+func PredictCommand() *cobra.Command {
+	var modelFile string
+	var inputFile string
+	var outputFile string
+	var passthroughColumns []string
+
+	var cmd = &cobra.Command{
+		Use:   "predict -m modelFile [-i dataFile] [-o outputFile]",
+		Short: "Writes the predictions of a model for unlabeled data",
+		Args:  cobra.ArbitraryArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return pkg.Predict(modelFile, inputFile, outputFile, passthroughColumns)
+		},
+	}
+
+	cmd.Flags().StringVarP(&modelFile, "model", "m", "", "name of model")
+	cmd.Flags().StringVarP(&inputFile, "input", "i", "", "name of data input file, the target column may be absent or empty (optional, uses stdin if not present or -)")
+	cmd.Flags().StringVarP(&outputFile, "output", "o", "", "name of output file (optional, uses stdout if not present or -)")
+	cmd.Flags().StringSliceVarP(&passthroughColumns, "passthrough-columns", "", nil, "list of input columns copied to each prediction, such as a row ID")
+
+	_ = cmd.MarkFlagRequired("model")
+
+	return cmd
+}
+
+func ServeCommand() *cobra.Command {
+	var modelFile string
+	var address string
+	var options pkg.ServerOptions
+
+	var cmd = &cobra.Command{
+		Use:   "serve -m modelFile",
+		Short: "Serves the predictions of a model over a JSON HTTP API",
+		Args:  cobra.ArbitraryArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return pkg.Serve(modelFile, address, options)
+		},
+	}
+
+	cmd.Flags().StringVarP(&modelFile, "model", "m", "", "name of model to serve")
+	cmd.Flags().StringVarP(&address, "address", "", ":8080", "address the server listens on")
+	cmd.Flags().Int64VarP(&options.MaxRequestBytes, "max-request-bytes", "", 1<<20, "maximum size of a request body in bytes")
+	cmd.Flags().IntVarP(&options.MaxBatchSize, "max-batch-size", "", 1000, "maximum number of records of a batch request")
+
+	_ = cmd.MarkFlagRequired("model")
+
+	return cmd
+}
+
 var logLevel string
 var logFormat string
 
@@ -101,6 +427,13 @@ func main() {
 
 	Main.AddCommand(TrainCommand())
 	Main.AddCommand(TestCommand())
+	Main.AddCommand(PredictCommand())
+	Main.AddCommand(CrossValidateCommand())
+	Main.AddCommand(TuneCommand())
+	Main.AddCommand(ExplainCommand())
+	Main.AddCommand(PretrainCommand())
+	Main.AddCommand(OODCommand())
+	Main.AddCommand(ServeCommand())
 
 	if err := Main.Execute(); err != nil {
 		panic(err)
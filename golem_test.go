@@ -2,16 +2,28 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
+	"github.com/nlpodyssey/spago/pkg/ml/nn"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"golem/pkg"
+	"golem/pkg/io"
 )
 
 type logLine map[string]interface{}
@@ -96,14 +108,42 @@ func TestGolem(t *testing.T) {
 			TrainCmdLine:        "train -i datasets/iris/iris.train -o $MODEL -t species --categorical-columns species -n 20 -s 3 --sparsity-loss-weight 0.01",
 			TestCmdLine:         "test -m $MODEL -i datasets/iris/iris.test",
 			ExpectedTrainOutput: []logExpectation{{key: "epoch", exactValue: 19.0}},
-			ExpectedTestOutput:  []logExpectation{{key: "MacroF1", minValue: 0.85, maxValue: 1}},
+			ExpectedTestOutput:  []logExpectation{{key: "MicroF1", minValue: 0.85, maxValue: 1}},
+		},
+		{
+			Name:                "Iris Early Stopping",
+			TrainCmdLine:        "train -i datasets/iris/iris.train -o $MODEL -t species --categorical-columns species -n 40 -s 3 --sparsity-loss-weight 0.01 --validation-split 0.2 --patience 5 --calibrate",
+			TestCmdLine:         "test -m $MODEL -i datasets/iris/iris.test",
+			ExpectedTrainOutput: []logExpectation{{key: "bestEpoch", minValue: 0, maxValue: 39}, {key: "temperature", minValue: 0.001, maxValue: 1000}},
+			ExpectedTestOutput:  []logExpectation{{key: "MicroF1", minValue: 0.8, maxValue: 1}},
+		},
+		{
+			Name:                "Iris Ghost Batch Normalization",
+			TrainCmdLine:        "train -i datasets/iris/iris.train -o $MODEL -t species --categorical-columns species -n 40 -s 3 -b 64 --virtual-batch-size 16 --sparsity-loss-weight 0.01",
+			TestCmdLine:         "test -m $MODEL -i datasets/iris/iris.test",
+			ExpectedTrainOutput: []logExpectation{{key: "epoch", exactValue: 39.0}},
+			ExpectedTestOutput:  []logExpectation{{key: "MicroF1", minValue: 0.8, maxValue: 1}},
+		},
+		{
+			Name:                "Iris Cosine Schedule",
+			TrainCmdLine:        "train -i datasets/iris/iris.train -o $MODEL -t species --categorical-columns species -n 20 -s 3 --sparsity-loss-weight 0.01 -l 0.02 --lr-schedule cosine --warmup-epochs 2 --min-learning-rate 0.001",
+			TestCmdLine:         "test -m $MODEL -i datasets/iris/iris.test",
+			ExpectedTrainOutput: []logExpectation{{key: "epoch", exactValue: 19.0}, {key: "learningRate", minValue: 0.001, maxValue: 0.002}},
+			ExpectedTestOutput:  []logExpectation{{key: "MicroF1", minValue: 0.85, maxValue: 1}},
+		},
+		{
+			Name:                "Iris RAdam Weight Decay",
+			TrainCmdLine:        "train -i datasets/iris/iris.train -o $MODEL -t species --categorical-columns species -n 20 -s 3 --sparsity-loss-weight 0.01 -l 0.1 --optimizer radam --weight-decay 0.01 --clip-norm 10",
+			TestCmdLine:         "test -m $MODEL -i datasets/iris/iris.test",
+			ExpectedTrainOutput: []logExpectation{{key: "epoch", exactValue: 19.0}},
+			ExpectedTestOutput:  []logExpectation{{key: "MicroF1", minValue: 0.85, maxValue: 1}},
 		},
 		{
 			Name:                "Breast Cancer",
 			TrainCmdLine:        "train -i datasets/breast_cancer/breast-cancer.train -o $MODEL -t Class --categorical-columns Class,Age,Menopause,Tumor-size,Inv-nodes,Node-caps,Breast,Breast-quad,Irradiat  -s 6 -n 40",
 			TestCmdLine:         "test -i datasets/breast_cancer/breast-cancer.test -m $MODEL ",
 			ExpectedTrainOutput: []logExpectation{{key: "epoch", exactValue: 39.0}},
-			ExpectedTestOutput:  []logExpectation{{key: "MacroF1", minValue: 0.67, maxValue: 1}},
+			ExpectedTestOutput:  []logExpectation{{key: "MicroF1", minValue: 0.66, maxValue: 1}},
 		},
 
 		{
@@ -113,6 +153,27 @@ func TestGolem(t *testing.T) {
 			ExpectedTrainOutput: []logExpectation{{key: "epoch", exactValue: 19.0}},
 			ExpectedTestOutput:  []logExpectation{{key: "R-squared", minValue: 0.6, maxValue: 0.75}},
 		},
+		{
+			Name:                "Boston Housing Huber",
+			TrainCmdLine:        "train -i datasets/boston_housing/boston-housing-train.csv -o $MODEL -t medv  -n 20 -s 3 --sparsity-loss-weight 0.01 --loss huber",
+			TestCmdLine:         "test -i datasets/boston_housing/boston-housing-test.csv -m $MODEL ",
+			ExpectedTrainOutput: []logExpectation{{key: "epoch", exactValue: 19.0}},
+			ExpectedTestOutput:  []logExpectation{{key: "R-squared", minValue: 0.3, maxValue: 0.75}},
+		},
+		{
+			Name:                "Boston Housing Poisson",
+			TrainCmdLine:        "train -i datasets/boston_housing/boston-housing-train.csv -o $MODEL -t medv  -n 40 -s 3 --sparsity-loss-weight 0.01 --loss poisson",
+			TestCmdLine:         "test -i datasets/boston_housing/boston-housing-test.csv -m $MODEL ",
+			ExpectedTrainOutput: []logExpectation{{key: "epoch", exactValue: 39.0}},
+			ExpectedTestOutput:  []logExpectation{{key: "R-squared", minValue: 0.3, maxValue: 0.75}},
+		},
+		{
+			Name:                "Boston Housing Quantiles",
+			TrainCmdLine:        "train -i datasets/boston_housing/boston-housing-train.csv -o $MODEL -t medv  -n 20 -s 3 --sparsity-loss-weight 0.01 --loss quantile --quantiles 0.05,0.5,0.95",
+			TestCmdLine:         "test -i datasets/boston_housing/boston-housing-test.csv -m $MODEL ",
+			ExpectedTrainOutput: []logExpectation{{key: "epoch", exactValue: 19.0}},
+			ExpectedTestOutput:  []logExpectation{{key: "R-squared", minValue: 0.3, maxValue: 0.8}, {key: "Coverage", minValue: 0.75, maxValue: 1}},
+		},
 	}
 
 	for _, tt := range tests {
@@ -160,3 +221,812 @@ func createArgs(line, modelFileName string) []string {
 	result := strings.Split(line, " ")
 	return result
 }
+
+// testDir returns a temporary directory holding the files of the test, removed when the test ends
+func testDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+// trainTestModel trains a model with the train command line, in which $MODEL stands for the model file, discarding
+// the log. It returns the name of the model file, created in dir.
+func trainTestModel(t *testing.T, dir, line string) (modelFileName string) {
+	modelFileName = dir + "/model"
+	log.Logger = zerolog.New(ioutil.Discard)
+	trainCmd := TrainCommand()
+	trainCmd.SetArgs(createArgs(line, modelFileName))
+	require.NoError(t, trainCmd.Execute())
+	return modelFileName
+}
+
+func TestCrossValidate(t *testing.T) {
+	predictionsFile, err := ioutil.TempFile("", "")
+	require.NoError(t, err)
+	predictionsFileName := predictionsFile.Name()
+	predictionsFile.Close()
+	defer os.Remove(predictionsFileName)
+
+	cvCmd := CrossValidateCommand()
+	cvCmd.SetArgs(strings.Split("cv -i datasets/iris/iris.train -t species --categorical-columns species --folds 3 -n 10 -s 3 --sparsity-loss-weight 0.01 -o "+predictionsFileName, " "))
+
+	b := bytes.NewBufferString("")
+	log.Logger = zerolog.New(b)
+	err = cvCmd.Execute()
+	require.NoError(t, err)
+	out, err := parseOutputLog(b.String())
+	require.NoError(t, err)
+	require.False(t, hasExactValue(out, "level", "fatal"))
+	require.NoError(t, checkExpectation(out, logExpectation{key: "fold", exactValue: 2.0}))
+	require.NoError(t, checkExpectation(out, logExpectation{key: "Metric", exactValue: "MacroF1"}))
+
+	predictions, err := ioutil.ReadFile(predictionsFileName)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(predictions)), "\n")
+	require.Equal(t, "row,fold,label,predicted,probability,probability_setosa,probability_versicolor,probability_virginica,reconstructionLoss", lines[0])
+	require.Equal(t, 121, len(lines))
+}
+
+func TestTune(t *testing.T) {
+	dir := testDir(t)
+
+	searchSpaceFileName := dir + "/space.json"
+	require.NoError(t, ioutil.WriteFile(searchSpaceFileName,
+		[]byte(`{"learning-rate": {"min": 0.005, "max": 0.05, "log": true}, "num-decision-steps": {"choices": [2, 3]}}`), 0644))
+	modelFileName := dir + "/model"
+	leaderboardFileName := dir + "/leaderboard.csv"
+
+	tuneCmd := TuneCommand()
+	tuneCmd.SetArgs(strings.Split("tune -i datasets/iris/iris.train -t species --categorical-columns species --validation-split 0.2 "+
+		"--method halving --trials 4 --workers 2 --min-epochs 2 --reduction-factor 2 -n 8 --search-space "+searchSpaceFileName+
+		" -o "+modelFileName+" --leaderboard "+leaderboardFileName, " "))
+
+	b := bytes.NewBufferString("")
+	log.Logger = zerolog.New(b)
+	err := tuneCmd.Execute()
+	require.NoError(t, err)
+	out, err := parseOutputLog(b.String())
+	require.NoError(t, err)
+	require.False(t, hasExactValue(out, "level", "fatal"))
+	require.NoError(t, checkExpectation(out, logExpectation{key: "message", exactValue: "Best trial"}))
+
+	leaderboard, err := ioutil.ReadFile(leaderboardFileName)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(leaderboard)), "\n")
+	require.Equal(t, "rank,trial,epochs,learning-rate,num-decision-steps,Accuracy,BalancedAccuracy,LogLoss,Loss,MacroF1,MicroF1,PrAuc,RocAuc", lines[0])
+	// 4 trials with 2 epochs, 2 with 4 epochs and 1 with 8 epochs
+	require.Equal(t, 8, len(lines))
+
+	testCmd := TestCommand()
+	testCmd.SetArgs(strings.Split("test -i datasets/iris/iris.test -m "+modelFileName, " "))
+	require.NoError(t, testCmd.Execute())
+}
+
+func TestMetricsOutput(t *testing.T) {
+	dir := testDir(t)
+	trainMetricsFileName := dir + "/train-metrics.json"
+	testMetricsFileName := dir + "/test-metrics.json"
+
+	modelFileName := trainTestModel(t, dir, "train -i datasets/iris/iris.train -t species --categorical-columns species -n 5 "+
+		"--validation-split 0.2 --test-file datasets/iris/iris.test -o $MODEL --metrics-output "+trainMetricsFileName)
+
+	trainMetrics := map[string]map[string]interface{}{}
+	data, err := ioutil.ReadFile(trainMetricsFileName)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &trainMetrics))
+	require.Contains(t, trainMetrics, "train")
+	require.Contains(t, trainMetrics, "validation")
+	require.Contains(t, trainMetrics, "test")
+
+	// without a validation split, the test file selects the model, so its metrics are not reported as test metrics
+	selectedMetricsFileName := dir + "/selected-metrics.json"
+	b := bytes.NewBufferString("")
+	log.Logger = zerolog.New(b)
+	trainCmd := TrainCommand()
+	trainCmd.SetArgs(createArgs("train -i datasets/iris/iris.train -t species --categorical-columns species -n 5 "+
+		"--test-file datasets/iris/iris.test -o $MODEL --metrics-output "+selectedMetricsFileName, dir+"/selected"))
+	require.NoError(t, trainCmd.Execute())
+	require.Contains(t, b.String(), "no held-out test metrics")
+	selectedMetrics := map[string]map[string]interface{}{}
+	data, err = ioutil.ReadFile(selectedMetricsFileName)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &selectedMetrics))
+	require.Contains(t, selectedMetrics, "validation")
+	require.NotContains(t, selectedMetrics, "test")
+
+	testMetrics := func(line string) map[string]interface{} {
+		testCmd := TestCommand()
+		testCmd.SetArgs(strings.Split(line+" -i datasets/iris/iris.test -m "+modelFileName+" --metrics-output "+testMetricsFileName, " "))
+		require.NoError(t, testCmd.Execute())
+		metrics := map[string]interface{}{}
+		data, err := ioutil.ReadFile(testMetricsFileName)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &metrics))
+		return metrics
+	}
+
+	// the AUCs need the scores of every row, which are only kept with --exact-metrics
+	streamingMetrics := testMetrics("test")
+	require.NotContains(t, streamingMetrics, "RocAuc")
+	require.NotContains(t, streamingMetrics, "PrAuc")
+
+	exactMetrics := testMetrics("test --exact-metrics")
+	for _, key := range []string{"Loss", "Accuracy", "BalancedAccuracy", "LogLoss", "MacroF1", "MicroF1", "RocAuc", "PrAuc", "Classes", "ConfusionMatrix"} {
+		require.Contains(t, exactMetrics, key)
+	}
+	require.Equal(t, trainMetrics["test"]["Accuracy"], exactMetrics["Accuracy"])
+	require.Equal(t, exactMetrics["Accuracy"], streamingMetrics["Accuracy"])
+	require.Equal(t, exactMetrics["ConfusionMatrix"], streamingMetrics["ConfusionMatrix"])
+	confusionMatrix := exactMetrics["ConfusionMatrix"].(map[string]interface{})
+	require.Equal(t, []interface{}{"setosa", "versicolor", "virginica"}, confusionMatrix["Classes"])
+}
+
+func TestExplain(t *testing.T) {
+	dir := testDir(t)
+	importanceFileName := dir + "/importance.csv"
+
+	modelFileName := trainTestModel(t, dir, "train -i datasets/breast_cancer/breast-cancer.train -t Class "+
+		"--categorical-columns Class,Age,Menopause,Tumor-size,Inv-nodes,Node-caps,Breast,Breast-quad,Irradiat "+
+		"-c 2 -s 3 -n 5 -o $MODEL")
+
+	explainCmd := ExplainCommand()
+	explainCmd.SetArgs(strings.Split("explain -m "+modelFileName+" -i datasets/breast_cancer/breast-cancer.test -o "+importanceFileName, " "))
+	require.NoError(t, explainCmd.Execute())
+
+	data, err := ioutil.ReadFile(importanceFileName)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Equal(t, "rank,column,importance,step1,step2", lines[0])
+	require.Equal(t, 10, len(lines))
+
+	columns := map[string]bool{}
+	total := 0.0
+	previous := 1.0
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, ",")
+		columns[fields[1]] = true
+		importance, err := strconv.ParseFloat(fields[2], 64)
+		require.NoError(t, err)
+		require.LessOrEqual(t, importance, previous)
+		previous = importance
+		total += importance
+	}
+	require.InDelta(t, 1.0, total, 1e-4)
+	require.True(t, columns["Deg-malig"])
+	require.True(t, columns["Irradiat"])
+	require.False(t, columns["Class"])
+}
+
+func TestAttributions(t *testing.T) {
+	dir := testDir(t)
+	outputFileName := dir + "/predictions.csv"
+	attentionFileName := dir + "/attention.csv"
+
+	modelFileName := trainTestModel(t, dir, "train -i datasets/breast_cancer/breast-cancer.train -t Class "+
+		"--categorical-columns Class,Age,Menopause,Tumor-size,Inv-nodes,Node-caps,Breast,Breast-quad,Irradiat "+
+		"-c 2 -s 3 -n 5 -o $MODEL")
+
+	testCmd := TestCommand()
+	testCmd.SetArgs(strings.Split("test -m "+modelFileName+" -i datasets/breast_cancer/breast-cancer.test --attributions "+
+		"-o "+outputFileName+" -a "+attentionFileName, " "))
+	require.NoError(t, testCmd.Execute())
+
+	data, err := ioutil.ReadFile(outputFileName)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	header := strings.Split(lines[0], ",")
+	require.Equal(t, []string{"reconstructionLoss", "attribution_Age", "attribution_Menopause", "attribution_Tumor-size",
+		"attribution_Inv-nodes", "attribution_Node-caps", "attribution_Deg-malig", "attribution_Breast",
+		"attribution_Breast-quad", "attribution_Irradiat"}, header[len(header)-10:])
+	normalized := 0
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, ",")
+		require.Equal(t, len(header), len(fields))
+		total := 0.0
+		for _, field := range fields[len(fields)-9:] {
+			attribution, err := strconv.ParseFloat(field, 64)
+			require.NoError(t, err)
+			total += attribution
+		}
+		// the attributions of a row are all zero when none of its decision steps contributes to the output
+		if total != 0 {
+			require.InDelta(t, 1.0, total, 1e-4)
+			normalized++
+		}
+	}
+	require.Greater(t, normalized, 0)
+
+	data, err = ioutil.ReadFile(attentionFileName)
+	require.NoError(t, err)
+	lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+	header = strings.Split(lines[0], ",")
+	require.Equal(t, []string{"line", "step", "Deg-malig", "Age_0", "Age_1"}, header[:5])
+	for _, line := range lines[1:] {
+		require.Equal(t, len(header), len(strings.Split(line, ",")))
+	}
+}
+
+func TestPretrain(t *testing.T) {
+	dir := testDir(t)
+
+	// the unlabeled data holds the features of the training data, without the target column
+	data, err := ioutil.ReadFile("datasets/iris/iris.train")
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	header := strings.Split(lines[0], ",")
+	targetIndex := -1
+	for i, column := range header {
+		if column == "species" {
+			targetIndex = i
+		}
+	}
+	require.NotEqual(t, -1, targetIndex)
+	unlabeled := &strings.Builder{}
+	for _, line := range lines {
+		fields := strings.Split(line, ",")
+		fields = append(fields[:targetIndex], fields[targetIndex+1:]...)
+		unlabeled.WriteString(strings.Join(fields, ",") + "\n")
+	}
+	unlabeledFileName := dir + "/unlabeled.csv"
+	require.NoError(t, ioutil.WriteFile(unlabeledFileName, []byte(unlabeled.String()), 0644))
+	pretrainedFileName := dir + "/pretrained"
+	modelFileName := dir + "/model"
+
+	b := bytes.NewBufferString("")
+	log.Logger = zerolog.New(b)
+	pretrainCmd := PretrainCommand()
+	pretrainCmd.SetArgs(strings.Split("pretrain -i "+unlabeledFileName+" -o "+pretrainedFileName+" -n 5 -s 3", " "))
+	require.NoError(t, pretrainCmd.Execute())
+	out, err := parseOutputLog(b.String())
+	require.NoError(t, err)
+	require.NoError(t, checkExpectation(out, logExpectation{key: "epoch", exactValue: 4.0}))
+	require.NoError(t, checkExpectation(out, logExpectation{key: "reconstructionLoss", minValue: 0, maxValue: 10}))
+
+	// options of supervised training are rejected rather than ignored
+	pretrainCmd = PretrainCommand()
+	pretrainCmd.SetArgs(strings.Split("pretrain -i "+unlabeledFileName+" -o "+pretrainedFileName+" --loss huber", " "))
+	pretrainCmd.SilenceUsage = true
+	pretrainCmd.SilenceErrors = true
+	require.EqualError(t, pretrainCmd.Execute(), "unknown flag: --loss")
+
+	b.Reset()
+	trainCmd := TrainCommand()
+	trainCmd.SetArgs(strings.Split("train -i datasets/iris/iris.train -t species --categorical-columns species -n 20 -s 3 "+
+		"--sparsity-loss-weight 0.01 --pretrained-model "+pretrainedFileName+" -o "+modelFileName, " "))
+	require.NoError(t, trainCmd.Execute())
+	out, err = parseOutputLog(b.String())
+	require.NoError(t, err)
+	require.False(t, hasExactValue(out, "level", "fatal"))
+	require.True(t, hasExactValue(out, "pretrainedModel", pretrainedFileName))
+	require.NoError(t, checkExpectation(out, logExpectation{key: "MicroF1", minValue: 0.8, maxValue: 1}))
+
+	testCmd := TestCommand()
+	testCmd.SetArgs(strings.Split("test -i datasets/iris/iris.test -m "+pretrainedFileName, " "))
+	testCmd.SilenceUsage = true
+	testCmd.SilenceErrors = true
+	require.Error(t, testCmd.Execute())
+}
+
+func TestOOD(t *testing.T) {
+	dir := testDir(t)
+	calibratedFileName := dir + "/calibrated"
+	dataFileName := dir + "/data.csv"
+	scoresFileName := dir + "/scores.csv"
+
+	// the last row has an out-of-distribution sepal width
+	data, err := ioutil.ReadFile("datasets/iris/iris.test")
+	require.NoError(t, err)
+	data = append(data, []byte("5.0,40.0,1.5,0.2,setosa\n")...)
+	require.NoError(t, ioutil.WriteFile(dataFileName, data, 0644))
+
+	modelFileName := trainTestModel(t, dir, "train -i datasets/iris/iris.train -t species --categorical-columns species -n 20 -s 3 "+
+		"--reconstruction-loss-weight 1 -o $MODEL")
+
+	b := bytes.NewBufferString("")
+	log.Logger = zerolog.New(b)
+	calibrateCmd := OODCommand()
+	calibrateCmd.SetArgs(strings.Split("calibrate -m "+modelFileName+" -i datasets/iris/iris.train --contamination 0.05 -o "+calibratedFileName, " "))
+	require.NoError(t, calibrateCmd.Execute())
+	out, err := parseOutputLog(b.String())
+	require.NoError(t, err)
+	require.NoError(t, checkExpectation(out, logExpectation{key: "percentile", minValue: 94.99, maxValue: 95.01}))
+
+	scoreCmd := OODCommand()
+	scoreCmd.SetArgs(strings.Split("score -m "+calibratedFileName+" -i "+dataFileName+" --top-features 2 -o "+scoresFileName, " "))
+	require.NoError(t, scoreCmd.Execute())
+
+	scores, err := ioutil.ReadFile(scoresFileName)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(scores)), "\n")
+	require.Equal(t, "row,oodScore,ood,feature1,error1,feature2,error2", lines[0])
+	require.Equal(t, 32, len(lines))
+	outlier := strings.Split(lines[31], ",")
+	require.Equal(t, "30", outlier[0])
+	require.Equal(t, "true", outlier[2])
+	require.Equal(t, "sepal_width", outlier[3])
+
+	// the columns are matched by name, so the same rows without the target column, which comes last, and with
+	// the other columns reversed get the same scores
+	var unlabeled []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		values := strings.Split(line, ",")
+		unlabeled = append(unlabeled, strings.Join([]string{values[3], values[2], values[1], values[0]}, ","))
+	}
+	unlabeledFileName := dir + "/unlabeled.csv"
+	unlabeledScoresFileName := dir + "/unlabeled-scores.csv"
+	require.NoError(t, ioutil.WriteFile(unlabeledFileName, []byte(strings.Join(unlabeled, "\n")+"\n"), 0644))
+	scoreCmd = OODCommand()
+	scoreCmd.SetArgs(strings.Split("score -m "+calibratedFileName+" -i "+unlabeledFileName+" --top-features 2 -o "+unlabeledScoresFileName, " "))
+	require.NoError(t, scoreCmd.Execute())
+	unlabeledScores, err := ioutil.ReadFile(unlabeledScoresFileName)
+	require.NoError(t, err)
+	require.Equal(t, string(scores), string(unlabeledScores))
+
+	scoreCmd = OODCommand()
+	scoreCmd.SetArgs(strings.Split("score -m "+modelFileName+" -i "+dataFileName+" -o "+scoresFileName, " "))
+	scoreCmd.SilenceUsage = true
+	scoreCmd.SilenceErrors = true
+	require.Error(t, scoreCmd.Execute())
+}
+
+func TestServe(t *testing.T) {
+	dir := testDir(t)
+
+	modelFileName := trainTestModel(t, dir, "train -i datasets/iris/iris.train -t species --categorical-columns species -n 20 -s 3 "+
+		"--sparsity-loss-weight 0.01 -o $MODEL")
+
+	predictor, err := pkg.LoadPredictor(modelFileName)
+	require.NoError(t, err)
+	server := httptest.NewServer(pkg.NewServer(predictor, pkg.ServerOptions{MaxRequestBytes: 1024, MaxBatchSize: 2}))
+	defer server.Close()
+
+	post := func(path, body string) (int, map[string]interface{}) {
+		resp, err := http.Post(server.URL+path, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		result := map[string]interface{}{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		return resp.StatusCode, result
+	}
+
+	for _, path := range []string{"/health", "/ready"} {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	status, result := post("/predict", `{"record": {"sepal_length": 5.7, "sepal_width": 3.8, "petal_length": 1.7, "petal_width": "0.3"}, "attention": true}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "setosa", result["prediction"])
+	probabilities := result["probabilities"].(map[string]interface{})
+	require.Len(t, probabilities, 3)
+	require.Greater(t, probabilities["setosa"].(float64), 0.5)
+	require.Contains(t, result, "reconstructionLoss")
+	require.Len(t, result["attention"], 2)
+
+	status, result = post("/predict/batch", `{"records": [{"sepal_length": 5.7, "sepal_width": 3.8, "petal_length": 1.7, "petal_width": 0.3},`+
+		`{"sepal_length": 6.2, "sepal_width": 2.2, "petal_length": 4.5, "petal_width": 1.5}]}`)
+	require.Equal(t, http.StatusOK, status)
+	predictions := result["predictions"].([]interface{})
+	require.Len(t, predictions, 2)
+	require.NotContains(t, predictions[0], "attention")
+
+	status, result = post("/predict", `{"record": {"sepal_length": 5.7}}`)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Contains(t, result["error"], "sepal_width")
+
+	status, _ = post("/predict", `{"record": `)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = post("/predict/batch", `{"records": [{}, {}, {}]}`)
+	require.Equal(t, http.StatusRequestEntityTooLarge, status)
+
+	status, _ = post("/predict", `{"record": {"sepal_length": "`+strings.Repeat("5", 2048)+`"}}`)
+	require.Equal(t, http.StatusRequestEntityTooLarge, status)
+
+	resp, err := http.Get(server.URL + "/predict")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestPredictor(t *testing.T) {
+	dir := testDir(t)
+
+	modelFileName := trainTestModel(t, dir, "train -i datasets/iris/iris.train -t species --categorical-columns species -n 20 -s 3 "+
+		"--sparsity-loss-weight 0.01 -o $MODEL")
+
+	dataFile, err := os.Open("datasets/iris/iris.test")
+	require.NoError(t, err)
+	rows, err := csv.NewReader(dataFile).ReadAll()
+	dataFile.Close()
+	require.NoError(t, err)
+	records := make([]map[string]string, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		record := map[string]string{}
+		for i, column := range rows[0] {
+			// the target column is not needed for predictions
+			if column != "species" {
+				record[column] = row[i]
+			}
+		}
+		records = append(records, record)
+	}
+
+	predictor, err := pkg.LoadPredictor(modelFileName)
+	require.NoError(t, err)
+	expected, err := predictor.Predict(context.Background(), records)
+	require.NoError(t, err)
+	require.Len(t, expected, len(records))
+	correct := 0
+	for i, prediction := range expected {
+		require.Len(t, prediction.Probabilities, 3)
+		require.Len(t, prediction.Attention, 2)
+		if prediction.Class == rows[i+1][4] {
+			correct++
+		}
+	}
+	require.Greater(t, float64(correct)/float64(len(records)), 0.8)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(records); i += 3 {
+				predictions, err := predictor.Predict(context.Background(), records[i:i+1])
+				if assert.NoError(t, err) {
+					assert.Equal(t, expected[i].Class, predictions[0].Class)
+					assert.InDelta(t, expected[i].Probabilities[expected[i].Class], predictions[0].Probabilities[expected[i].Class], 1e-5)
+					assert.InDelta(t, expected[i].ReconstructionLoss, predictions[0].ReconstructionLoss, 1e-5)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = predictor.Predict(ctx, records)
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestPredict(t *testing.T) {
+	dir := testDir(t)
+	unlabeledFileName := dir + "/unlabeled.csv"
+	emptyTargetFileName := dir + "/empty-target.csv"
+	predictionsFileName := dir + "/predictions.csv"
+
+	data, err := ioutil.ReadFile("datasets/iris/iris.test")
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	unlabeled := []string{"id,sepal_length,sepal_width,petal_length,petal_width"}
+	emptyTarget := []string{lines[0]}
+	for i, line := range lines[1:] {
+		features := line[:strings.LastIndex(line, ",")]
+		unlabeled = append(unlabeled, fmt.Sprintf("row%d,%s", i, features))
+		emptyTarget = append(emptyTarget, features+",")
+	}
+	// a row that cannot be parsed is skipped
+	unlabeled = append(unlabeled, "bad,5.0,abc,1.5,0.2")
+	require.NoError(t, ioutil.WriteFile(unlabeledFileName, []byte(strings.Join(unlabeled, "\n")+"\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(emptyTargetFileName, []byte(strings.Join(emptyTarget, "\n")+"\n"), 0644))
+
+	modelFileName := trainTestModel(t, dir, "train -i datasets/iris/iris.train -t species --categorical-columns species -n 20 -s 3 "+
+		"--sparsity-loss-weight 0.01 -o $MODEL")
+
+	predictCmd := PredictCommand()
+	predictCmd.SetArgs(strings.Split("predict -m "+modelFileName+" -i "+unlabeledFileName+" --passthrough-columns id -o "+predictionsFileName, " "))
+	require.NoError(t, predictCmd.Execute())
+
+	predictions, err := ioutil.ReadFile(predictionsFileName)
+	require.NoError(t, err)
+	predictionLines := strings.Split(strings.TrimSpace(string(predictions)), "\n")
+	require.Equal(t, "id,predicted,probability,probability_setosa,probability_versicolor,probability_virginica,reconstructionLoss", predictionLines[0])
+	require.Equal(t, len(lines), len(predictionLines))
+	correct := 0
+	for i, line := range predictionLines[1:] {
+		fields := strings.Split(line, ",")
+		require.Equal(t, fmt.Sprintf("row%d", i), fields[0])
+		if fields[1] == lines[i+1][strings.LastIndex(lines[i+1], ",")+1:] {
+			correct++
+		}
+	}
+	require.Greater(t, float64(correct)/float64(len(predictionLines)-1), 0.8)
+
+	predictCmd = PredictCommand()
+	predictCmd.SetArgs(strings.Split("predict -m "+modelFileName+" -i "+emptyTargetFileName+" -o "+predictionsFileName, " "))
+	require.NoError(t, predictCmd.Execute())
+	emptyTargetPredictions, err := ioutil.ReadFile(predictionsFileName)
+	require.NoError(t, err)
+	emptyTargetLines := strings.Split(strings.TrimSpace(string(emptyTargetPredictions)), "\n")
+	require.Equal(t, len(lines), len(emptyTargetLines))
+	for i := range emptyTargetLines {
+		require.Equal(t, predictionLines[i][strings.Index(predictionLines[i], ",")+1:], emptyTargetLines[i])
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	dir := testDir(t)
+	predictionsFileName := dir + "/predictions.csv"
+
+	modelFileName := trainTestModel(t, dir, "train -i datasets/iris/iris.train -t species --categorical-columns species -n 10 -s 3 "+
+		"--sparsity-loss-weight 0.01 -o $MODEL")
+
+	// runs the command with the file as stdin, returning its stdout
+	runWithStdio := func(cmd *cobra.Command, args, inputFileName string) string {
+		stdin, stdout := os.Stdin, os.Stdout
+		defer func() {
+			os.Stdin, os.Stdout = stdin, stdout
+		}()
+		input, err := os.Open(inputFileName)
+		require.NoError(t, err)
+		defer input.Close()
+		output, err := ioutil.TempFile(dir, "")
+		require.NoError(t, err)
+		defer output.Close()
+		os.Stdin, os.Stdout = input, output
+
+		cmd.SetArgs(strings.Split(args, " "))
+		require.NoError(t, cmd.Execute())
+		out, err := ioutil.ReadFile(output.Name())
+		require.NoError(t, err)
+		return string(out)
+	}
+
+	testCmd := TestCommand()
+	testCmd.SetArgs(strings.Split("test -m "+modelFileName+" -i datasets/iris/iris.test -o "+predictionsFileName, " "))
+	require.NoError(t, testCmd.Execute())
+	expected, err := ioutil.ReadFile(predictionsFileName)
+	require.NoError(t, err)
+	require.Equal(t, string(expected), runWithStdio(TestCommand(), "test -m "+modelFileName+" -o -", "datasets/iris/iris.test"))
+
+	attentionFileName := dir + "/attention.csv"
+	testCmd = TestCommand()
+	testCmd.SetArgs(strings.Split("test -m "+modelFileName+" -i datasets/iris/iris.test -a "+attentionFileName, " "))
+	require.NoError(t, testCmd.Execute())
+	expected, err = ioutil.ReadFile(attentionFileName)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(expected), "line,step,"))
+	require.Equal(t, string(expected), runWithStdio(TestCommand(), "test -m "+modelFileName+" -i datasets/iris/iris.test -a -", "datasets/iris/iris.test"))
+	_, err = os.Stat("-")
+	require.True(t, os.IsNotExist(err))
+
+	predictCmd := PredictCommand()
+	predictCmd.SetArgs(strings.Split("predict -m "+modelFileName+" -i datasets/iris/iris.test -o "+predictionsFileName, " "))
+	require.NoError(t, predictCmd.Execute())
+	expected, err = ioutil.ReadFile(predictionsFileName)
+	require.NoError(t, err)
+	require.Equal(t, string(expected), runWithStdio(PredictCommand(), "predict -m "+modelFileName+" -i -", "datasets/iris/iris.test"))
+}
+
+func TestMultiTarget(t *testing.T) {
+	dir := testDir(t)
+	outputFileName := dir + "/output.csv"
+	metricsFileName := dir + "/metrics.json"
+	predictionsFileName := dir + "/predictions.csv"
+
+	modelFileName := trainTestModel(t, dir, "train -i datasets/cholesterol/cholesterol-train.csv -t chol,num "+
+		"--categorical-columns sex,cp,fbs,restecg,exang,slope,thal,num --target-weights 1,0.5 -n 20 -s 3 "+
+		"--sparsity-loss-weight 0.01 -o $MODEL")
+
+	testCmd := TestCommand()
+	testCmd.SetArgs(strings.Split("test -i datasets/cholesterol/cholesterol-test.csv -m "+modelFileName+
+		" -o "+outputFileName+" --metrics-output "+metricsFileName, " "))
+	require.NoError(t, testCmd.Execute())
+
+	output, err := ioutil.ReadFile(outputFileName)
+	require.NoError(t, err)
+	outputLines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	header := strings.Split(outputLines[0], ",")
+	require.Equal(t, []string{"chol_label", "chol_prediction", "num_label", "num_predicted", "num_probability"}, header[:5])
+	require.ElementsMatch(t, []string{"num_probability_0", "num_probability_1", "num_probability_2", "num_probability_3",
+		"num_probability_4"}, header[5:10])
+	require.Equal(t, []string{"reconstructionLoss"}, header[10:])
+	require.Len(t, outputLines, 61)
+
+	metrics := map[string]interface{}{}
+	data, err := ioutil.ReadFile(metricsFileName)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &metrics))
+	targets := metrics["Targets"].(map[string]interface{})
+	chol := targets["chol"].(map[string]interface{})
+	num := targets["num"].(map[string]interface{})
+	require.Contains(t, chol, "R-squared")
+	require.Contains(t, num, "Accuracy")
+	require.InDelta(t, chol["Loss"].(float64)+0.5*num["Loss"].(float64), metrics["Loss"], 1e-6)
+
+	predictCmd := PredictCommand()
+	predictCmd.SetArgs(strings.Split("predict -m "+modelFileName+" -i datasets/cholesterol/cholesterol-test.csv -o "+predictionsFileName, " "))
+	require.NoError(t, predictCmd.Execute())
+	predictions, err := ioutil.ReadFile(predictionsFileName)
+	require.NoError(t, err)
+	predictionLines := strings.Split(strings.TrimSpace(string(predictions)), "\n")
+	require.Len(t, predictionLines, 61)
+	for i := range predictionLines {
+		// the predictions match the output of the test command without the labels
+		testFields := strings.Split(outputLines[i], ",")
+		require.Equal(t, strings.Join(append(testFields[1:2], testFields[3:]...), ","), predictionLines[i])
+	}
+
+	p, err := pkg.LoadPredictor(modelFileName)
+	require.NoError(t, err)
+	record := map[string]string{"age": "56", "sex": "1", "cp": "4", "trestbps": "130", "fbs": "1", "restecg": "2",
+		"thalach": "103", "exang": "1", "oldpeak": "1.6", "slope": "3", "ca": "0", "thal": "7"}
+	results, err := p.Predict(context.Background(), []map[string]string{record})
+	require.NoError(t, err)
+	require.Len(t, results[0].Targets, 2)
+	require.Equal(t, "chol", results[0].Target)
+	require.Equal(t, results[0].Value, results[0].Targets[0].Value)
+	require.Equal(t, "num", results[0].Targets[1].Target)
+	require.Len(t, results[0].Targets[1].Probabilities, 5)
+}
+
+func TestMultiLabel(t *testing.T) {
+	dir := testDir(t)
+	metricsFileName := dir + "/metrics.json"
+	outputFileName := dir + "/output.csv"
+	predictionsFileName := dir + "/predictions.csv"
+
+	// the tags of each flower are its species, and "large" when its sepals are longer than 6
+	tagData := func(fileName string) string {
+		data, err := ioutil.ReadFile(fileName)
+		require.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		result := []string{"sepal_length,sepal_width,petal_length,petal_width,tags"}
+		for _, line := range lines[1:] {
+			fields := strings.Split(line, ",")
+			tags := fields[4]
+			if sepalLength, _ := strconv.ParseFloat(fields[0], 64); sepalLength > 6 {
+				tags += "|large"
+			}
+			result = append(result, strings.Join(fields[:4], ",")+","+tags)
+		}
+		taggedFileName := dir + "/" + fileName[strings.LastIndex(fileName, "/")+1:]
+		require.NoError(t, ioutil.WriteFile(taggedFileName, []byte(strings.Join(result, "\n")+"\n"), 0644))
+		return taggedFileName
+	}
+	trainFileName := tagData("datasets/iris/iris.train")
+	testFileName := tagData("datasets/iris/iris.test")
+
+	modelFileName := trainTestModel(t, dir, "train -i "+trainFileName+" -t tags --multi-label-columns tags -n 40 -s 3 "+
+		"--sparsity-loss-weight 0.01 -o $MODEL")
+
+	testCmd := TestCommand()
+	testCmd.SetArgs(strings.Split("test -i "+testFileName+" -m "+modelFileName+" -o "+outputFileName+
+		" --metrics-output "+metricsFileName, " "))
+	require.NoError(t, testCmd.Execute())
+
+	metrics := map[string]interface{}{}
+	data, err := ioutil.ReadFile(metricsFileName)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &metrics))
+	for _, key := range []string{"Loss", "MacroF1", "MicroF1", "SampleF1", "HammingLoss", "SubsetAccuracy", "Labels"} {
+		require.Contains(t, metrics, key)
+	}
+	require.Greater(t, metrics["MicroF1"], 0.8)
+	require.Less(t, metrics["HammingLoss"], 0.15)
+
+	output, err := ioutil.ReadFile(outputFileName)
+	require.NoError(t, err)
+	outputLines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	require.Equal(t, []string{"label", "predicted"}, strings.Split(outputLines[0], ",")[:2])
+	require.Contains(t, strings.Split(outputLines[0], ","), "probability_large")
+
+	predictCmd := PredictCommand()
+	predictCmd.SetArgs(strings.Split("predict -m "+modelFileName+" -i "+testFileName+" -o "+predictionsFileName, " "))
+	require.NoError(t, predictCmd.Execute())
+	predictions, err := ioutil.ReadFile(predictionsFileName)
+	require.NoError(t, err)
+	predictionLines := strings.Split(strings.TrimSpace(string(predictions)), "\n")
+	require.Len(t, predictionLines, len(outputLines))
+	for i := range predictionLines {
+		// the predictions match the output of the test command without the labels
+		require.Equal(t, outputLines[i][strings.Index(outputLines[i], ",")+1:], predictionLines[i])
+	}
+
+	p, err := pkg.LoadPredictor(modelFileName)
+	require.NoError(t, err)
+	results, err := p.Predict(context.Background(), []map[string]string{
+		{"sepal_length": "7.7", "sepal_width": "3.0", "petal_length": "6.1", "petal_width": "2.3"},
+	})
+	require.NoError(t, err)
+	require.Len(t, results[0].Probabilities, 4)
+	require.NotNil(t, results[0].Labels)
+}
+
+func TestSampleWeights(t *testing.T) {
+	dir := testDir(t)
+
+	// weightData adds a weight column to the iris data file, repeating each row as many times as given by repeat
+	// and weighting it as given by weight
+	weightData := func(fileName, name string, repeat, weight func(line int) int) string {
+		data, err := ioutil.ReadFile(fileName)
+		require.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		result := []string{lines[0] + ",w"}
+		for i, line := range lines[1:] {
+			for r := 0; r < repeat(i); r++ {
+				result = append(result, fmt.Sprintf("%s,%d", line, weight(i)))
+			}
+		}
+		weightedFileName := dir + "/" + name
+		require.NoError(t, ioutil.WriteFile(weightedFileName, []byte(strings.Join(result, "\n")+"\n"), 0644))
+		return weightedFileName
+	}
+	one := func(int) int { return 1 }
+	twiceEven := func(line int) int { return 1 + (line+1)%2 }
+	trainFileName := weightData("datasets/iris/iris.train", "train.csv", one, twiceEven)
+	weightedFileName := weightData("datasets/iris/iris.test", "weighted.csv", one, twiceEven)
+	repeatedFileName := weightData("datasets/iris/iris.test", "repeated.csv", twiceEven, one)
+
+	modelFileName := trainTestModel(t, dir, "train -i "+trainFileName+" -t species --categorical-columns species --weight-column w "+
+		"--class-weights balanced -n 20 -s 3 -o $MODEL")
+
+	p, err := pkg.LoadPredictor(modelFileName)
+	require.NoError(t, err)
+	require.True(t, p.Model().MetaData.Weighted)
+	require.Len(t, p.Model().MetaData.ClassWeights, 3)
+	// the weight column is neither a feature nor needed to predict
+	require.Equal(t, 4, p.Model().MetaData.FeatureCount())
+	_, err = p.Predict(context.Background(), []map[string]string{
+		{"sepal_length": "7.7", "sepal_width": "3.0", "petal_length": "6.1", "petal_width": "2.3"},
+	})
+	require.NoError(t, err)
+
+	testMetrics := func(fileName string) map[string]interface{} {
+		metricsFileName := fileName + ".json"
+		testCmd := TestCommand()
+		testCmd.SetArgs(strings.Split("test --exact-metrics -i "+fileName+" -m "+modelFileName+" --metrics-output "+metricsFileName, " "))
+		require.NoError(t, testCmd.Execute())
+		metrics := map[string]interface{}{}
+		data, err := ioutil.ReadFile(metricsFileName)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &metrics))
+		return metrics
+	}
+	// a row of weight 2 counts as the same row repeated twice
+	weighted := testMetrics(weightedFileName)
+	repeated := testMetrics(repeatedFileName)
+	for _, key := range []string{"Loss", "Accuracy", "BalancedAccuracy", "MacroF1", "MicroF1", "LogLoss", "RocAuc", "PrAuc"} {
+		require.InDelta(t, repeated[key], weighted[key], 1e-4, key)
+	}
+	require.Equal(t, repeated["ConfusionMatrix"], weighted["ConfusionMatrix"])
+}
+
+func TestWorkers(t *testing.T) {
+	dir := testDir(t)
+
+	// weights trains a model with the command line, returning its parameters
+	weights := func(cmd *cobra.Command, line, modelFileName string) []float32 {
+		cmd.SetArgs(createArgs(line, modelFileName))
+		require.NoError(t, cmd.Execute())
+		modelFile, err := os.Open(modelFileName)
+		require.NoError(t, err)
+		defer modelFile.Close()
+		m, err := io.LoadModel(modelFile)
+		require.NoError(t, err)
+		return nn.DumpParamsVector(m.TabNet).Data()
+	}
+	b := bytes.NewBufferString("")
+	log.Logger = zerolog.New(b)
+	// a given random seed and number of workers give the same weights
+	trainCmdLine := "train -i datasets/breast_cancer/breast-cancer.train -o $MODEL -t Class " +
+		"--categorical-columns Class,Age,Menopause,Tumor-size,Inv-nodes,Node-caps,Breast,Breast-quad,Irradiat " +
+		"-s 3 -n 5 -x 7 --input-dropout-probability 0.1 --workers 3"
+	trained := weights(TrainCommand(), trainCmdLine, dir+"/model")
+	require.Equal(t, trained, weights(TrainCommand(), trainCmdLine, dir+"/repeated"))
+	require.NotEqual(t, trained, weights(TrainCommand(), strings.Replace(trainCmdLine, "--workers 3", "--workers 2", 1), dir+"/other"))
+	out, err := parseOutputLog(b.String())
+	require.NoError(t, err)
+	require.NoError(t, checkExpectation(out, logExpectation{key: "epoch", exactValue: 4.0}))
+
+	pretrainCmdLine := "pretrain -i datasets/breast_cancer/breast-cancer.train -o $MODEL " +
+		"--categorical-columns Class,Age,Menopause,Tumor-size,Inv-nodes,Node-caps,Breast,Breast-quad,Irradiat -s 3 -n 2 --workers 2"
+	require.Equal(t, weights(PretrainCommand(), pretrainCmdLine, dir+"/pretrained"),
+		weights(PretrainCommand(), pretrainCmdLine, dir+"/repretrained"))
+}
@@ -0,0 +1,96 @@
+package pkg
+
+import (
+	"math"
+
+	mat "github.com/nlpodyssey/spago/pkg/mat32"
+	"github.com/nlpodyssey/spago/pkg/mat32/rand"
+	"github.com/nlpodyssey/spago/pkg/ml/ag"
+	"github.com/nlpodyssey/spago/pkg/ml/nn"
+
+	"golem/pkg/io"
+	"golem/pkg/model"
+)
+
+// softmax returns the class probabilities for the logits, scaled by the temperature
+func softmax(logits []mat.Float, temperature float64) []float64 {
+	if temperature <= 0 {
+		temperature = 1.0
+	}
+	_, maxLogit := argmax(logits)
+	result := make([]float64, len(logits))
+	sum := 0.0
+	for i, logit := range logits {
+		result[i] = math.Exp(float64(logit-maxLogit) / temperature)
+		sum += result[i]
+	}
+	for i := range result {
+		result[i] /= sum
+	}
+	return result
+}
+
+// collectLogits runs the classification model on the dataset, returning the logits and target class of each record
+func collectLogits(m *model.Model, dataSet *io.DataSet) ([][]mat.Float, []int) {
+	g := ag.NewGraph(ag.Rand(rand.NewLockedRand(42)),
+		ag.ConcurrentComputations(1))
+	proc := nn.Reify(nn.Context{Graph: g, Mode: nn.Inference}, m.TabNet).(*model.TabNet)
+
+	var logits [][]mat.Float
+	var targets []int
+	dataSet.ResetOrder(io.OriginalOrder)
+	for d := dataSet.Next(); len(d) > 0; d = dataSet.Next() {
+		_, output := predict(g, proc, d)
+		for i, prediction := range output.Output {
+			logits = append(logits, append([]mat.Float{}, prediction.Value().Data()...))
+			targets = append(targets, int(d[i].Target))
+		}
+		g.Clear()
+	}
+	return logits, targets
+}
+
+// negativeLogLikelihood is the average negative log-likelihood of the targets under the temperature-scaled softmax
+func negativeLogLikelihood(logits [][]mat.Float, targets []int, temperature float64) float64 {
+	nll := 0.0
+	for i := range logits {
+		p := softmax(logits[i], temperature)[targets[i]]
+		nll -= math.Log(math.Max(p, 1e-15))
+	}
+	return nll / float64(len(logits))
+}
+
+// fitTemperature finds the temperature minimizing the negative log-likelihood of the targets, as described in
+// "On Calibration of Modern Neural Networks" - https://arxiv.org/abs/1706.04599
+// The likelihood is convex in the inverse temperature, which is found with a golden-section search in log scale.
+func fitTemperature(logits [][]mat.Float, targets []int) float64 {
+	const minLogBeta, maxLogBeta = -5.0, 5.0
+	const iterations = 100
+	ratio := (math.Sqrt(5) - 1) / 2
+
+	nll := func(logBeta float64) float64 {
+		return negativeLogLikelihood(logits, targets, math.Exp(-logBeta))
+	}
+	a, b := minLogBeta, maxLogBeta
+	c := b - ratio*(b-a)
+	d := a + ratio*(b-a)
+	fc, fd := nll(c), nll(d)
+	for i := 0; i < iterations; i++ {
+		if fc < fd {
+			b, d, fd = d, c, fc
+			c = b - ratio*(b-a)
+			fc = nll(c)
+		} else {
+			a, c, fc = c, d, fd
+			d = a + ratio*(b-a)
+			fd = nll(d)
+		}
+	}
+	return math.Exp(-(a + b) / 2)
+}
+
+// calibrate fits the temperature of a classification model on the held-out dataset
+func calibrate(m *model.Model, heldOutDataSet *io.DataSet) {
+	logits, targets := collectLogits(m, heldOutDataSet)
+	m.Temperature = fitTemperature(logits, targets)
+}
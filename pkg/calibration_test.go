@@ -0,0 +1,31 @@
+package pkg
+
+import (
+	"math"
+	"testing"
+
+	mat "github.com/nlpodyssey/spago/pkg/mat32"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSoftmax(t *testing.T) {
+	p := softmax([]mat.Float{1, 2, 3}, 1.0)
+	require.InDelta(t, 1.0, p[0]+p[1]+p[2], 1e-9)
+	require.InDelta(t, math.Exp(1)/(math.Exp(1)+math.Exp(2)+math.Exp(3)), p[0], 1e-6)
+
+	// Higher temperatures flatten the distribution
+	hot := softmax([]mat.Float{1, 2, 3}, 10.0)
+	require.Less(t, hot[2], p[2])
+	require.Greater(t, hot[0], p[0])
+}
+
+func TestFitTemperature(t *testing.T) {
+	// Overconfident logits, right in only 3 of 4 cases
+	logits := [][]mat.Float{{10, 0}, {10, 0}, {10, 0}, {10, 0}}
+	targets := []int{0, 0, 0, 1}
+	temperature := fitTemperature(logits, targets)
+	require.Greater(t, temperature, 1.0)
+	// The calibrated probability of the majority class matches its frequency
+	require.InDelta(t, 0.75, softmax(logits[0], temperature)[0], 1e-3)
+	require.Less(t, negativeLogLikelihood(logits, targets, temperature), negativeLogLikelihood(logits, targets, 1.0))
+}
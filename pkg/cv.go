@@ -0,0 +1,192 @@
+package pkg
+
+import (
+	"fmt"
+	gio "io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gonum.org/v1/gonum/stat"
+
+	"golem/pkg/io"
+	"golem/pkg/model"
+)
+
+// CrossValidate evaluates the model configuration with k-fold cross-validation on the data file,
+// logging the metrics of each fold and their mean and standard deviation.
+// Classification folds are stratified by the class of the first target. The metadata of each fold, with the column
+// statistics, imputation values and categories, is computed from the rows of its training folds only, so that the
+// held-out fold does not leak into its model. The out-of-fold predictions are optionally written to predictionsFileName.
+func CrossValidate(dataFile string, targetColumns []string, predictionsFileName string, numFolds int, config model.TabNetConfig, trainingParams TrainingParameters) error {
+	if numFolds < 2 {
+		return fmt.Errorf("invalid number of folds %d, at least 2 are required", numFolds)
+	}
+	if trainingParams.Calibrate && trainingParams.ValidationSplit <= 0 {
+		return fmt.Errorf("calibration requires a validation split")
+	}
+	p, err := trainingDataParameters(targetColumns, trainingParams)
+	if err != nil {
+		return err
+	}
+	header, rows, err := io.ReadRows(dataFile)
+	if err != nil {
+		return fmt.Errorf("error reading training data: %w", err)
+	}
+	metaData, loaded, err := loadTrainingRows(p, header, rows, trainingParams)
+	if err != nil {
+		return err
+	}
+	if loaded.Size() < numFolds {
+		return fmt.Errorf("not enough data for %d folds", numFolds)
+	}
+	// the rows that can be parsed, whose records are split into folds
+	dataSet, dataErrors, err := io.ParseRecords(rows, metaData, p.BatchSize)
+	if err != nil {
+		return err
+	}
+	dataSet.Rand = loaded.Rand
+	recordRows := make(map[*io.DataRecord][]string, dataSet.Size())
+	for i, row := range parsedRows(len(rows), dataErrors) {
+		recordRows[dataSet.Data[i]] = rows[row]
+	}
+	// every fold predicts the classes of the whole data, in the same order, even those missing from its training folds
+	for _, target := range metaData.Targets() {
+		p.TargetMaps = append(p.TargetMaps, target.Map)
+	}
+
+	folds := dataSet.KFoldSplit(numFolds, metaData.TargetType() == model.Categorical)
+	predictions := &outOfFoldPredictions{predictions: map[*io.DataRecord][]string{}}
+	metrics := map[string][]float64{}
+	var metricNames []string
+
+	for i, fold := range folds {
+		log.Info().Int("fold", i).Int("trainSize", fold.Train.Size()).Int("testSize", fold.Test.Size()).Msg("Training fold")
+		foldMetaData, trainDataSet, err := loadTrainingRows(p, header, dataRows(datasetRecords(fold.Train), recordRows), trainingParams)
+		if err != nil {
+			return err
+		}
+		testRecords := datasetRecords(fold.Test)
+		testDataSet, testErrors, err := io.ParseRecords(dataRows(testRecords, recordRows), foldMetaData, p.BatchSize)
+		if err != nil {
+			return err
+		}
+		// held-out rows that cannot be parsed with the metadata of the fold have no prediction
+		printDataErrors(testErrors)
+		predictions.records = map[*io.DataRecord]*io.DataRecord{}
+		for j, row := range parsedRows(len(testRecords), testErrors) {
+			predictions.records[testDataSet.Data[j]] = testRecords[row]
+		}
+
+		var validationDataSet *io.DataSet
+		if trainingParams.ValidationSplit > 0 {
+			trainDataSet, validationDataSet, err = splitValidationData(trainDataSet, trainingParams.ValidationSplit)
+			if err != nil {
+				return err
+			}
+		}
+		m := trainModel(foldMetaData, trainDataSet, validationDataSet, config, trainingParams)
+
+		predictions.fold = i
+		attnWriter := newAttentionWriter(NoopWriter{}, m)
+		result := evaluate(m, testDataSet, predictions, attnWriter, false)
+		foldMetrics := result.evaluator.Metrics()
+		foldMetrics["ReconstructionLoss"] = result.ReconstructionLoss
+		foldMetrics["SparsityLoss"] = result.SparsityLoss
+
+		metricNames = sortedMetricNames(foldMetrics)
+		event := log.Info().Int("fold", i)
+		for _, name := range metricNames {
+			event = event.Float64(name, foldMetrics[name])
+			metrics[name] = append(metrics[name], foldMetrics[name])
+		}
+		event.Msg("Fold metrics")
+	}
+
+	for _, name := range metricNames {
+		mean, stdDev := stat.MeanStdDev(metrics[name], nil)
+		log.Info().Str("Metric", name).Float64("Mean", mean).Float64("StdDev", stdDev).Msg("Cross-validation metrics")
+	}
+
+	if predictionsFileName != "" {
+		predictionsFile, err := os.Create(predictionsFileName)
+		if err != nil {
+			return fmt.Errorf("error creating predictions file %s: %w", predictionsFileName, err)
+		}
+		defer predictionsFile.Close()
+		predictions.write(predictionsFile, dataSet.Data)
+	}
+	return nil
+}
+
+// parsedRows returns the indices of the rows parsed into records, given the errors of the other rows
+func parsedRows(numRows int, dataErrors []io.DataError) []int {
+	failed := make(map[int]bool, len(dataErrors))
+	for _, dataError := range dataErrors {
+		failed[dataError.Line] = true
+	}
+	result := make([]int, 0, numRows-len(failed))
+	for row := 0; row < numRows; row++ {
+		if !failed[row] {
+			result = append(result, row)
+		}
+	}
+	return result
+}
+
+// datasetRecords returns the records of the dataset, in their original order
+func datasetRecords(set *io.DataSet) []*io.DataRecord {
+	var result []*io.DataRecord
+	set.ResetOrder(io.OriginalOrder)
+	for batch := set.Next(); len(batch) > 0; batch = set.Next() {
+		result = append(result, batch...)
+	}
+	return result
+}
+
+// dataRows returns the data rows from which the records were parsed
+func dataRows(records []*io.DataRecord, recordRows map[*io.DataRecord][]string) [][]string {
+	result := make([][]string, len(records))
+	for i, record := range records {
+		result[i] = recordRows[record]
+	}
+	return result
+}
+
+func sortedMetricNames(metrics map[string]float64) []string {
+	result := make([]string, 0, len(metrics))
+	for name := range metrics {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// outOfFoldPredictions collects the prediction for each record made by the model of the fold holding it out.
+// The fold parses the records it predicts with its own metadata, from the records given by records.
+type outOfFoldPredictions struct {
+	fold        int
+	columns     []string
+	records     map[*io.DataRecord]*io.DataRecord
+	predictions map[*io.DataRecord][]string
+}
+
+func (o *outOfFoldPredictions) writeHeader(columns []string) {
+	o.columns = columns
+}
+
+func (o *outOfFoldPredictions) writePrediction(record *io.DataRecord, values []string) {
+	o.predictions[o.records[record]] = append([]string{strconv.Itoa(o.fold)}, values...)
+}
+
+// write writes the predictions as CSV, in the original order of the data. Records without prediction are left out.
+func (o *outOfFoldPredictions) write(w gio.Writer, data []*io.DataRecord) {
+	fmt.Fprintf(w, "row,fold,%s\n", strings.Join(o.columns, ","))
+	for i, record := range data {
+		if prediction, ok := o.predictions[record]; ok {
+			fmt.Fprintf(w, "%d,%s\n", i, strings.Join(prediction, ","))
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package pkg
+
+import (
+	"fmt"
+	gio "io"
+	"os"
+	"sort"
+
+	mat "github.com/nlpodyssey/spago/pkg/mat32"
+	"github.com/nlpodyssey/spago/pkg/mat32/rand"
+	"github.com/nlpodyssey/spago/pkg/ml/ag"
+	"github.com/nlpodyssey/spago/pkg/ml/nn"
+	"github.com/rs/zerolog/log"
+
+	"golem/pkg/io"
+	"golem/pkg/model"
+)
+
+// Explain computes the global feature importances of the model over the input data, logging them
+// and optionally writing them as a CSV report ranked by decreasing importance
+func Explain(modelFileName, inputFileName, outputFileName string) error {
+	m, dataSet, err := loadModelAndData(modelFileName, inputFileName)
+	if err != nil {
+		return err
+	}
+	if len(dataSet.Data) == 0 {
+		return fmt.Errorf("no data to explain in %s", inputFileName)
+	}
+	if m.TabNet.NumDecisionSteps < 2 {
+		return fmt.Errorf("the model has no attention masks to explain, as it has a single decision step")
+	}
+
+	importances := computeFeatureImportances(m, dataSet)
+	for i, importance := range importances {
+		log.Info().Int("Rank", i+1).Str("Column", importance.Column).
+			Float64("Importance", importance.Importance).
+			Floats64("StepImportances", importance.StepImportances).Msg("Feature importance")
+	}
+
+	if outputFileName == "" {
+		return nil
+	}
+	outputFile, err := os.Create(outputFileName)
+	if err != nil {
+		return fmt.Errorf("error creating output file %s: %w", outputFileName, err)
+	}
+	defer outputFile.Close()
+	writeFeatureImportances(outputFile, importances)
+	return nil
+}
+
+// featureImportance is the importance of a data column, overall and at each decision step
+type featureImportance struct {
+	Column          string
+	Importance      float64
+	StepImportances []float64
+}
+
+// maskAggregator accumulates attention masks by data column, weighting the mask of each step by the
+// contribution of the step to the decision, as the aggregate feature importance mask of the TabNet paper
+type maskAggregator struct {
+	metaData *model.Metadata
+	// inputColumns maps each element of the model input to the data column it was derived from
+	inputColumns []int
+	// steps holds the accumulated importances of each data column at each step
+	steps [][]float64
+}
+
+func newMaskAggregator(m *model.Model) *maskAggregator {
+	steps := make([][]float64, m.TabNet.NumDecisionSteps-1)
+	for i := range steps {
+		steps[i] = make([]float64, len(m.MetaData.Columns))
+	}
+	return &maskAggregator{
+		metaData:     m.MetaData,
+		inputColumns: m.MetaData.InputColumns(m.TabNet.CategoricalEmbeddingDimension),
+		steps:        steps,
+	}
+}
+
+// add accumulates the attention mask of an example along with the decision contribution of its steps
+func (a *maskAggregator) add(mask model.AttentionMask, contributions []mat.Float) {
+	for step := range mask {
+		for i, value := range mask[step] {
+			a.steps[step][a.inputColumns[i]] += float64(contributions[step]) * float64(value)
+		}
+	}
+}
+
+// attributions returns the aggregate attention mask of a single example by feature column, in data order,
+// normalized to sum to one. The attributions are all zero when no decision step contributes to the output.
+func (a *maskAggregator) attributions(mask model.AttentionMask, contributions []mat.Float) []float64 {
+	byColumn := make([]float64, len(a.metaData.Columns))
+	for step := range mask {
+		for i, value := range mask[step] {
+			byColumn[a.inputColumns[i]] += float64(contributions[step]) * float64(value)
+		}
+	}
+	columns := a.metaData.FeatureColumns()
+	result := make([]float64, len(columns))
+	for i, column := range columns {
+		result[i] = byColumn[column]
+	}
+	normalize(result)
+	return result
+}
+
+// aggregate returns the normalized importance of each feature column, in data order
+func (a *maskAggregator) aggregate() []float64 {
+	columns := a.metaData.FeatureColumns()
+	result := make([]float64, len(columns))
+	for i, column := range columns {
+		for step := range a.steps {
+			result[i] += a.steps[step][column]
+		}
+	}
+	normalize(result)
+	return result
+}
+
+// importances returns the normalized overall and per step feature importances,
+// sorted by decreasing overall importance
+func (a *maskAggregator) importances() []featureImportance {
+	columns := a.metaData.FeatureColumns()
+	overall := a.aggregate()
+	result := make([]featureImportance, len(columns))
+	for i, column := range columns {
+		result[i] = featureImportance{
+			Column:          a.metaData.Columns[column].Name,
+			Importance:      overall[i],
+			StepImportances: make([]float64, len(a.steps)),
+		}
+	}
+	for step := range a.steps {
+		stepImportances := make([]float64, len(columns))
+		for i, column := range columns {
+			stepImportances[i] = a.steps[step][column]
+		}
+		normalize(stepImportances)
+		for i := range columns {
+			result[i].StepImportances[step] = stepImportances[i]
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Importance > result[j].Importance
+	})
+	return result
+}
+
+// normalize scales the values so that they sum to one, leaving them unchanged if they sum to zero
+func normalize(values []float64) {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	if sum == 0 {
+		return
+	}
+	for i := range values {
+		values[i] /= sum
+	}
+}
+
+// computeFeatureImportances aggregates the attention masks of the model over the dataset
+func computeFeatureImportances(m *model.Model, dataSet *io.DataSet) []featureImportance {
+	g := ag.NewGraph(ag.Rand(rand.NewLockedRand(42)),
+		ag.ConcurrentComputations(1))
+
+	dataSet.ResetOrder(io.OriginalOrder)
+	ctx := nn.Context{Graph: g, Mode: nn.Inference}
+	proc := nn.Reify(ctx, m.TabNet).(*model.TabNet)
+
+	aggregator := newMaskAggregator(m)
+	for d := dataSet.Next(); len(d) > 0; d = dataSet.Next() {
+		_, output := predict(g, proc, d)
+		for i := range output.AttentionMasks {
+			aggregator.add(output.AttentionMasks[i], output.DecisionContributions[i])
+		}
+		g.Clear()
+	}
+	return aggregator.importances()
+}
+
+func writeFeatureImportances(w gio.Writer, importances []featureImportance) {
+	fmt.Fprintf(w, "rank,column,importance")
+	if len(importances) > 0 {
+		for step := range importances[0].StepImportances {
+			fmt.Fprintf(w, ",step%d", step+1)
+		}
+	}
+	fmt.Fprintf(w, "\n")
+	for i, importance := range importances {
+		fmt.Fprintf(w, "%d,%s,%f", i+1, importance.Column, importance.Importance)
+		for _, stepImportance := range importance.StepImportances {
+			fmt.Fprintf(w, ",%f", stepImportance)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+}
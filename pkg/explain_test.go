@@ -0,0 +1,55 @@
+package pkg
+
+import (
+	"testing"
+
+	mat "github.com/nlpodyssey/spago/pkg/mat32"
+	"github.com/stretchr/testify/require"
+
+	"golem/pkg/model"
+)
+
+func TestMaskAggregator(t *testing.T) {
+	metaData := model.NewMetadata()
+	metaData.Columns = []*model.Column{
+		{Name: "a", Type: model.Continuous},
+		{Name: "target", Type: model.Categorical},
+		{Name: "b", Type: model.Categorical},
+	}
+	metaData.TargetColumn = 1
+	metaData.ContinuousFeaturesMap.Set(0, 0)
+	metaData.MissingIndicatorsMap.Set(0, 1)
+	metaData.CategoricalFeaturesMap.Set(2, 0)
+	require.Equal(t, []int{0, 0, 2, 2}, metaData.InputColumns(2))
+
+	m := &model.Model{
+		MetaData: metaData,
+		TabNet: model.NewTabNet(model.TabNetConfig{
+			NumDecisionSteps:              3,
+			NumColumns:                    4,
+			IntermediateFeatureDimension:  2,
+			OutputDimension:               2,
+			CategoricalEmbeddingDimension: 2,
+		}),
+	}
+	aggregator := newMaskAggregator(m)
+	aggregator.add(model.AttentionMask{{0.5, 0.25, 0.25, 0}, {0, 0, 0.5, 0.5}}, []mat.Float{1, 3})
+	aggregator.add(model.AttentionMask{{1, 0, 0, 0}, {0, 0, 1, 0}}, []mat.Float{2, 0})
+
+	attributions := aggregator.attributions(model.AttentionMask{{0.5, 0.25, 0.25, 0}, {0, 0, 0.5, 0.5}}, []mat.Float{1, 3})
+	require.InDeltaSlice(t, []float64{0.75 / 4, 3.25 / 4}, attributions, 1e-6)
+	// without contributions from the decision steps, no column is attributed the output
+	attributions = aggregator.attributions(model.AttentionMask{{0.5, 0.25, 0.25, 0}, {0, 0, 0.5, 0.5}}, []mat.Float{0, 0})
+	require.Equal(t, []float64{0, 0}, attributions)
+
+	importances := aggregator.importances()
+	require.Equal(t, 2, len(importances))
+	require.Equal(t, "b", importances[0].Column)
+	require.InDelta(t, 3.25/6, importances[0].Importance, 1e-6)
+	require.InDelta(t, 0.25/3, importances[0].StepImportances[0], 1e-6)
+	require.InDelta(t, 1, importances[0].StepImportances[1], 1e-6)
+	require.Equal(t, "a", importances[1].Column)
+	require.InDelta(t, 2.75/6, importances[1].Importance, 1e-6)
+	require.InDelta(t, 2.75/3, importances[1].StepImportances[0], 1e-6)
+	require.InDelta(t, 0, importances[1].StepImportances[1], 1e-6)
+}
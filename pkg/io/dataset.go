@@ -2,6 +2,7 @@ package io
 
 import (
 	"math/rand"
+	"sort"
 )
 
 type DataSet struct {
@@ -86,3 +87,50 @@ func (d *DataSet) RandomSplit(sizes ...int) []*DataSet {
 	return splits
 
 }
+
+// Copy returns a dataset sharing the records of d, with its own batch size and ordering
+func (d *DataSet) Copy(batchSize int) *DataSet {
+	indices := make([]int, len(d.dataIndices))
+	copy(indices, d.dataIndices)
+	return NewDataSetSplit(d.Data, batchSize, indices)
+}
+
+// Fold holds the train and test datasets of a cross-validation fold
+type Fold struct {
+	Train *DataSet
+	Test  *DataSet
+}
+
+// KFoldSplit randomly splits the dataset into k folds of approximately equal size.
+// When stratified, each fold holds approximately the same proportion of each target value.
+func (d *DataSet) KFoldSplit(k int, stratified bool) []Fold {
+	indices := d.RandomSplit(d.Size())[0].dataIndices
+	if stratified {
+		sort.SliceStable(indices, func(i, j int) bool {
+			return d.Data[indices[i]].Target < d.Data[indices[j]].Target
+		})
+	}
+	foldIndices := make([][]int, k)
+	for i, index := range indices {
+		foldIndices[i%k] = append(foldIndices[i%k], index)
+	}
+
+	folds := make([]Fold, k)
+	for i := range folds {
+		var trainIndices []int
+		for j := range foldIndices {
+			if j != i {
+				trainIndices = append(trainIndices, foldIndices[j]...)
+			}
+		}
+		sort.Ints(trainIndices)
+		sort.Ints(foldIndices[i])
+		folds[i] = Fold{
+			Train: NewDataSetSplit(d.Data, d.BatchSize, trainIndices),
+			Test:  NewDataSetSplit(d.Data, d.BatchSize, foldIndices[i]),
+		}
+		folds[i].Train.Rand = d.Rand
+		folds[i].Test.Rand = d.Rand
+	}
+	return folds
+}
@@ -7,7 +7,9 @@ import (
 	"io"
 	"math"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 
 	"golem/pkg/model"
 
@@ -31,6 +33,39 @@ type DataRecord struct {
 	// Float64 is used to represent valus for both continuous and categorical target types.
 
 	Target mat.Float
+
+	// ExtraTargets contains the values of the targets after the first one, for multi-target models
+	ExtraTargets []mat.Float
+
+	// MultiHotTargets contains the multi-hot vector of the labels of each multi-label target, by target index.
+	// It is nil when the metadata has no multi-label target.
+	MultiHotTargets []mat.Matrix
+
+	// Weight is the sample weight of the record in the loss and metrics. It is 1 unless the metadata is weighted.
+	Weight mat.Float
+}
+
+// TargetValue returns the value of the target with the given index in the metadata targets
+func (d *DataRecord) TargetValue(target int) mat.Float {
+	if target == 0 {
+		return d.Target
+	}
+	return d.ExtraTargets[target-1]
+}
+
+// SetTargetValue sets the value of the target with the given index in the metadata targets
+func (d *DataRecord) SetTargetValue(target int, value mat.Float) {
+	if target == 0 {
+		d.Target = value
+		return
+	}
+	d.ExtraTargets[target-1] = value
+}
+
+// MultiHotTarget returns the multi-hot vector of the labels of the multi-label target with the given index
+// in the metadata targets
+func (d *DataRecord) MultiHotTarget(target int) mat.Matrix {
+	return d.MultiHotTargets[target]
 }
 
 // DataBatch holds a minibatch of data.
@@ -54,13 +89,52 @@ func NewSet(values ...string) Set {
 	return set
 }
 
+// Values returns the values in the set in sorted order
+func (s Set) Values() []string {
+	result := make([]string, 0, len(s))
+	for val := range s {
+		result = append(result, val)
+	}
+	sort.Strings(result)
+	return result
+}
+
 type DataParameters struct {
-	DataFile           string
-	TargetColumn       string
+	DataFile string
+	// TargetColumns holds the names of the target columns, the first one being the main target.
+	// Data without target columns is unlabeled.
+	TargetColumns      []string
 	CategoricalColumns Set
-	BatchSize          int
+	// MultiLabelColumns holds the names of the multi-label target columns, whose labels are separated
+	// by LabelSeparator
+	MultiLabelColumns Set
+	LabelSeparator    string
+	// WeightColumn is the name of the column holding the sample weight of each row. Rows are not weighted
+	// when it is empty.
+	WeightColumn string
+	// TargetMaps holds, for each target, classes or labels indexed first in new metadata, in the same order,
+	// such as those of the whole data when the metadata is computed from part of it
+	TargetMaps []*model.NameMap
+	// RegressionLoss is the loss of the continuous targets. Targets predicted with a log link are not standardized.
+	RegressionLoss model.RegressionLoss
+	BatchSize      int
+
+	// MissingValues contains the tokens recognized as missing values
+	MissingValues Set
+	// Imputation is the strategy used to replace missing values
+	Imputation model.ImputationStrategy
+	// ImputationConstant replaces missing continuous values when using the constant imputation strategy
+	ImputationConstant float64
+	// MissingIndicators adds an "is-missing" indicator feature for each column with missing values
+	MissingIndicators bool
+	// MinCategoryFrequency is the minimum number of occurrences of a categorical value in the data.
+	// Less frequent values are folded into the unknown category of their column.
+	MinCategoryFrequency int
 }
 
+// missingCategory marks a missing categorical value until it is imputed
+const missingCategory = -1
+
 type DataError struct {
 	Line  int
 	Error string
@@ -68,40 +142,75 @@ type DataError struct {
 
 // LoadData reads the train file and splits it into batches of at most BatchSize elements.
 func LoadData(p DataParameters, metaData *model.Metadata) (*model.Metadata, *DataSet, []DataError, error) {
+	header, rows, err := ReadRows(p.DataFile)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return LoadRows(p, header, rows, metaData)
+}
 
-	var errors []DataError
-	inputFile, err := os.Open(p.DataFile)
+// ReadRows reads the header and the rows of a CSV data file. Reading stops at the first row that cannot be read.
+func ReadRows(fileName string) ([]string, [][]string, error) {
+	inputFile, err := os.Open(fileName)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("error opening file: %w", err)
+		return nil, nil, fmt.Errorf("error opening file: %w", err)
 	}
+	defer inputFile.Close()
 
 	reader := csv.NewReader(inputFile)
 	reader.Comma = ','
 
 	//First line is expected to be a header
-	record, err := reader.Read()
+	header, err := reader.Read()
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("error reading data header: %w", err)
+		return nil, nil, fmt.Errorf("error reading data header: %w", err)
 	}
+	var rows [][]string
+	for record, err := reader.Read(); err == nil; record, err = reader.Read() {
+		rows = append(rows, record)
+	}
+	return header, rows, nil
+}
 
+// LoadRows parses the data rows read with their header by ReadRows, as LoadData does with the rows of its file.
+// Without metadata, new metadata is computed from the rows.
+func LoadRows(p DataParameters, header []string, rows [][]string, metaData *model.Metadata) (*model.Metadata, *DataSet, []DataError, error) {
+	var errors []DataError
 	newMetadata := false
 	if metaData == nil {
 		metaData = model.NewMetadata()
 		newMetadata = true
-		metaData.Columns = parseColumns(record, p)
-		if err := setTargetColumn(p, metaData); err != nil {
+		metaData.Columns = parseColumns(header, p)
+		if err := setTargetColumns(p, metaData); err != nil {
+			return nil, nil, nil, err
+		}
+		for i, target := range metaData.Targets() {
+			if i < len(p.TargetMaps) {
+				for index := 0; index < p.TargetMaps[i].Size(); index++ {
+					target.Map.ValueFor(p.TargetMaps[i].IndexToName[index])
+				}
+			}
+		}
+		if err := setWeightColumn(p, metaData); err != nil {
 			return nil, nil, nil, err
 		}
+		for i, col := range metaData.Columns {
+			if col.Type == model.MultiLabel && !metaData.IsTargetColumn(i) {
+				return nil, nil, nil, fmt.Errorf("multi-label column %s is not a target column", col.Name)
+			}
+		}
 		buildFeatureIndex(metaData)
+		metaData.MissingValues = p.MissingValues.Values()
+		metaData.LabelSeparator = p.LabelSeparator
+		metaData.RegressionLoss = p.RegressionLoss
 	}
 
 	var data []*DataRecord
 	currentLine := 0
-	targetType := metaData.Columns[metaData.TargetColumn].Type
+	missingValues := NewSet(metaData.MissingValues...)
 
-	for record, err = reader.Read(); err == nil; record, err = reader.Read() {
-		dataRecord := DataRecord{}
-		targetValue, err := parseTarget(newMetadata, metaData, record[metaData.TargetColumn])
+	for _, record := range rows {
+		dataRecord, err := parseRecord(metaData, missingValues, newMetadata, record)
 		if err != nil {
 			errors = append(errors, DataError{
 				Line:  currentLine,
@@ -109,54 +218,123 @@ func LoadData(p DataParameters, metaData *model.Metadata) (*model.Metadata, *Dat
 			})
 			continue
 		}
+		data = append(data, dataRecord)
+		currentLine++
+	}
 
-		dataRecord.Target = targetValue
+	dataSet := NewDataSet(data, p.BatchSize)
 
-		if targetType == model.Continuous && newMetadata {
-			metaData.Columns[metaData.TargetColumn].Average += float64(targetValue)
-		}
+	if newMetadata {
+		computeStatistics(metaData, dataSet, p.MissingIndicators)
+		addUnknownCategories(metaData, dataSet, p.MinCategoryFrequency)
+		resizeMultiHotTargets(metaData, dataSet)
+	}
+	if err := imputeMissingValues(metaData, dataSet); err != nil {
+		return nil, nil, nil, err
+	}
+	standardizeContinuousFeatures(metaData, dataSet)
+	standardizeTargets(metaData, dataSet)
 
-		dataRecord.ContinuousFeatures = mat.NewEmptyVecDense(metaData.ContinuousFeaturesMap.Size())
-		err = parseContinuousFeatures(metaData, record, dataRecord.ContinuousFeatures, newMetadata)
-		if err != nil {
+	return metaData, dataSet, errors, nil
+}
+
+// ParseRecords parses data rows holding the columns of the metadata, in the same order, into a dataset,
+// as LoadData does when given existing metadata. Rows that cannot be parsed are reported as errors.
+func ParseRecords(records [][]string, metaData *model.Metadata, batchSize int) (*DataSet, []DataError, error) {
+	var errors []DataError
+	var data []*DataRecord
+	missingValues := NewSet(metaData.MissingValues...)
+	for line, record := range records {
+		if len(record) != len(metaData.Columns) {
 			errors = append(errors, DataError{
-				Line:  currentLine,
-				Error: err.Error(),
+				Line:  line,
+				Error: fmt.Sprintf("expected %d columns, got %d", len(metaData.Columns), len(record)),
 			})
 			continue
 		}
-
-		dataRecord.CategoricalFeatures, err = parseCategoricalFeatures(metaData, newMetadata, record)
+		dataRecord, err := parseRecord(metaData, missingValues, false, record)
 		if err != nil {
 			errors = append(errors, DataError{
-				Line:  currentLine,
+				Line:  line,
 				Error: err.Error(),
 			})
 			continue
 		}
-		data = append(data, &dataRecord)
-		currentLine++
+		data = append(data, dataRecord)
 	}
 
-	dataSet := NewDataSet(data, p.BatchSize)
-
-	if newMetadata {
-		computeStatistics(metaData, dataSet)
+	dataSet := NewDataSet(data, batchSize)
+	if err := imputeMissingValues(metaData, dataSet); err != nil {
+		return nil, nil, err
 	}
 	standardizeContinuousFeatures(metaData, dataSet)
-	if targetType == model.Continuous {
-		standardizeTarget(metaData, dataSet)
+	standardizeTargets(metaData, dataSet)
+	return dataSet, errors, nil
+}
+
+// parseRecord parses the target and features of a data row. Missing values are left to be imputed.
+func parseRecord(metaData *model.Metadata, missingValues Set, newMetadata bool, record []string) (*DataRecord, error) {
+	dataRecord := &DataRecord{Weight: 1}
+	if metaData.Weighted {
+		weight, err := parseWeight(record[metaData.WeightColumn])
+		if err != nil {
+			return nil, err
+		}
+		dataRecord.Weight = weight
+	}
+	targets := metaData.Targets()
+	if len(targets) > 1 {
+		dataRecord.ExtraTargets = make([]mat.Float, len(targets)-1)
 	}
+	for i, target := range targets {
+		if metaData.Columns[target.Column].Type == model.MultiLabel {
+			labels, err := parseMultiLabelTarget(newMetadata, metaData, target, record[target.Column])
+			if err != nil {
+				return nil, err
+			}
+			if dataRecord.MultiHotTargets == nil {
+				dataRecord.MultiHotTargets = make([]mat.Matrix, len(targets))
+			}
+			dataRecord.MultiHotTargets[i] = labels
+			continue
+		}
+		targetValue, err := parseTarget(newMetadata, metaData, target, record[target.Column])
+		if err != nil {
+			return nil, err
+		}
+		dataRecord.SetTargetValue(i, targetValue)
 
-	return metaData, dataSet, errors, nil
+		targetColumn := metaData.Columns[target.Column]
+		if targetColumn.Type == model.Continuous && newMetadata {
+			targetColumn.Average += float64(targetValue)
+		}
+	}
+
+	dataRecord.ContinuousFeatures = mat.NewEmptyVecDense(metaData.ContinuousFeatureCount())
+	if err := parseContinuousFeatures(metaData, missingValues, record, dataRecord.ContinuousFeatures, newMetadata); err != nil {
+		return nil, err
+	}
+
+	var err error
+	dataRecord.CategoricalFeatures, err = parseCategoricalFeatures(metaData, missingValues, newMetadata, record)
+	if err != nil {
+		return nil, err
+	}
+	return dataRecord, nil
 }
 
-func standardizeTarget(metadata *model.Metadata, set *DataSet) {
-	set.ResetOrder(OriginalOrder)
-	for batch := set.Next(); len(batch) > 0; batch = set.Next() {
-		for _, d := range batch {
-			targetColumn := metadata.Columns[metadata.TargetColumn]
-			d.Target = mat.Float((float64(d.Target) - targetColumn.Average) / targetColumn.StdDev)
+// standardizeTargets standardizes the values of the continuous targets
+func standardizeTargets(metadata *model.Metadata, set *DataSet) {
+	for i, target := range metadata.Targets() {
+		targetColumn := metadata.Columns[target.Column]
+		if targetColumn.Type != model.Continuous {
+			continue
+		}
+		set.ResetOrder(OriginalOrder)
+		for batch := set.Next(); len(batch) > 0; batch = set.Next() {
+			for _, d := range batch {
+				d.SetTargetValue(i, mat.Float((float64(d.TargetValue(i))-targetColumn.Average)/targetColumn.StdDev))
+			}
 		}
 	}
 }
@@ -175,39 +353,290 @@ func standardizeContinuousFeatures(metadata *model.Metadata, set *DataSet) {
 	}
 }
 
-// computeStatistics computes dataset-wide statistics
-// (currently only mean and std deviation of each continuous feature and continuous target)
-func computeStatistics(metadata *model.Metadata, set *DataSet) {
+// computeStatistics computes dataset-wide statistics: mean and std deviation of each continuous feature
+// and continuous targets, and the values used to impute missing values in each feature column.
+// Missing values are ignored when computing the statistics.
+func computeStatistics(metadata *model.Metadata, set *DataSet, missingIndicators bool) {
 	set.ResetOrder(OriginalOrder)
 	stdDevs := make([]float64, len(metadata.Columns))
-	targetStdDev := 0.0
 	dataCount := float64(set.Size())
-	targetColumn := metadata.Columns[metadata.TargetColumn]
+	targets := metadata.Targets()
+	targetStdDevs := make([]float64, len(targets))
+
+	continuousValues := make(map[int][]float64, metadata.ContinuousFeaturesMap.Size())
+	categoricalCounts := make(map[int]map[int]int, metadata.CategoricalFeaturesMap.Size())
+	for column := range metadata.CategoricalFeaturesMap.ColumnToIndex {
+		categoricalCounts[column] = map[int]int{}
+	}
+	hasMissingValues := map[int]bool{}
 
-	for _, col := range metadata.Columns {
-		col.Average = col.Average / dataCount
+	for batch := set.Next(); len(batch) > 0; batch = set.Next() {
+		for _, d := range batch {
+			for column, index := range metadata.ContinuousFeaturesMap.ColumnToIndex {
+				value := float64(d.ContinuousFeatures.At(index, 0))
+				if math.IsNaN(value) {
+					hasMissingValues[column] = true
+					continue
+				}
+				continuousValues[column] = append(continuousValues[column], value)
+			}
+			for column, index := range metadata.CategoricalFeaturesMap.ColumnToIndex {
+				value := d.CategoricalFeatures[index]
+				if value == missingCategory {
+					hasMissingValues[column] = true
+					continue
+				}
+				categoricalCounts[column][value]++
+			}
+		}
 	}
 
+	// Averages are accumulated while parsing
+	for column := range metadata.ContinuousFeaturesMap.ColumnToIndex {
+		if count := len(continuousValues[column]); count > 0 {
+			metadata.Columns[column].Average /= float64(count)
+		}
+	}
+	for _, target := range targets {
+		targetColumn := metadata.Columns[target.Column]
+		targetColumn.Average = targetColumn.Average / dataCount
+	}
+
+	set.ResetOrder(OriginalOrder)
 	for batch := set.Next(); len(batch) > 0; batch = set.Next() {
 		for _, d := range batch {
 			for column, index := range metadata.ContinuousFeaturesMap.ColumnToIndex {
-				diff := math.Pow(float64(d.ContinuousFeatures.At(index, 0))-metadata.Columns[column].Average, 2)
-				stdDevs[column] += diff
+				value := float64(d.ContinuousFeatures.At(index, 0))
+				if math.IsNaN(value) {
+					continue
+				}
+				stdDevs[column] += math.Pow(value-metadata.Columns[column].Average, 2)
+			}
+			for i, target := range targets {
+				targetStdDevs[i] += math.Pow(float64(d.TargetValue(i))-metadata.Columns[target.Column].Average, 2)
+			}
+		}
+	}
+	for column := range metadata.ContinuousFeaturesMap.ColumnToIndex {
+		if count := len(continuousValues[column]); count > 0 {
+			metadata.Columns[column].StdDev = math.Sqrt(stdDevs[column] / float64(count))
+		}
+	}
+	for i, target := range targets {
+		metadata.Columns[target.Column].StdDev = math.Sqrt(targetStdDevs[i] / dataCount)
+	}
+	// Constant and all-missing columns are only centered, as they cannot be scaled to a unit standard deviation
+	for column := range metadata.ContinuousFeaturesMap.ColumnToIndex {
+		if col := metadata.Columns[column]; col.StdDev == 0 {
+			col.StdDev = 1
+		}
+	}
+	for _, target := range targets {
+		if targetColumn := metadata.Columns[target.Column]; targetColumn.Type == model.Continuous && targetColumn.StdDev == 0 {
+			targetColumn.StdDev = 1
+		}
+	}
+	if metadata.RegressionLoss.LogLink() {
+		// The model predicts the logarithm of the original values of the targets
+		for _, target := range targets {
+			if targetColumn := metadata.Columns[target.Column]; targetColumn.Type == model.Continuous {
+				targetColumn.Average = 0
+				targetColumn.StdDev = 1
+			}
+		}
+	}
+
+	for column := range metadata.ContinuousFeaturesMap.ColumnToIndex {
+		col := metadata.Columns[column]
+		switch col.Imputation {
+		case model.MeanImputation:
+			col.ImputedValue = col.Average
+		case model.MedianImputation:
+			col.ImputedValue = median(continuousValues[column])
+		case model.MostFrequentImputation:
+			col.ImputedValue = mostFrequentValue(continuousValues[column])
+		}
+	}
+
+	for _, column := range metadata.CategoricalFeaturesMap.Columns() {
+		col := metadata.Columns[column]
+		mostFrequent, ok := mostFrequentCategory(categoricalCounts[column])
+		if !ok || (col.Imputation == model.ConstantImputation && hasMissingValues[column]) {
+			col.ImputedCategory = model.MissingCategory
+			metadata.CategoricalValuesMap.ValueFor(model.CategoricalValue{Column: column, Value: col.ImputedCategory})
+			continue
+		}
+		col.ImputedCategory = metadata.CategoricalValuesMap.IndexToValue[mostFrequent].Value
+	}
+
+	if missingIndicators {
+		index := metadata.ContinuousFeaturesMap.Size()
+		for column := range metadata.Columns {
+			if hasMissingValues[column] {
+				metadata.MissingIndicatorsMap.Set(column, index)
+				index++
+			}
+		}
+	}
+}
+
+// addUnknownCategories adds an unknown category to each categorical column, holding the values not seen
+// during training. Values seen less than minFrequency times are folded into the unknown category.
+// Unknown categories are placed after all known categories.
+func addUnknownCategories(metadata *model.Metadata, set *DataSet, minFrequency int) {
+	if minFrequency > 1 {
+		foldRareCategories(metadata, set, minFrequency)
+	}
+	for _, column := range metadata.CategoricalFeaturesMap.Columns() {
+		metadata.CategoricalValuesMap.ValueFor(model.CategoricalValue{Column: column, Value: model.UnknownCategory})
+	}
+}
+
+// foldRareCategories removes the categorical values seen less than minFrequency times,
+// re-indexing the remaining values and mapping the removed ones to the unknown category of their column
+func foldRareCategories(metadata *model.Metadata, set *DataSet, minFrequency int) {
+	counts := make([]int, metadata.CategoricalValuesMap.Size())
+	for _, d := range set.Data {
+		for _, index := range d.CategoricalFeatures {
+			if index != missingCategory {
+				counts[index]++
+			}
+		}
+	}
+
+	values := metadata.CategoricalValuesMap
+	folded := model.NewCategoricalValuesMap()
+	newIndex := make([]int, len(counts))
+	for index := range counts {
+		value := values.IndexToValue[index]
+		if counts[index] >= minFrequency || value.Value == model.MissingCategory {
+			newIndex[index] = folded.ValueFor(value)
+		} else {
+			newIndex[index] = missingCategory
+		}
+	}
+	for _, column := range metadata.CategoricalFeaturesMap.Columns() {
+		folded.ValueFor(model.CategoricalValue{Column: column, Value: model.UnknownCategory})
+		col := metadata.Columns[column]
+		if _, ok := folded.ValueToIndex[model.CategoricalValue{Column: column, Value: col.ImputedCategory}]; !ok {
+			col.ImputedCategory = model.UnknownCategory
+		}
+	}
+	for index := range newIndex {
+		if newIndex[index] == missingCategory {
+			newIndex[index], _ = folded.UnknownValueFor(values.IndexToValue[index].Column)
+		}
+	}
+
+	for _, d := range set.Data {
+		for i, index := range d.CategoricalFeatures {
+			if index != missingCategory {
+				d.CategoricalFeatures[i] = newIndex[index]
 			}
-			targetStdDev += math.Pow(float64(d.Target)-targetColumn.Average, 2)
 		}
 	}
-	for i := range stdDevs {
-		metadata.Columns[i].StdDev = math.Sqrt(stdDevs[i] / dataCount)
+	metadata.CategoricalValuesMap = folded
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// mostFrequentValue returns the mode of values, choosing the smallest value in case of ties
+func mostFrequentValue(values []float64) float64 {
+	counts := map[float64]int{}
+	for _, v := range values {
+		counts[v]++
+	}
+	result, resultCount := 0.0, 0
+	for v, count := range counts {
+		if count > resultCount || (count == resultCount && v < result) {
+			result, resultCount = v, count
+		}
+	}
+	return result
+}
+
+// mostFrequentCategory returns the most frequent category index, choosing the smallest index in case of ties
+func mostFrequentCategory(counts map[int]int) (int, bool) {
+	result, resultCount := 0, 0
+	for index, count := range counts {
+		if count > resultCount || (count == resultCount && index < result) {
+			result, resultCount = index, count
+		}
+	}
+	return result, resultCount > 0
+}
+
+// imputeMissingValues replaces missing values with the imputed value of their column,
+// and sets the "is-missing" indicator features
+func imputeMissingValues(metadata *model.Metadata, set *DataSet) error {
+	imputedCategories := make(map[int]int, metadata.CategoricalFeaturesMap.Size())
+	for column := range metadata.CategoricalFeaturesMap.ColumnToIndex {
+		value := model.CategoricalValue{Column: column, Value: metadata.Columns[column].ImputedCategory}
+		if index, ok := metadata.CategoricalValuesMap.ValueToIndex[value]; ok {
+			imputedCategories[column] = index
+		}
+	}
+
+	featureCount := metadata.ContinuousFeatureCount()
+	set.ResetOrder(OriginalOrder)
+	for batch := set.Next(); len(batch) > 0; batch = set.Next() {
+		for _, d := range batch {
+			if d.ContinuousFeatures.Size() != featureCount {
+				features := mat.NewEmptyVecDense(featureCount)
+				copy(features.Data(), d.ContinuousFeatures.Data())
+				d.ContinuousFeatures = features
+			}
+			for column, index := range metadata.ContinuousFeaturesMap.ColumnToIndex {
+				if !math.IsNaN(float64(d.ContinuousFeatures.At(index, 0))) {
+					continue
+				}
+				d.ContinuousFeatures.Set(index, 0, mat.Float(metadata.Columns[column].ImputedValue))
+				setMissingIndicator(metadata, column, d)
+			}
+			for column, index := range metadata.CategoricalFeaturesMap.ColumnToIndex {
+				if d.CategoricalFeatures[index] != missingCategory {
+					continue
+				}
+				imputed, ok := imputedCategories[column]
+				if !ok {
+					return fmt.Errorf("no imputed value available for categorical attribute %s", metadata.Columns[column].Name)
+				}
+				d.CategoricalFeatures[index] = imputed
+				setMissingIndicator(metadata, column, d)
+			}
+		}
 	}
-	targetColumn.StdDev = math.Sqrt(targetStdDev / dataCount)
+	return nil
+}
 
+func setMissingIndicator(metadata *model.Metadata, column int, d *DataRecord) {
+	if metadata.MissingIndicatorsMap == nil {
+		return
+	}
+	if index, ok := metadata.MissingIndicatorsMap.GetColumn(column); ok {
+		d.ContinuousFeatures.Set(index, 0, 1.0)
+	}
 }
 
 func parseColumns(record []string, p DataParameters) []*model.Column {
 	result := make([]*model.Column, len(record))
 
 	columnType := func(c string) model.ColumnType {
+		if _, ok := p.MultiLabelColumns[c]; ok {
+			return model.MultiLabel
+		}
 		if _, ok := p.CategoricalColumns[c]; ok {
 			return model.Categorical
 		}
@@ -215,17 +644,25 @@ func parseColumns(record []string, p DataParameters) []*model.Column {
 	}
 	for i := range result {
 		result[i] = &model.Column{
-			Name: record[i],
-			Type: columnType(record[i]),
+			Name:         record[i],
+			Type:         columnType(record[i]),
+			Imputation:   p.Imputation,
+			ImputedValue: p.ImputationConstant,
 		}
 	}
 
 	return result
 }
 
-func parseCategoricalFeatures(metaData *model.Metadata, newMetadata bool, record []string) ([]int, error) {
+func parseCategoricalFeatures(metaData *model.Metadata, missingValues Set, newMetadata bool, record []string) ([]int, error) {
 	categoricalFeatures := make([]int, metaData.CategoricalFeaturesMap.Size())
-	for column, index := range metaData.CategoricalFeaturesMap.ColumnToIndex {
+	// new values are indexed in the order of the columns, so that the indices do not depend on the map order
+	for _, column := range metaData.CategoricalFeaturesMap.Columns() {
+		index := metaData.CategoricalFeaturesMap.ColumnToIndex[column]
+		if _, ok := missingValues[record[column]]; ok {
+			categoricalFeatures[index] = missingCategory
+			continue
+		}
 		categoryValue := model.CategoricalValue{
 			Column: column,
 			Value:  record[column],
@@ -236,6 +673,9 @@ func parseCategoricalFeatures(metaData *model.Metadata, newMetadata bool, record
 		} else {
 			ok := false
 			valueIndex, ok = metaData.CategoricalValuesMap.ValueToIndex[categoryValue]
+			if !ok {
+				valueIndex, ok = metaData.CategoricalValuesMap.UnknownValueFor(column)
+			}
 			if !ok {
 				return nil, fmt.Errorf("unknown value %s for categorical attribute %s", record[column], metaData.Columns[column].Name)
 			}
@@ -245,8 +685,14 @@ func parseCategoricalFeatures(metaData *model.Metadata, newMetadata bool, record
 	return categoricalFeatures, nil
 }
 
-func parseContinuousFeatures(metaData *model.Metadata, record []string, features mat.Matrix, newMetadata bool) error {
+// parseContinuousFeatures parses the continuous features of a record into features.
+// Missing values are set to NaN, to be imputed once the dataset statistics are known.
+func parseContinuousFeatures(metaData *model.Metadata, missingValues Set, record []string, features mat.Matrix, newMetadata bool) error {
 	for column, index := range metaData.ContinuousFeaturesMap.ColumnToIndex {
+		if _, ok := missingValues[record[column]]; ok {
+			features.Set(index, 0, mat.Float(math.NaN()))
+			continue
+		}
 		value, err := strconv.ParseFloat(record[column], 64)
 		if err != nil {
 			return fmt.Errorf("error parsing feature %s: %w", metaData.Columns[column].Name, err)
@@ -259,33 +705,101 @@ func parseContinuousFeatures(metaData *model.Metadata, record []string, features
 	return nil
 }
 
-func parseTarget(newMetadata bool, metaData *model.Metadata, target string) (mat.Float, error) {
+func parseTarget(newMetadata bool, metaData *model.Metadata, target *model.Target, value string) (mat.Float, error) {
 
 	var parseFunc func(string) (mat.Float, error)
-	switch metaData.TargetType() {
+	switch metaData.Columns[target.Column].Type {
 	case model.Categorical:
 		if newMetadata {
-			parseFunc = metaData.ParseOrAddCategoricalTarget
+			parseFunc = func(value string) (mat.Float, error) {
+				index, _ := target.Map.ValueFor(value)
+				return mat.Float(index), nil
+			}
 		} else {
-			parseFunc = metaData.ParseCategoricalTarget
+			parseFunc = func(value string) (mat.Float, error) {
+				index, ok := target.Map.ContainsName(value)
+				if !ok {
+					return 0, fmt.Errorf("unknown categorical target value %s", value)
+				}
+				return mat.Float(index), nil
+			}
 		}
 	case model.Continuous:
 		parseFunc = metaData.ParseContinuousTarget
 	}
 
-	targetValue, err := parseFunc(target)
+	targetValue, err := parseFunc(value)
 	if err != nil {
-		return 0, fmt.Errorf("unable to parse target value %s: %w", target, err)
+		return 0, fmt.Errorf("unable to parse target value %s: %w", value, err)
+	}
+	if metaData.Columns[target.Column].Type == model.Continuous && metaData.RegressionLoss.LogLink() && targetValue < 0 {
+		return 0, fmt.Errorf("negative target value %s, not supported with a log link", value)
 	}
 
 	return targetValue, nil
 }
 
+// parseWeight parses a sample weight, which must be a non-negative number
+func parseWeight(value string) (mat.Float, error) {
+	weight, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse sample weight %s: %w", value, err)
+	}
+	if weight < 0 || math.IsInf(weight, 0) || math.IsNaN(weight) {
+		return 0, fmt.Errorf("invalid sample weight %s", value)
+	}
+	return mat.Float(weight), nil
+}
+
+// parseMultiLabelTarget parses the labels of a multi-label target into a multi-hot vector. While the labels are
+// collected, the vector only has room for the labels seen so far, and is resized by resizeMultiHotTargets.
+func parseMultiLabelTarget(newMetadata bool, metaData *model.Metadata, target *model.Target, value string) (mat.Matrix, error) {
+	var indexes []int
+	if value != "" {
+		for _, label := range strings.Split(value, metaData.LabelSeparator) {
+			var index int
+			if newMetadata {
+				index, _ = target.Map.ValueFor(label)
+			} else {
+				var ok bool
+				index, ok = target.Map.ContainsName(label)
+				if !ok {
+					return nil, fmt.Errorf("unable to parse target value %s: unknown label %s", value, label)
+				}
+			}
+			indexes = append(indexes, index)
+		}
+	}
+	labels := mat.NewEmptyVecDense(target.Map.Size())
+	for _, index := range indexes {
+		labels.Set(index, 0, 1)
+	}
+	return labels, nil
+}
+
+// resizeMultiHotTargets gives the multi-hot vectors of the multi-label targets one element per label
+// of their target
+func resizeMultiHotTargets(metadata *model.Metadata, set *DataSet) {
+	for i, target := range metadata.Targets() {
+		if metadata.Columns[target.Column].Type != model.MultiLabel {
+			continue
+		}
+		size := target.Map.Size()
+		for _, d := range set.Data {
+			if d.MultiHotTargets[i].Size() != size {
+				labels := mat.NewEmptyVecDense(size)
+				copy(labels.Data(), d.MultiHotTargets[i].Data())
+				d.MultiHotTargets[i] = labels
+			}
+		}
+	}
+}
+
 func buildFeatureIndex(metaData *model.Metadata) {
 	continuousFeatureIndex := 0
 	categoricalFeatureIndex := 0
 	for i, col := range metaData.Columns {
-		if i != metaData.TargetColumn {
+		if metaData.IsFeatureColumn(i) {
 			if col.Type == model.Continuous {
 				metaData.ContinuousFeaturesMap.Set(i, continuousFeatureIndex)
 				continuousFeatureIndex++
@@ -297,14 +811,56 @@ func buildFeatureIndex(metaData *model.Metadata) {
 	}
 }
 
-func setTargetColumn(p DataParameters, metaData *model.Metadata) error {
+// setTargetColumns sets the target columns of the metadata, or marks the data as unlabeled
+// when no target column is specified
+func setTargetColumns(p DataParameters, metaData *model.Metadata) error {
+	metaData.TargetColumn = model.NoTarget
+	seen := NewSet()
+	for _, name := range p.TargetColumns {
+		if name == "" {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			return fmt.Errorf("target column %s specified more than once", name)
+		}
+		seen[name] = Void
+		column, ok := columnIndex(metaData, name)
+		if !ok {
+			return fmt.Errorf("target column %s not found in data header", name)
+		}
+		if !metaData.HasTarget() {
+			metaData.TargetColumn = column
+			continue
+		}
+		metaData.ExtraTargets = append(metaData.ExtraTargets, &model.Target{Column: column, Map: model.NewNameMap()})
+	}
+	return nil
+}
+
+// setWeightColumn sets the sample weight column of the metadata, when one is specified
+func setWeightColumn(p DataParameters, metaData *model.Metadata) error {
+	if p.WeightColumn == "" {
+		return nil
+	}
+	column, ok := columnIndex(metaData, p.WeightColumn)
+	if !ok {
+		return fmt.Errorf("weight column %s not found in data header", p.WeightColumn)
+	}
+	if metaData.IsTargetColumn(column) {
+		return fmt.Errorf("weight column %s is a target column", p.WeightColumn)
+	}
+	metaData.Weighted = true
+	metaData.WeightColumn = column
+	return nil
+}
+
+func columnIndex(metaData *model.Metadata, name string) (int, bool) {
 	for i, col := range metaData.Columns {
-		if col.Name == p.TargetColumn {
-			metaData.TargetColumn = i
-			return nil
+		if col.Name == name {
+			return i, true
 		}
 	}
-	return fmt.Errorf("target column %s not found in data header", p.TargetColumn)
+	return 0, false
 }
 
 func SaveModel(model *model.Model, writer io.Writer) error {
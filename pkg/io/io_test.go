@@ -1,8 +1,11 @@
 package io
 
 import (
+	"io/ioutil"
 	"math"
 	"math/rand"
+	"os"
+	"strings"
 	"testing"
 
 	mat "github.com/nlpodyssey/spago/pkg/mat32"
@@ -14,7 +17,7 @@ import (
 func TestLoadData(t *testing.T) {
 	params := DataParameters{
 		DataFile:           "../../datasets/breast_cancer/breast-cancer.train",
-		TargetColumn:       "Class",
+		TargetColumns:      []string{"Class"},
 		CategoricalColumns: NewSet("Class", "Age", "Menopause", "Tumor-size", "Inv-nodes", "Node-caps", "Breast", "Breast-quad", "Irradiat"),
 		BatchSize:          10,
 	}
@@ -27,13 +30,200 @@ func TestLoadData(t *testing.T) {
 
 	require.Equal(t, 1, dataSet.Data[0].ContinuousFeatures.Rows())
 	require.Equal(t, 8, len(dataSet.Data[0].CategoricalFeatures))
+	// new values are indexed in the order of their columns
+	require.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7}, dataSet.Data[0].CategoricalFeatures)
 
 	params.DataFile = "../../datasets/breast_cancer/breast-cancer.test"
 	testMetaData, dataSet, dataErrors, err := LoadData(params, metaData)
 	require.NoError(t, err)
 	require.Equal(t, metaData, testMetaData)
-	require.Equal(t, 1, len(dataErrors)) // Line 8 contains a category value for Age not present in training
-	require.Equal(t, 56, len(dataSet.Data))
+	require.Equal(t, 0, len(dataErrors))
+	require.Equal(t, 57, len(dataSet.Data))
+
+	// Record 8 contains a category value for Age not present in training
+	ageColumn := 1
+	unknownAge, ok := metaData.CategoricalValuesMap.UnknownValueFor(ageColumn)
+	require.True(t, ok)
+	ageIndex, _ := metaData.CategoricalFeaturesMap.GetColumn(ageColumn)
+	require.Equal(t, unknownAge, dataSet.Data[8].CategoricalFeatures[ageIndex])
+}
+
+func TestLoadData_MinCategoryFrequency(t *testing.T) {
+	trainFile := writeTempFile(t, "c,d,target\na,x,0\nb,x,1\na,y,0\nc,x,1\na,x,0\n")
+	defer os.Remove(trainFile)
+	params := DataParameters{
+		DataFile:             trainFile,
+		TargetColumns:        []string{"target"},
+		CategoricalColumns:   NewSet("c", "d"),
+		BatchSize:            10,
+		MinCategoryFrequency: 2,
+	}
+	metaData, dataSet, dataErrors, err := LoadData(params, nil)
+	require.NoError(t, err)
+	require.Empty(t, dataErrors)
+
+	values := metaData.CategoricalValuesMap
+	require.Equal(t, 4, values.Size())
+	a, ok := values.ValueToIndex[model.CategoricalValue{Column: 0, Value: "a"}]
+	require.True(t, ok)
+	x, ok := values.ValueToIndex[model.CategoricalValue{Column: 1, Value: "x"}]
+	require.True(t, ok)
+	unknownC, ok := values.UnknownValueFor(0)
+	require.True(t, ok)
+	unknownD, ok := values.UnknownValueFor(1)
+	require.True(t, ok)
+	// Unknown categories are placed after the known ones
+	require.ElementsMatch(t, []int{2, 3}, []int{unknownC, unknownD})
+
+	require.Equal(t, []int{a, x}, dataSet.Data[0].CategoricalFeatures)
+	require.Equal(t, []int{unknownC, x}, dataSet.Data[1].CategoricalFeatures)
+	require.Equal(t, []int{a, unknownD}, dataSet.Data[2].CategoricalFeatures)
+	require.Equal(t, []int{unknownC, x}, dataSet.Data[3].CategoricalFeatures)
+
+	_, testDataSet, dataErrors, err := LoadData(DataParameters{DataFile: trainFile, TargetColumns: []string{"target"}, BatchSize: 10}, metaData)
+	require.NoError(t, err)
+	require.Empty(t, dataErrors)
+	for i := range dataSet.Data {
+		require.Equal(t, dataSet.Data[i].CategoricalFeatures, testDataSet.Data[i].CategoricalFeatures)
+	}
+}
+
+func TestLoadData_MissingValues(t *testing.T) {
+	trainFile := writeTempFile(t, "x,y,c,target\n1,10,a,0\n2,NA,a,1\n3,20,?,0\nNA,30,b,1\n6,20,a,0\n")
+	defer os.Remove(trainFile)
+
+	tests := []struct {
+		imputation      model.ImputationStrategy
+		expectedX       float64
+		expectedY       float64
+		expectedC       string
+		expectedIndices map[int]int
+	}{
+		{imputation: model.MeanImputation, expectedX: 3.0, expectedY: 20.0, expectedC: "a"},
+		{imputation: model.MedianImputation, expectedX: 2.5, expectedY: 20.0, expectedC: "a"},
+		{imputation: model.MostFrequentImputation, expectedX: 1.0, expectedY: 20.0, expectedC: "a"},
+		{imputation: model.ConstantImputation, expectedX: -1.0, expectedY: -1.0, expectedC: model.MissingCategory},
+	}
+	for _, tt := range tests {
+		params := DataParameters{
+			DataFile:           trainFile,
+			TargetColumns:      []string{"target"},
+			CategoricalColumns: NewSet("c"),
+			BatchSize:          10,
+			MissingValues:      NewSet("NA", "?"),
+			Imputation:         tt.imputation,
+			ImputationConstant: -1.0,
+			MissingIndicators:  true,
+		}
+		metaData, dataSet, dataErrors, err := LoadData(params, nil)
+		require.NoError(t, err)
+		require.Empty(t, dataErrors)
+		require.Equal(t, 5, dataSet.Size())
+		require.Equal(t, []string{"?", "NA"}, metaData.MissingValues)
+
+		require.InDelta(t, tt.expectedX, metaData.Columns[0].ImputedValue, 1e-6)
+		require.InDelta(t, tt.expectedY, metaData.Columns[1].ImputedValue, 1e-6)
+		require.Equal(t, tt.expectedC, metaData.Columns[2].ImputedCategory)
+
+		// One indicator per column with missing values, placed after the continuous features
+		require.Equal(t, map[int]int{0: 2, 1: 3, 2: 4}, metaData.MissingIndicatorsMap.ColumnToIndex)
+		require.Equal(t, 6, metaData.FeatureCount())
+
+		indicators := func(d *DataRecord) []mat.Float {
+			return d.ContinuousFeatures.Data()[2:]
+		}
+		require.Equal(t, []mat.Float{0, 0, 0}, indicators(dataSet.Data[0]))
+		require.Equal(t, []mat.Float{0, 1, 0}, indicators(dataSet.Data[1]))
+		require.Equal(t, []mat.Float{0, 0, 1}, indicators(dataSet.Data[2]))
+		require.Equal(t, []mat.Float{1, 0, 0}, indicators(dataSet.Data[3]))
+
+		imputedCategory := metaData.CategoricalValuesMap.ValueToIndex[model.CategoricalValue{Column: 2, Value: tt.expectedC}]
+		require.Equal(t, imputedCategory, dataSet.Data[2].CategoricalFeatures[0])
+
+		// The same policy is applied when loading data with existing metadata
+		testMetaData, testDataSet, dataErrors, err := LoadData(DataParameters{DataFile: trainFile, TargetColumns: []string{"target"}, BatchSize: 10}, metaData)
+		require.NoError(t, err)
+		require.Empty(t, dataErrors)
+		require.Equal(t, metaData, testMetaData)
+		for i := range dataSet.Data {
+			require.Equal(t, dataSet.Data[i].ContinuousFeatures.Data(), testDataSet.Data[i].ContinuousFeatures.Data())
+			require.Equal(t, dataSet.Data[i].CategoricalFeatures, testDataSet.Data[i].CategoricalFeatures)
+		}
+	}
+
+	// Without missing value tokens, rows with missing values are rejected
+	_, dataSet, dataErrors, err := LoadData(DataParameters{
+		DataFile:           trainFile,
+		TargetColumns:      []string{"target"},
+		CategoricalColumns: NewSet("c"),
+		BatchSize:          10,
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(dataErrors))
+	require.Equal(t, 3, dataSet.Size())
+}
+
+func TestLoadData_ConstantColumns(t *testing.T) {
+	trainFile := writeTempFile(t, "x,y,z,target\nNA,5,1,3\nNA,5,2,3\nNA,5,3,3\n")
+	defer os.Remove(trainFile)
+
+	for _, imputation := range []model.ImputationStrategy{model.MeanImputation, model.ConstantImputation} {
+		metaData, dataSet, dataErrors, err := LoadData(DataParameters{
+			DataFile:           trainFile,
+			TargetColumns:      []string{"target"},
+			BatchSize:          10,
+			MissingValues:      NewSet("NA"),
+			Imputation:         imputation,
+			ImputationConstant: 2,
+		}, nil)
+		require.NoError(t, err)
+		require.Empty(t, dataErrors)
+
+		// The all-missing column x, the constant column y and the constant target are centered without scaling
+		require.Equal(t, 1.0, metaData.Columns[0].StdDev)
+		require.Equal(t, 1.0, metaData.Columns[1].StdDev)
+		require.Equal(t, 1.0, metaData.Columns[3].StdDev)
+		for _, d := range dataSet.Data {
+			x := d.ContinuousFeatures.At(0, 0)
+			require.False(t, math.IsNaN(float64(x)))
+			require.Equal(t, mat.Float(metaData.Columns[0].ImputedValue), x)
+			require.Equal(t, mat.Float(0), d.ContinuousFeatures.At(1, 0))
+			require.Equal(t, mat.Float(0), d.Target)
+		}
+		require.InDelta(t, 1.0, stdDev(dataSet, valueForColumn(t, metaData, "z")), 1e-6)
+	}
+}
+
+func TestLoadRows(t *testing.T) {
+	dataFile := writeTempFile(t, "x,target\n1,a\n3,b\n100,c\n")
+	defer os.Remove(dataFile)
+	header, rows, err := ReadRows(dataFile)
+	require.NoError(t, err)
+	require.Equal(t, []string{"x", "target"}, header)
+	require.Equal(t, [][]string{{"1", "a"}, {"3", "b"}, {"100", "c"}}, rows)
+
+	params := DataParameters{TargetColumns: []string{"target"}, CategoricalColumns: NewSet("target"), BatchSize: 10}
+	all, _, _, err := LoadRows(params, header, rows, nil)
+	require.NoError(t, err)
+
+	// the statistics of metadata computed from part of the rows only depend on these rows,
+	// while the target classes given by the parameters come first, in the same order
+	params.TargetMaps = []*model.NameMap{all.TargetMap}
+	metaData, dataSet, dataErrors, err := LoadRows(params, header, [][]string{rows[1], rows[0]}, nil)
+	require.NoError(t, err)
+	require.Empty(t, dataErrors)
+	require.Equal(t, 2.0, metaData.Columns[0].Average)
+	require.Equal(t, all.TargetMap, metaData.TargetMap)
+	require.Equal(t, mat.Float(1), dataSet.Data[0].Target)
+}
+
+func writeTempFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(content)
+	require.NoError(t, err)
+	return f.Name()
 }
 
 func TestDataSet(t *testing.T) {
@@ -105,6 +295,45 @@ func TestDataSet_RandomSplit(t *testing.T) {
 
 }
 
+func TestDataSet_KFoldSplit(t *testing.T) {
+	data := make([]*DataRecord, 100)
+	for i := range data {
+		data[i] = &DataRecord{
+			Target: mat.Float(i % 4),
+		}
+	}
+	ds := NewDataSet(data, 10)
+	ds.Rand = rand.New(rand.NewSource(42))
+
+	folds := ds.KFoldSplit(5, true)
+	require.Equal(t, 5, len(folds))
+	for _, fold := range folds {
+		require.Equal(t, 80, fold.Train.Size())
+		require.Equal(t, 20, fold.Test.Size())
+		counts := map[mat.Float]int{}
+		for _, target := range extractOrder(fold.Test) {
+			counts[target]++
+		}
+		// Each target value is equally represented in each fold
+		require.Equal(t, map[mat.Float]int{0: 5, 1: 5, 2: 5, 3: 5}, counts)
+	}
+
+	// Each record is held out in exactly one fold
+	heldOut := map[*DataRecord]int{}
+	for _, fold := range folds {
+		fold.Test.ResetOrder(OriginalOrder)
+		for b := fold.Test.Next(); len(b) > 0; b = fold.Test.Next() {
+			for _, d := range b {
+				heldOut[d]++
+			}
+		}
+	}
+	require.Equal(t, 100, len(heldOut))
+	for _, count := range heldOut {
+		require.Equal(t, 1, count)
+	}
+}
+
 func extractOrder(split *DataSet) []mat.Float {
 	order := make([]mat.Float, 0)
 	for b := split.Next(); len(b) > 0; b = split.Next() {
@@ -118,7 +347,7 @@ func extractOrder(split *DataSet) []mat.Float {
 func Test_Standardization(t *testing.T) {
 	params := DataParameters{
 		DataFile:           "../../datasets/iris/iris.train",
-		TargetColumn:       "species",
+		TargetColumns:      []string{"species"},
 		CategoricalColumns: NewSet("species"),
 		BatchSize:          10,
 	}
@@ -155,7 +384,7 @@ func Test_Standardization(t *testing.T) {
 func Test_Standardization_Target(t *testing.T) {
 	params := DataParameters{
 		DataFile:           "../../datasets/cholesterol/cholesterol-train.csv",
-		TargetColumn:       "chol",
+		TargetColumns:      []string{"chol"},
 		CategoricalColumns: NewSet("sex", "cp", "fbs", "restecg", "exang", "slope", "thal"),
 		BatchSize:          10,
 	}
@@ -185,6 +414,54 @@ func Test_Standardization_Target(t *testing.T) {
 
 }
 
+func Test_MultiTarget(t *testing.T) {
+	params := DataParameters{
+		DataFile:           "../../datasets/cholesterol/cholesterol-train.csv",
+		TargetColumns:      []string{"chol", "num"},
+		CategoricalColumns: NewSet("sex", "cp", "fbs", "restecg", "exang", "slope", "thal", "num"),
+		BatchSize:          10,
+	}
+	metaData, dataSet, _, err := LoadData(params, nil)
+	require.NoError(t, err)
+	require.NotZero(t, dataSet.Size())
+
+	targets := metaData.Targets()
+	require.Len(t, targets, 2)
+	require.True(t, metaData.IsMultiTarget())
+	require.Equal(t, "chol", metaData.Columns[targets[0].Column].Name)
+	require.Equal(t, "num", metaData.Columns[targets[1].Column].Name)
+	require.Equal(t, 5, targets[1].Map.Size())
+	require.Equal(t, 6, metaData.OutputDimension())
+
+	// target columns are not features
+	require.Len(t, metaData.FeatureColumns(), len(metaData.Columns)-2)
+	require.Equal(t, len(metaData.Columns)-2, metaData.ContinuousFeaturesMap.Size()+metaData.CategoricalFeaturesMap.Size())
+
+	_, testDataSet, dataErrors, err := LoadData(DataParameters{
+		DataFile:      "../../datasets/cholesterol/cholesterol-test.csv",
+		TargetColumns: []string{"chol", "num"},
+		BatchSize:     10,
+	}, metaData)
+	require.NoError(t, err)
+	require.Empty(t, dataErrors)
+
+	chol := func(d *DataRecord) float64 {
+		return float64(d.TargetValue(0))
+	}
+	require.InDelta(t, averageValue(dataSet, chol), 0, 1e-1)
+	require.InDelta(t, stdDev(dataSet, chol), 1.0, 1e-1)
+	for _, set := range []*DataSet{dataSet, testDataSet} {
+		for _, d := range set.Data {
+			require.Len(t, d.ExtraTargets, 1)
+			require.Contains(t, []string{"0", "1", "2", "3", "4"}, targets[1].Map.IndexToName[int(d.TargetValue(1))])
+		}
+	}
+
+	params.TargetColumns = []string{"chol", "chol"}
+	_, _, _, err = LoadData(params, nil)
+	require.Error(t, err)
+}
+
 func stdDev(ds *DataSet, v valueFunc) float64 {
 	avg := averageValue(ds, v)
 	ds.ResetOrder(OriginalOrder)
@@ -230,3 +507,179 @@ func averageValue(ds *DataSet, v valueFunc) float64 {
 	avg = avg / (float64(ds.Size()))
 	return avg
 }
+
+func TestDataReader(t *testing.T) {
+	params := DataParameters{
+		DataFile:           "../../datasets/breast_cancer/breast-cancer.train",
+		TargetColumns:      []string{"Class"},
+		CategoricalColumns: NewSet("Class", "Age", "Menopause", "Tumor-size", "Inv-nodes", "Node-caps", "Breast", "Breast-quad", "Irradiat"),
+		BatchSize:          10,
+	}
+	metaData, _, _, err := LoadData(params, nil)
+	require.NoError(t, err)
+	params.DataFile = "../../datasets/breast_cancer/breast-cancer.test"
+	_, dataSet, _, err := LoadData(params, metaData)
+	require.NoError(t, err)
+
+	input, err := os.Open(params.DataFile)
+	require.NoError(t, err)
+	defer input.Close()
+	reader, err := NewDataReader(input, metaData, 10)
+	require.NoError(t, err)
+	var data []*DataRecord
+	for {
+		batch, dataErrors, err := reader.Next()
+		require.NoError(t, err)
+		require.Empty(t, dataErrors)
+		if len(batch) == 0 {
+			break
+		}
+		require.LessOrEqual(t, len(batch), 10)
+		data = append(data, batch...)
+	}
+	require.Equal(t, dataSet.Data, data)
+}
+
+func TestDataReader_Header(t *testing.T) {
+	trainFile := writeTempFile(t, "x,c,target\n1,a,2\n2,b,4\n3,a,6\n")
+	defer os.Remove(trainFile)
+	metaData, _, _, err := LoadData(DataParameters{
+		DataFile:           trainFile,
+		TargetColumns:      []string{"target"},
+		CategoricalColumns: NewSet("c"),
+		BatchSize:          10,
+	}, nil)
+	require.NoError(t, err)
+
+	// columns are matched by name, and columns unknown to the model are ignored
+	reader, err := NewDataReader(strings.NewReader("id,target,c,x\nr1,4,b,2\nr2,6,a,abc\nr3,2\n"), metaData, 10)
+	require.NoError(t, err)
+	batch, dataErrors, err := reader.Next()
+	require.NoError(t, err)
+	require.Len(t, batch, 1)
+	require.InDelta(t, 0.0, batch[0].ContinuousFeatures.At(0, 0), 1e-6)
+	require.InDelta(t, 0.0, batch[0].Target, 1e-6)
+	require.Len(t, dataErrors, 2)
+	require.Equal(t, 1, dataErrors[0].Line)
+	require.Equal(t, 2, dataErrors[1].Line)
+
+	batch, _, err = reader.Next()
+	require.NoError(t, err)
+	require.Empty(t, batch)
+
+	_, err = NewDataReader(strings.NewReader("x,target\n1,2\n"), metaData, 10)
+	require.Error(t, err)
+}
+
+func Test_MultiLabel(t *testing.T) {
+	trainFile := writeTempFile(t, "a,c,tags\n1,x,\n2,y,red\n3,x,red|blue\n4,y,green|red\n")
+	defer os.Remove(trainFile)
+	params := DataParameters{
+		DataFile:           trainFile,
+		TargetColumns:      []string{"tags"},
+		CategoricalColumns: NewSet("c"),
+		MultiLabelColumns:  NewSet("tags"),
+		LabelSeparator:     "|",
+		BatchSize:          10,
+	}
+	metaData, dataSet, dataErrors, err := LoadData(params, nil)
+	require.NoError(t, err)
+	require.Empty(t, dataErrors)
+	require.Equal(t, model.MultiLabel, metaData.TargetType())
+	require.Equal(t, "|", metaData.LabelSeparator)
+	require.Equal(t, 3, metaData.TargetMap.Size())
+	require.Equal(t, 3, metaData.OutputDimension())
+	require.Equal(t, 2, metaData.FeatureCount())
+
+	labels := func(set *DataSet) [][]mat.Float {
+		var result [][]mat.Float
+		for _, d := range set.Data {
+			result = append(result, d.MultiHotTarget(0).Data())
+		}
+		return result
+	}
+	// labels are indexed in order of appearance: red, blue, green
+	expected := [][]mat.Float{{0, 0, 0}, {1, 0, 0}, {1, 1, 0}, {1, 0, 1}}
+	require.Equal(t, expected, labels(dataSet))
+
+	testFile := writeTempFile(t, "a,c,tags\n1,x,green|blue\n2,y,purple\n")
+	defer os.Remove(testFile)
+	params.DataFile = testFile
+	_, testDataSet, dataErrors, err := LoadData(params, metaData)
+	require.NoError(t, err)
+	require.Len(t, dataErrors, 1)
+	require.Equal(t, [][]mat.Float{{0, 1, 1}}, labels(testDataSet))
+
+	// multi-label columns are only accepted as targets
+	params.DataFile = trainFile
+	params.TargetColumns = []string{"a"}
+	_, _, _, err = LoadData(params, nil)
+	require.Error(t, err)
+}
+
+func Test_WeightColumn(t *testing.T) {
+	trainFile := writeTempFile(t, "a,w,target\n1,2,x\n2,0.5,y\n3,-1,x\n4,1,y\n")
+	defer os.Remove(trainFile)
+	params := DataParameters{
+		DataFile:           trainFile,
+		TargetColumns:      []string{"target"},
+		CategoricalColumns: NewSet("target"),
+		WeightColumn:       "w",
+		BatchSize:          10,
+	}
+	metaData, dataSet, dataErrors, err := LoadData(params, nil)
+	require.NoError(t, err)
+	// negative weights are rejected
+	require.Len(t, dataErrors, 1)
+	require.True(t, metaData.Weighted)
+	require.Equal(t, 1, metaData.WeightColumn)
+	require.Equal(t, []int{0}, metaData.FeatureColumns())
+	require.Equal(t, 1, metaData.FeatureCount())
+
+	var weights []mat.Float
+	for _, d := range dataSet.Data {
+		weights = append(weights, d.Weight)
+	}
+	require.Equal(t, []mat.Float{2, 0.5, 1}, weights)
+
+	params.WeightColumn = "target"
+	_, _, _, err = LoadData(params, nil)
+	require.Error(t, err)
+
+	params.WeightColumn = "missing"
+	_, _, _, err = LoadData(params, nil)
+	require.Error(t, err)
+
+	// records are not weighted without a weight column
+	params.WeightColumn = ""
+	metaData, dataSet, _, err = LoadData(params, nil)
+	require.NoError(t, err)
+	require.False(t, metaData.Weighted)
+	require.Equal(t, mat.Float(1), dataSet.Data[0].Weight)
+	require.Equal(t, 2, metaData.FeatureCount())
+}
+
+func Test_LogLinkTarget(t *testing.T) {
+	trainFile := writeTempFile(t, "a,count\n1,0\n2,3\n3,-1\n4,9\n")
+	defer os.Remove(trainFile)
+	params := DataParameters{
+		DataFile:       trainFile,
+		TargetColumns:  []string{"count"},
+		RegressionLoss: model.RegressionLoss{Function: model.PoissonLoss},
+		BatchSize:      10,
+	}
+	metaData, dataSet, dataErrors, err := LoadData(params, nil)
+	require.NoError(t, err)
+	// negative targets are rejected
+	require.Len(t, dataErrors, 1)
+	require.Equal(t, model.PoissonLoss, metaData.RegressionLoss.Function)
+
+	// targets predicted with a log link are not standardized
+	var targets []mat.Float
+	for _, d := range dataSet.Data {
+		targets = append(targets, d.Target)
+	}
+	require.Equal(t, []mat.Float{0, 3, 9}, targets)
+	require.Equal(t, 0.0, metaData.Columns[1].Average)
+	require.Equal(t, 1.0, metaData.Columns[1].StdDev)
+}
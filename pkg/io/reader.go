@@ -0,0 +1,104 @@
+package io
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+
+	"golem/pkg/model"
+)
+
+// DataReader reads the records of CSV data one batch at a time, parsing them with the metadata of a trained
+// model, so that data of any size can be processed in constant memory. The first line of the data is a header,
+// whose column names are matched to the model columns; other columns are ignored.
+type DataReader struct {
+	reader        *csv.Reader
+	metaData      *model.Metadata
+	missingValues Set
+	batchSize     int
+	// fileColumns holds the index in the data of each model column
+	fileColumns []int
+	line        int
+}
+
+// NewDataReader reads the header of the data and returns a reader of its records
+func NewDataReader(input io.Reader, metaData *model.Metadata, batchSize int) (*DataReader, error) {
+	reader := csv.NewReader(input)
+	reader.Comma = ','
+	// rows with missing fields are reported as data errors
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading data header: %w", err)
+	}
+	headerIndex := make(map[string]int, len(header))
+	for i, name := range header {
+		headerIndex[name] = i
+	}
+	fileColumns := make([]int, len(metaData.Columns))
+	for column, c := range metaData.Columns {
+		index, ok := headerIndex[c.Name]
+		if !ok {
+			return nil, fmt.Errorf("column %s not found in data header", c.Name)
+		}
+		fileColumns[column] = index
+	}
+	return &DataReader{
+		reader:        reader,
+		metaData:      metaData,
+		missingValues: NewSet(metaData.MissingValues...),
+		batchSize:     batchSize,
+		fileColumns:   fileColumns,
+	}, nil
+}
+
+// Next returns the next batch of parsed records along with the errors of the records that could not be parsed,
+// which are numbered from the first line after the header. The batch is empty at the end of the data.
+func (r *DataReader) Next() (DataBatch, []DataError, error) {
+	var errors []DataError
+	batch := make(DataBatch, 0, r.batchSize)
+	for len(batch) < r.batchSize {
+		record, err := r.reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading data: %w", err)
+		}
+		line := r.line
+		r.line++
+		row := make([]string, len(r.fileColumns))
+		missingField := false
+		for column, index := range r.fileColumns {
+			if index >= len(record) {
+				missingField = true
+				break
+			}
+			row[column] = record[index]
+		}
+		if missingField {
+			errors = append(errors, DataError{
+				Line:  line,
+				Error: fmt.Sprintf("expected %d fields, got %d", len(r.fileColumns), len(record)),
+			})
+			continue
+		}
+		dataRecord, err := parseRecord(r.metaData, r.missingValues, false, row)
+		if err != nil {
+			errors = append(errors, DataError{
+				Line:  line,
+				Error: err.Error(),
+			})
+			continue
+		}
+		batch = append(batch, dataRecord)
+	}
+
+	dataSet := NewDataSet(batch, len(batch))
+	if err := imputeMissingValues(r.metaData, dataSet); err != nil {
+		return nil, nil, err
+	}
+	standardizeContinuousFeatures(r.metaData, dataSet)
+	standardizeTargets(r.metaData, dataSet)
+	return batch, errors, nil
+}
@@ -0,0 +1,201 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+// metricsReport holds the metrics of an evaluation by name, in a form that can be encoded as JSON
+type metricsReport map[string]interface{}
+
+// writeMetricsReport writes the report as JSON to the named file
+func writeMetricsReport(fileName string, report interface{}) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding metrics: %w", err)
+	}
+	if err := ioutil.WriteFile(fileName, data, 0644); err != nil {
+		return fmt.Errorf("error writing metrics to %s: %w", fileName, err)
+	}
+	return nil
+}
+
+// classCounts holds the weighted counts of the decisions of a classifier for a class
+type classCounts struct {
+	TruePos  float64
+	TrueNeg  float64
+	FalsePos float64
+	FalseNeg float64
+}
+
+// Precision returns the fraction of the positive decisions that are correct, NaN when there are none
+func (c *classCounts) Precision() float64 {
+	return c.TruePos / (c.TruePos + c.FalsePos)
+}
+
+// Recall returns the fraction of the positive examples that are decided positive, NaN when there are none
+func (c *classCounts) Recall() float64 {
+	return c.TruePos / (c.TruePos + c.FalseNeg)
+}
+
+// F1Score returns the harmonic mean of the precision and recall, zero when either is undefined
+func (c *classCounts) F1Score() float64 {
+	precision, recall := zeroIfNaN(c.Precision()), zeroIfNaN(c.Recall())
+	return zeroIfNaN(2 * precision * recall / (precision + recall))
+}
+
+// scoredExample is a score assigned to an example for a binary decision, along with the expected decision
+// and the weight of the example
+type scoredExample struct {
+	score    float64
+	positive bool
+	weight   float64
+}
+
+// sortByDecreasingScore sorts the examples by decreasing score, returning the weight of the positive
+// and negative examples
+func sortByDecreasingScore(examples []scoredExample) (float64, float64) {
+	sort.SliceStable(examples, func(i, j int) bool {
+		return examples[i].score > examples[j].score
+	})
+	positives, negatives := 0.0, 0.0
+	for _, e := range examples {
+		if e.positive {
+			positives += e.weight
+		} else {
+			negatives += e.weight
+		}
+	}
+	return positives, negatives
+}
+
+// rocAUC returns the area under the ROC curve, computed as the probability of a positive example
+// being scored higher than a negative one, with ties counting as half. It is not defined unless there are
+// both positive and negative examples.
+func rocAUC(examples []scoredExample) (float64, bool) {
+	positives, negatives := sortByDecreasingScore(examples)
+	if positives == 0 || negatives == 0 {
+		return 0, false
+	}
+	// Examples are scanned by decreasing score, counting the negatives scored higher than each group of ties
+	result := 0.0
+	higherNegatives := 0.0
+	for start := 0; start < len(examples); {
+		end := start
+		tiedPositives, tiedNegatives := 0.0, 0.0
+		for end < len(examples) && examples[end].score == examples[start].score {
+			if examples[end].positive {
+				tiedPositives += examples[end].weight
+			} else {
+				tiedNegatives += examples[end].weight
+			}
+			end++
+		}
+		result += tiedPositives * (negatives - higherNegatives - tiedNegatives/2)
+		higherNegatives += tiedNegatives
+		start = end
+	}
+	return result / (positives * negatives), true
+}
+
+// averagePrecision returns the area under the precision-recall curve, computed as the average of the precision
+// at each threshold weighted by the increase in recall. It is not defined unless there are positive examples.
+func averagePrecision(examples []scoredExample) (float64, bool) {
+	positives, _ := sortByDecreasingScore(examples)
+	if positives == 0 {
+		return 0, false
+	}
+	result := 0.0
+	truePos := 0.0
+	predictedPos := 0.0
+	for start := 0; start < len(examples); {
+		end := start
+		newTruePos := 0.0
+		for end < len(examples) && examples[end].score == examples[start].score {
+			if examples[end].positive {
+				newTruePos += examples[end].weight
+			}
+			predictedPos += examples[end].weight
+			end++
+		}
+		if newTruePos > 0 {
+			truePos += newTruePos
+			result += newTruePos / positives * truePos / predictedPos
+		}
+		start = end
+	}
+	return result, true
+}
+
+// zeroIfNaN replaces undefined metrics with zero
+func zeroIfNaN(v float64) float64 {
+	if math.IsNaN(v) {
+		return 0
+	}
+	return v
+}
+
+// average returns the average of the values, or zero if there are none
+func average(values map[string]float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, name := range sortedMetricNames(values) {
+		sum += values[name]
+	}
+	return sum / float64(len(values))
+}
+
+// weightedMedian returns the value splitting the total weight of the values in two halves. When a value ends
+// exactly the lower half, the result is averaged with the next value, which gives the median with equal weights.
+func weightedMedian(values, weights []float64) float64 {
+	order := make([]int, 0, len(values))
+	total := 0.0
+	for i := range values {
+		if weights[i] > 0 {
+			order = append(order, i)
+			total += weights[i]
+		}
+	}
+	if len(order) == 0 {
+		return 0
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return values[order[i]] < values[order[j]]
+	})
+	cumulative := 0.0
+	for k, i := range order {
+		cumulative += weights[i]
+		if cumulative == total/2 && k+1 < len(order) {
+			return (values[i] + values[order[k+1]]) / 2
+		}
+		if cumulative > total/2 {
+			return values[i]
+		}
+	}
+	return values[order[len(order)-1]]
+}
+
+// weightedMoments accumulates the weighted mean of a stream of values and the weighted sum of their squared
+// deviations from it, updated as each value is added
+type weightedMoments struct {
+	weight float64
+	mean   float64
+	// squaredDeviations is the weighted sum of the squared deviations of the values from their mean
+	squaredDeviations float64
+}
+
+// add accumulates the value with the given weight, ignoring values without weight
+func (m *weightedMoments) add(value, weight float64) {
+	if weight <= 0 {
+		return
+	}
+	m.weight += weight
+	delta := value - m.mean
+	m.mean += delta * weight / m.weight
+	m.squaredDeviations += weight * delta * (value - m.mean)
+}
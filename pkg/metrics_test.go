@@ -0,0 +1,271 @@
+package pkg
+
+import (
+	"math"
+	"testing"
+
+	mat "github.com/nlpodyssey/spago/pkg/mat32"
+	"github.com/nlpodyssey/spago/pkg/ml/ag"
+	"github.com/stretchr/testify/require"
+	"gonum.org/v1/gonum/stat"
+
+	"golem/pkg/io"
+	"golem/pkg/model"
+)
+
+func scored(scores []float64, positives []bool) []scoredExample {
+	result := make([]scoredExample, len(scores))
+	for i := range scores {
+		result[i] = scoredExample{score: scores[i], positive: positives[i], weight: 1}
+	}
+	return result
+}
+
+func TestRocAUC(t *testing.T) {
+	auc, ok := rocAUC(scored([]float64{0.9, 0.8, 0.3, 0.1}, []bool{true, true, false, false}))
+	require.True(t, ok)
+	require.InDelta(t, 1.0, auc, 1e-9)
+
+	auc, ok = rocAUC(scored([]float64{0.9, 0.8, 0.3, 0.1}, []bool{false, true, true, false}))
+	require.True(t, ok)
+	require.InDelta(t, 0.5, auc, 1e-9)
+
+	// Ties count as half
+	auc, ok = rocAUC(scored([]float64{0.5, 0.5, 0.5, 0.1}, []bool{true, false, true, false}))
+	require.True(t, ok)
+	require.InDelta(t, 0.75, auc, 1e-9)
+
+	_, ok = rocAUC(scored([]float64{0.9, 0.8}, []bool{true, true}))
+	require.False(t, ok)
+
+	// Weights count as repeated examples
+	examples := scored([]float64{0.9, 0.8, 0.3}, []bool{false, true, false})
+	examples[2].weight = 3
+	auc, ok = rocAUC(examples)
+	require.True(t, ok)
+	require.InDelta(t, 0.75, auc, 1e-9)
+}
+
+func TestAveragePrecision(t *testing.T) {
+	ap, ok := averagePrecision(scored([]float64{0.9, 0.8, 0.3, 0.1}, []bool{true, true, false, false}))
+	require.True(t, ok)
+	require.InDelta(t, 1.0, ap, 1e-9)
+
+	ap, ok = averagePrecision(scored([]float64{0.9, 0.8, 0.3, 0.1}, []bool{false, true, true, false}))
+	require.True(t, ok)
+	require.InDelta(t, (1.0/2+2.0/3)/2, ap, 1e-9)
+
+	_, ok = averagePrecision(scored([]float64{0.9, 0.8}, []bool{false, false}))
+	require.False(t, ok)
+
+	examples := scored([]float64{0.9, 0.8, 0.3, 0.1}, []bool{false, true, true, false})
+	examples[0].weight = 2
+	ap, ok = averagePrecision(examples)
+	require.True(t, ok)
+	require.InDelta(t, (1.0/3+2.0/4)/2, ap, 1e-9)
+}
+
+func TestWeightedMedian(t *testing.T) {
+	require.InDelta(t, 1.5, weightedMedian([]float64{2, 0, 1, 2}, []float64{1, 1, 1, 1}), 1e-9)
+	require.InDelta(t, 1.0, weightedMedian([]float64{2, 0, 1}, []float64{1, 1, 1}), 1e-9)
+	require.InDelta(t, 0.0, weightedMedian([]float64{2, 0, 1}, []float64{1, 3, 1}), 1e-9)
+	// Values without weight are ignored
+	require.InDelta(t, 1.0, weightedMedian([]float64{2, 0, 5}, []float64{1, 1, 0}), 1e-9)
+}
+
+func TestClassificationEvaluator(t *testing.T) {
+	metaData := model.NewMetadata()
+	for _, class := range []string{"a", "b", "c"} {
+		metaData.TargetMap.ValueFor(class)
+	}
+	g := ag.NewGraph()
+	evaluator := newClassificationEvaluator(&model.Model{MetaData: metaData}, 0, crossEntropyLoss, g, false)
+
+	predictions := []struct {
+		logits []mat.Float
+		label  mat.Float
+	}{
+		{logits: []mat.Float{2, 0, 0}, label: 0},
+		{logits: []mat.Float{0, 2, 0}, label: 1},
+		{logits: []mat.Float{0, 2, 0}, label: 2},
+		{logits: []mat.Float{0, 0, 2}, label: 2},
+	}
+	for _, p := range predictions {
+		evaluator.EvaluatePrediction(g.NewVariable(mat.NewVecDense(p.logits), false), &io.DataRecord{Target: p.label})
+	}
+
+	require.Equal(t, [][]float64{{1, 0, 0}, {0, 1, 0}, {0, 1, 1}}, evaluator.confusionMatrix)
+	classMetrics := evaluator.classMetrics()
+	require.Equal(t, classCounts{TruePos: 1, TrueNeg: 3}, *classMetrics["a"])
+	require.Equal(t, classCounts{TruePos: 1, FalsePos: 1, TrueNeg: 2}, *classMetrics["b"])
+	require.Equal(t, classCounts{TruePos: 1, FalseNeg: 1, TrueNeg: 2}, *classMetrics["c"])
+
+	metrics := evaluator.Metrics()
+	require.InDelta(t, 0.75, metrics["Accuracy"], 1e-9)
+	require.InDelta(t, (1+1+0.5)/3.0, metrics["BalancedAccuracy"], 1e-9)
+	require.InDelta(t, 0.75, metrics["MicroF1"], 1e-9)
+	require.InDelta(t, (1+2.0/3+2.0/3)/3, metrics["MacroF1"], 1e-6)
+	// the AUCs need the scores of every prediction, only kept by exact evaluators
+	require.NotContains(t, metrics, "RocAuc")
+	require.NotContains(t, metrics, "PrAuc")
+}
+
+func TestClassificationEvaluator_Weighted(t *testing.T) {
+	metaData := model.NewMetadata()
+	metaData.Weighted = true
+	for _, class := range []string{"a", "b"} {
+		metaData.TargetMap.ValueFor(class)
+	}
+	g := ag.NewGraph()
+	evaluator := newClassificationEvaluator(&model.Model{MetaData: metaData}, 0, crossEntropyLoss, g, false)
+
+	records := []*io.DataRecord{{Target: 0, Weight: 3}, {Target: 1, Weight: 1}, {Target: 1, Weight: 0}}
+	logits := [][]mat.Float{{2, 0}, {2, 0}, {0, 2}}
+	losses := 0.0
+	for i, record := range records {
+		evaluator.EvaluatePrediction(g.NewVariable(mat.NewVecDense(logits[i]), false), record)
+		losses += float64(record.Weight) * float64(crossEntropyLoss(g, g.NewVariable(mat.NewVecDense(logits[i]), false), record.Target).ScalarValue())
+	}
+
+	require.Equal(t, [][]float64{{3, 0}, {1, 0}}, evaluator.confusionMatrix)
+	metrics := evaluator.Metrics()
+	require.InDelta(t, 0.75, metrics["Accuracy"], 1e-9)
+	require.InDelta(t, 0.5, metrics["BalancedAccuracy"], 1e-9)
+	require.InDelta(t, losses/4, metrics["Loss"], 1e-6)
+}
+
+func TestMultiLabelEvaluator(t *testing.T) {
+	metaData := model.NewMetadata()
+	metaData.Columns = []*model.Column{{Name: "tags", Type: model.MultiLabel}}
+	metaData.LabelSeparator = "|"
+	for _, label := range []string{"a", "b", "c"} {
+		metaData.TargetMap.ValueFor(label)
+	}
+	g := ag.NewGraph()
+	evaluator := newMultiLabelEvaluator(&model.Model{MetaData: metaData}, 0, g)
+	require.Equal(t, []string{"label", "predicted", "probability_a", "probability_b", "probability_c"}, evaluator.Columns())
+
+	predictions := []struct {
+		logits []mat.Float
+		labels []mat.Float
+	}{
+		{[]mat.Float{2, -2, -2}, []mat.Float{1, 0, 0}},
+		{[]mat.Float{2, -2, -2}, []mat.Float{1, 1, 0}},
+		{[]mat.Float{-2, -2, 2}, []mat.Float{0, 0, 0}},
+		{[]mat.Float{-2, -2, -2}, []mat.Float{0, 0, 0}},
+	}
+	var outputs [][]string
+	for _, p := range predictions {
+		record := &io.DataRecord{MultiHotTargets: []mat.Matrix{mat.NewVecDense(p.labels)}}
+		outputs = append(outputs, evaluator.EvaluatePrediction(g.NewVariable(mat.NewVecDense(p.logits), false), record))
+	}
+	require.Equal(t, []string{"a|b", "a"}, outputs[1][:2])
+	require.Equal(t, []string{"", "c"}, outputs[2][:2])
+
+	classMetrics := evaluator.classMetrics()
+	require.Equal(t, 2.0, classMetrics["a"].TruePos)
+	require.Equal(t, 1.0, classMetrics["b"].FalseNeg)
+	require.Equal(t, 1.0, classMetrics["c"].FalsePos)
+
+	metrics := evaluator.Metrics()
+	require.InDelta(t, 1.0/3, metrics["MacroF1"], 1e-6)
+	require.InDelta(t, 2.0/3, metrics["MicroF1"], 1e-6)
+	require.InDelta(t, (1+2.0/3+0+1)/4, metrics["SampleF1"], 1e-6)
+	require.InDelta(t, 2.0/12, metrics["HammingLoss"], 1e-9)
+	require.InDelta(t, 0.5, metrics["SubsetAccuracy"], 1e-9)
+	// binary cross-entropy of a correct decision with logit 2
+	require.InDelta(t, math.Log(1+math.Exp(-2)), float64(multiLabelLoss(g, g.NewVariable(mat.NewVecDense([]mat.Float{2, -2}), false),
+		mat.NewVecDense([]mat.Float{1, 0})).ScalarValue()), 1e-6)
+}
+
+func TestRegressionEvaluator(t *testing.T) {
+	g := ag.NewGraph()
+	evaluator := &regressionEvaluator{
+		lossFunc:     mseLoss,
+		g:            g,
+		targetColumn: &model.Column{Average: 10, StdDev: 2},
+		exact:        true,
+	}
+	// Standardized values, corresponding to labels 10, 12, 14, 16 and predictions 11, 12, 12, 18
+	labels := []mat.Float{0, 1, 2, 3}
+	predictions := []mat.Float{0.5, 1, 1, 4}
+	for i := range labels {
+		evaluator.EvaluatePrediction(g.NewScalar(predictions[i]), &io.DataRecord{Target: labels[i]})
+	}
+
+	metrics := evaluator.Metrics()
+	require.InDelta(t, (1+0+2+2)/4.0, metrics["MAE"], 1e-6)
+	require.InDelta(t, math.Sqrt((1+0+4+4)/4.0), metrics["RMSE"], 1e-6)
+	require.InDelta(t, 100*(1.0/10+0+2.0/14+2.0/16)/4, metrics["MAPE"], 1e-4)
+	require.InDelta(t, 1.5, metrics["MedianAE"], 1e-6)
+	// Residuals are -1, 0, 2, -2
+	require.InDelta(t, 1-stat.Variance([]float64{-1, 0, 2, -2}, nil)/stat.Variance([]float64{10, 12, 14, 16}, nil),
+		metrics["ExplainedVariance"], 1e-6)
+	require.InDelta(t, stat.RSquaredFrom([]float64{11, 12, 12, 18}, []float64{10, 12, 14, 16}, nil), metrics["R-squared"], 1e-6)
+
+	// Weights count as repeated predictions
+	weighted := &regressionEvaluator{
+		lossFunc:     mseLoss,
+		g:            g,
+		weighted:     true,
+		targetColumn: &model.Column{Average: 10, StdDev: 2},
+		exact:        true,
+	}
+	for i, weight := range []mat.Float{1, 2, 0, 1} {
+		weighted.EvaluatePrediction(g.NewScalar(predictions[i]), &io.DataRecord{Target: labels[i], Weight: weight})
+	}
+	weightedMetrics := weighted.Metrics()
+	require.InDelta(t, (1+0+0+2)/4.0, weightedMetrics["MAE"], 1e-6)
+	require.InDelta(t, math.Sqrt((1+0+0+4)/4.0), weightedMetrics["RMSE"], 1e-6)
+	require.InDelta(t, 0.5, weightedMetrics["MedianAE"], 1e-6)
+	// mseLoss is half the squared error of the standardized values
+	require.InDelta(t, 0.5*(0.25+0+0+1)/4, weightedMetrics["Loss"], 1e-6)
+
+	deciles := evaluator.residualsByDecile()
+	require.Equal(t, 4, len(deciles))
+	require.Equal(t, residualDecile{Decile: 3, Count: 1, MeanPrediction: 11, MeanLabel: 10, MeanResidual: -1, MAE: 1}, deciles[0])
+
+	// Without keeping the predictions, the metrics are the same except for those needing all of them
+	streaming := &regressionEvaluator{
+		lossFunc:     mseLoss,
+		g:            g,
+		targetColumn: &model.Column{Average: 10, StdDev: 2},
+	}
+	for i := range labels {
+		streaming.EvaluatePrediction(g.NewScalar(predictions[i]), &io.DataRecord{Target: labels[i]})
+	}
+	require.Empty(t, streaming.values)
+	streamingMetrics := streaming.Metrics()
+	require.NotContains(t, streamingMetrics, "MedianAE")
+	delete(metrics, "MedianAE")
+	require.Equal(t, metrics, streamingMetrics)
+	require.NotContains(t, streaming.Report(), "ResidualsByDecile")
+}
+
+func TestQuantileEvaluator(t *testing.T) {
+	g := ag.NewGraph()
+	evaluator := newQuantileEvaluator(&regressionEvaluator{
+		lossFunc:       multiQuantileLoss([]float64{0.1, 0.5, 0.9}),
+		regressionLoss: model.RegressionLoss{Function: model.QuantileLoss, Quantiles: []float64{0.1, 0.5, 0.9}},
+		g:              g,
+		targetColumn:   &model.Column{Average: 10, StdDev: 2},
+	})
+	require.Equal(t, []string{"label", "lower", "median", "upper"}, evaluator.Columns())
+
+	// Quantiles are -1, 0 and 1 in standardized units, that is 8, 10 and 12
+	gap := mat.Float(math.Log(math.E - 1))
+	outputs := mat.NewVecDense([]mat.Float{-1, gap, gap})
+	var results [][]string
+	for _, label := range []mat.Float{0.5, -2, -0.5, 1.5} {
+		results = append(results, evaluator.EvaluatePrediction(g.NewVariable(outputs, false), &io.DataRecord{Target: label}))
+	}
+	require.Equal(t, []string{"11.000000", "8.000000", "10.000000", "12.000000"}, results[0])
+
+	metrics := evaluator.Metrics()
+	require.InDelta(t, 0.5, metrics["Coverage"], 1e-6)
+	require.InDelta(t, 0.8, metrics["ExpectedCoverage"], 1e-6)
+	require.InDelta(t, 4, metrics["MeanIntervalWidth"], 1e-5)
+	// The median is the prediction of the regression metrics
+	require.InDelta(t, (1+4+1+3)/4.0, metrics["MAE"], 1e-5)
+	require.Equal(t, []quantileCalibration{{0.1, 0.25}, {0.5, 0.5}, {0.9, 0.75}}, evaluator.calibration())
+}
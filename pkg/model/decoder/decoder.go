@@ -28,9 +28,9 @@ func (d *Model) Init(generator *rand.LockedRand) {
 	d.FeatureTransformer.Init(generator)
 }
 
-func NewDecoder(inputDimension, featureDimension, outputDimension int, batchMomentum float64) *Model {
+func NewDecoder(inputDimension, featureDimension, outputDimension int, batchMomentum float64, virtualBatchSize int) *Model {
 	return &Model{
-		FeatureTransformer: featuretransformer.New(inputDimension, featureDimension, 1, batchMomentum),
+		FeatureTransformer: featuretransformer.New(inputDimension, featureDimension, 1, batchMomentum, virtualBatchSize),
 		DenseLayer:         linear.New(featureDimension, outputDimension, linear.BiasGrad(false)),
 	}
 }
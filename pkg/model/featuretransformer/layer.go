@@ -7,6 +7,8 @@ import (
 	"github.com/nlpodyssey/spago/pkg/ml/nn"
 	"github.com/nlpodyssey/spago/pkg/ml/nn/linear"
 	"github.com/nlpodyssey/spago/pkg/ml/nn/normalization/batchnorm"
+
+	"golem/pkg/model/ghostbatchnorm"
 )
 
 var (
@@ -18,8 +20,11 @@ type Layer struct {
 	InputDimension               int
 	IntermediateFeatureDimension int
 	NumSteps                     int
-	DenseLayer                   *linear.Model
-	BatchNormLayer               []*batchnorm.Model
+	// VirtualBatchSize is the size of the virtual batches used by ghost batch normalization during training
+	// (0 normalizes the whole batch)
+	VirtualBatchSize int
+	DenseLayer       *linear.Model
+	BatchNormLayer   []*batchnorm.Model
 }
 
 func (m *Layer) Init(generator *rand.LockedRand) {
@@ -28,7 +33,7 @@ func (m *Layer) Init(generator *rand.LockedRand) {
 
 func (m *Layer) Forward(step int, xs []ag.Node) []ag.Node {
 	transformedInput := m.DenseLayer.Forward(xs...)
-	transformedInput = m.BatchNormLayer[step].Forward(transformedInput...)
+	transformedInput = ghostbatchnorm.Forward(m.BatchNormLayer[step], m.VirtualBatchSize, transformedInput)
 	out := make([]ag.Node, len(xs))
 	for i := range out {
 		out[i] = glu(m.Graph(), 2*m.IntermediateFeatureDimension, transformedInput[i])
@@ -22,7 +22,7 @@ type Model struct {
 	Layer2 *Layer
 }
 
-func New(numInputFeatures, featureDimension, numSteps int, batchMomentum float64) *Model {
+func New(numInputFeatures, featureDimension, numSteps int, batchMomentum float64, virtualBatchSize int) *Model {
 	return &Model{
 		Layer1: &Layer{
 			InputDimension:               numInputFeatures,
@@ -30,6 +30,7 @@ func New(numInputFeatures, featureDimension, numSteps int, batchMomentum float64
 			DenseLayer:                   linear.New(numInputFeatures, 2*featureDimension, linear.BiasGrad(false)),
 			BatchNormLayer:               createBatchNormModels(numSteps, featureDimension, batchMomentum),
 			NumSteps:                     numSteps,
+			VirtualBatchSize:             virtualBatchSize,
 		},
 		Layer2: &Layer{
 			InputDimension:               featureDimension,
@@ -37,6 +38,7 @@ func New(numInputFeatures, featureDimension, numSteps int, batchMomentum float64
 			DenseLayer:                   linear.New(featureDimension, 2*featureDimension, linear.BiasGrad(false)),
 			BatchNormLayer:               createBatchNormModels(numSteps, featureDimension, batchMomentum),
 			NumSteps:                     numSteps,
+			VirtualBatchSize:             virtualBatchSize,
 		},
 	}
 }
@@ -0,0 +1,30 @@
+// Package ghostbatchnorm implements Ghost Batch Normalization, as used in:
+// "TabNet: Attentive Interpretable Tabular Learning" - https://arxiv.org/abs/1908.07442
+// and first described in "Train longer, generalize better: closing the generalization gap in large batch training
+// of neural networks" - https://arxiv.org/abs/1705.08741
+package ghostbatchnorm
+
+import (
+	"github.com/nlpodyssey/spago/pkg/ml/ag"
+	"github.com/nlpodyssey/spago/pkg/ml/nn"
+	"github.com/nlpodyssey/spago/pkg/ml/nn/normalization/batchnorm"
+)
+
+// Forward normalizes the batch with m in virtual batches of at most virtualBatchSize nodes. In training mode,
+// each virtual batch is normalized with its own statistics and updates the running statistics of m.
+// In inference mode, or when virtualBatchSize is not positive, the whole batch is normalized at once.
+func Forward(m *batchnorm.Model, virtualBatchSize int, xs []ag.Node) []ag.Node {
+	if m.Mode() != nn.Training || virtualBatchSize <= 0 || len(xs) <= virtualBatchSize {
+		return m.Forward(xs...)
+	}
+	// split into virtual batches of nearly the same size, so that no virtual batch is much smaller than the others
+	numChunks := (len(xs) + virtualBatchSize - 1) / virtualBatchSize
+	ys := make([]ag.Node, 0, len(xs))
+	start := 0
+	for i := 0; i < numChunks; i++ {
+		end := start + (len(xs)-start)/(numChunks-i)
+		ys = append(ys, m.Forward(xs[start:end]...)...)
+		start = end
+	}
+	return ys
+}
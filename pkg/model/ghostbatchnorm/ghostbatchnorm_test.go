@@ -0,0 +1,39 @@
+package ghostbatchnorm
+
+import (
+	"testing"
+
+	mat "github.com/nlpodyssey/spago/pkg/mat32"
+	"github.com/nlpodyssey/spago/pkg/ml/ag"
+	"github.com/nlpodyssey/spago/pkg/ml/nn"
+	"github.com/nlpodyssey/spago/pkg/ml/nn/normalization/batchnorm"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForward(t *testing.T) {
+	values := []mat.Float{1, 3, 10, 20, 30}
+	g := ag.NewGraph()
+	xs := make([]ag.Node, len(values))
+	for i, v := range values {
+		xs[i] = g.NewVariable(mat.NewVecDense([]mat.Float{v}), false)
+	}
+
+	m := batchnorm.NewWithMomentum(1, 0.5)
+	proc := nn.Reify(nn.Context{Graph: g, Mode: nn.Training}, m).(*batchnorm.Model)
+	ys := Forward(proc, 3, xs)
+	require.Equal(t, len(xs), len(ys))
+	// virtual batches {1, 3} and {10, 20, 30} are normalized independently
+	expected := []mat.Float{-1, 1, -1.2247449, 0, 1.2247449}
+	for i := range ys {
+		require.InDelta(t, expected[i], ys[i].Value().Scalar(), 1e-4)
+	}
+	// running statistics are updated by each virtual batch
+	require.InDelta(t, 0.5*(0.5*2)+0.5*20, m.Mean.Value().Scalar(), 1e-4)
+
+	inference := nn.Reify(nn.Context{Graph: g, Mode: nn.Inference}, m).(*batchnorm.Model)
+	ys = Forward(inference, 3, xs)
+	for i := range ys {
+		expected := (values[i] - m.Mean.Value().Scalar()) / m.StdDev.Value().Scalar()
+		require.InDelta(t, expected, ys[i].Value().Scalar(), 1e-4)
+	}
+}
@@ -2,6 +2,7 @@ package model
 
 import (
 	"fmt"
+	"math"
 	"sort"
 	"strconv"
 
@@ -107,13 +108,154 @@ func (c *CategoricalValuesMap) Size() int {
 	return len(c.ValueToIndex)
 }
 
+// UnknownValueFor returns the index of the out-of-vocabulary category of a categorical column
+func (c *CategoricalValuesMap) UnknownValueFor(column int) (int, bool) {
+	index, ok := c.ValueToIndex[CategoricalValue{Column: column, Value: UnknownCategory}]
+	return index, ok
+}
+
 type ColumnType int
 
 const (
 	Continuous ColumnType = iota
 	Categorical
+	// MultiLabel targets hold a set of labels, separated by the label separator of the metadata
+	MultiLabel
+)
+
+// ImputationStrategy identifies how missing values in a column are replaced
+type ImputationStrategy int
+
+const (
+	MeanImputation ImputationStrategy = iota
+	MedianImputation
+	ConstantImputation
+	MostFrequentImputation
+)
+
+// LossFunction identifies the loss of the continuous targets of a model
+type LossFunction int
+
+const (
+	MSELoss LossFunction = iota
+	// HuberLoss is quadratic for residuals up to the Huber delta, and linear beyond
+	HuberLoss
+	// QuantileLoss is the pinball loss of the prediction of a quantile
+	QuantileLoss
+	// PoissonLoss is the Poisson deviance of a prediction with a log link
+	PoissonLoss
+	// TweedieLoss is the Tweedie deviance of a prediction with a log link
+	TweedieLoss
 )
 
+func ParseLossFunction(s string) (LossFunction, error) {
+	switch s {
+	case "mse":
+		return MSELoss, nil
+	case "huber":
+		return HuberLoss, nil
+	case "quantile":
+		return QuantileLoss, nil
+	case "poisson":
+		return PoissonLoss, nil
+	case "tweedie":
+		return TweedieLoss, nil
+	default:
+		return 0, fmt.Errorf("unknown loss %s", s)
+	}
+}
+
+// RegressionLoss is the loss of the continuous targets of a model, along with its parameters
+type RegressionLoss struct {
+	Function LossFunction
+	// HuberDelta is the residual, in standardized units of the target, from which the Huber loss is linear
+	HuberDelta float64
+	// Quantile is the quantile of the target predicted with the quantile loss
+	Quantile float64
+	// Quantiles holds the quantiles of the target predicted together with the quantile loss, in increasing
+	// order and including the median. Only Quantile is predicted when it is empty.
+	Quantiles []float64
+	// TweediePower is the power of the variance function of the Tweedie distribution, between 1 and 2
+	TweediePower float64
+}
+
+// LogLink returns whether the model predicts the logarithm of the target. Such targets are not standardized
+// and must not be negative.
+func (l RegressionLoss) LogLink() bool {
+	return l.Function == PoissonLoss || l.Function == TweedieLoss
+}
+
+// InverseLink converts a model output to a prediction of the target, before de-standardization
+func (l RegressionLoss) InverseLink(output float64) float64 {
+	if l.LogLink() {
+		return math.Exp(output)
+	}
+	return output
+}
+
+// Outputs returns the number of model outputs of each continuous target: one per quantile when several
+// quantiles are predicted, and one otherwise
+func (l RegressionLoss) Outputs() int {
+	if len(l.Quantiles) > 0 {
+		return len(l.Quantiles)
+	}
+	return 1
+}
+
+// QuantileValues converts the outputs of a continuous target to the predicted quantiles, before de-standardization.
+// The first output is the lowest quantile, and each other output the softplus of the difference between
+// its quantile and the previous one, so that quantiles never cross.
+func (l RegressionLoss) QuantileValues(outputs []mat.Float) []float64 {
+	result := make([]float64, len(outputs))
+	for i, output := range outputs {
+		if i == 0 {
+			result[i] = float64(output)
+			continue
+		}
+		result[i] = result[i-1] + Softplus(float64(output))
+	}
+	return result
+}
+
+// MedianIndex returns the index of the median in Quantiles
+func (l RegressionLoss) MedianIndex() int {
+	return sort.SearchFloat64s(l.Quantiles, 0.5)
+}
+
+// SoftplusThreshold is the input above which the softplus function is computed as the identity
+const SoftplusThreshold = 20
+
+// Softplus returns log(1 + exp(x)), a smooth approximation of max(x, 0) that is always positive
+func Softplus(x float64) float64 {
+	if x > SoftplusThreshold {
+		return x
+	}
+	return math.Log1p(math.Exp(x))
+}
+
+// MissingCategory is the category value used for missing categorical values when
+// the constant imputation strategy is selected
+const MissingCategory = "<missing>"
+
+// UnknownCategory is the category value of the out-of-vocabulary bucket of each categorical column.
+// It holds values not seen (or seen too rarely) during training.
+const UnknownCategory = "<unknown>"
+
+func ParseImputationStrategy(s string) (ImputationStrategy, error) {
+	switch s {
+	case "mean":
+		return MeanImputation, nil
+	case "median":
+		return MedianImputation, nil
+	case "constant":
+		return ConstantImputation, nil
+	case "most-frequent":
+		return MostFrequentImputation, nil
+	default:
+		return 0, fmt.Errorf("unknown imputation strategy %s", s)
+	}
+}
+
 type Column struct {
 	Name string
 	Type ColumnType
@@ -123,6 +265,26 @@ type Column struct {
 
 	// Standard deviation for this column (for continuous values only)
 	StdDev float64
+
+	// Imputation is the strategy used to replace missing values in this column
+	Imputation ImputationStrategy
+
+	// ImputedValue replaces missing values in this column (for continuous values only)
+	ImputedValue float64
+
+	// ImputedCategory replaces missing values in this column (for categorical values only)
+	ImputedCategory string
+}
+
+// NoTarget is the target column of unlabeled data
+const NoTarget = -1
+
+// Target is a prediction target of the model
+type Target struct {
+	// Column points to the column in the data row that contains the target
+	Column int
+	// Map contains a mapping of target category names to target category indexes
+	Map *NameMap
 }
 
 type Metadata struct {
@@ -137,11 +299,37 @@ type Metadata struct {
 	// CategoricalValuesMap maps a given categorical column to a map from values to indexes
 	CategoricalValuesMap *CategoricalValuesMap
 
-	// TargetColumn points to the column in the data row that contains the prediction target
+	// TargetColumn points to the column in the data row that contains the prediction target,
+	// or is NoTarget for unlabeled data
 	TargetColumn int
 
 	// TargetMap contains a mapping of target category names to target category indexes
 	TargetMap *NameMap
+
+	// ExtraTargets holds the targets of multi-target models after the one given by TargetColumn and TargetMap
+	ExtraTargets []*Target
+
+	// LabelSeparator separates the labels of multi-label targets
+	LabelSeparator string
+
+	// Weighted is set when each row is weighted by the value of WeightColumn in the loss and metrics
+	Weighted bool
+	// WeightColumn points to the column in the data row that contains the sample weight, when Weighted is set
+	WeightColumn int
+
+	// RegressionLoss is the loss of the continuous targets
+	RegressionLoss RegressionLoss
+
+	// ClassWeights holds the weight of each class of the categorical target given by TargetMap in the loss,
+	// by class index. Classes are not weighted when it is empty.
+	ClassWeights []float64
+
+	// MissingValues contains the tokens that represent a missing value in the data
+	MissingValues []string
+
+	// MissingIndicatorsMap maps a data row column index to the index of its "is-missing" indicator
+	// in the continuous features. Indicators are placed after the continuous features.
+	MissingIndicatorsMap *ColumnMap
 }
 
 func NewMetadata() *Metadata {
@@ -151,6 +339,7 @@ func NewMetadata() *Metadata {
 		CategoricalFeaturesMap: NewColumnMap(),
 		CategoricalValuesMap:   NewCategoricalValuesMap(),
 		TargetMap:              NewNameMap(),
+		MissingIndicatorsMap:   NewColumnMap(),
 	}
 }
 
@@ -162,7 +351,20 @@ func NewCategoricalValuesMap() *CategoricalValuesMap {
 }
 
 func (d *Metadata) FeatureCount() int {
-	return d.CategoricalFeaturesMap.Size() + d.ContinuousFeaturesMap.Size()
+	return d.CategoricalFeaturesMap.Size() + d.ContinuousFeatureCount()
+}
+
+// ContinuousFeatureCount returns the size of the continuous features vector, including
+// the missing value indicators
+func (d *Metadata) ContinuousFeatureCount() int {
+	return d.ContinuousFeaturesMap.Size() + d.MissingIndicatorCount()
+}
+
+func (d *Metadata) MissingIndicatorCount() int {
+	if d.MissingIndicatorsMap == nil {
+		return 0
+	}
+	return d.MissingIndicatorsMap.Size()
 }
 
 func (d *Metadata) ParseCategoricalTarget(value string) (mat.Float, error) {
@@ -189,6 +391,104 @@ func (d *Metadata) ParseContinuousTarget(s string) (mat.Float, error) {
 	return mat.Float(v), nil
 }
 
+// HasTarget returns whether the data has a target column
+func (d *Metadata) HasTarget() bool {
+	return d.TargetColumn != NoTarget
+}
+
 func (d *Metadata) TargetType() ColumnType {
 	return d.Columns[d.TargetColumn].Type
 }
+
+// Targets returns the prediction targets of the model, starting with the one given by TargetColumn and TargetMap.
+// Unlabeled data has no targets.
+func (d *Metadata) Targets() []*Target {
+	if !d.HasTarget() {
+		return nil
+	}
+	return append([]*Target{{Column: d.TargetColumn, Map: d.TargetMap}}, d.ExtraTargets...)
+}
+
+// IsMultiTarget returns whether the model predicts more than one target
+func (d *Metadata) IsMultiTarget() bool {
+	return d.HasTarget() && len(d.ExtraTargets) > 0
+}
+
+// IsTargetColumn returns whether the column holds one of the targets
+func (d *Metadata) IsTargetColumn(column int) bool {
+	for _, target := range d.Targets() {
+		if target.Column == column {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFeatureColumn returns whether the column is used as a feature: it holds neither a target nor
+// the sample weight
+func (d *Metadata) IsFeatureColumn(column int) bool {
+	return !d.IsTargetColumn(column) && !(d.Weighted && d.WeightColumn == column)
+}
+
+// TargetDimension returns the number of model outputs of the target: one per class for categorical
+// targets, one per label for multi-label targets, and one per predicted quantile for continuous targets
+func (d *Metadata) TargetDimension(target *Target) int {
+	switch d.Columns[target.Column].Type {
+	case Categorical, MultiLabel:
+		return target.Map.Size()
+	default:
+		return d.RegressionLoss.Outputs()
+	}
+}
+
+// OutputDimension returns the number of model outputs, which are the outputs of each target in order
+func (d *Metadata) OutputDimension() int {
+	dimension := 0
+	for _, target := range d.Targets() {
+		dimension += d.TargetDimension(target)
+	}
+	return dimension
+}
+
+// InputColumns returns, for each element of the model input vector, the index of the data row column
+// it was derived from. Missing value indicators map to the column they refer to, and the embedding of
+// a categorical feature spans embeddingDimension elements.
+func (d *Metadata) InputColumns(embeddingDimension int) []int {
+	columns := make([]int, d.ContinuousFeatureCount(), d.ContinuousFeatureCount()+d.CategoricalFeaturesMap.Size()*embeddingDimension)
+	for index, column := range d.ContinuousFeaturesMap.IndexToColumn {
+		columns[index] = column
+	}
+	if d.MissingIndicatorsMap != nil {
+		for index, column := range d.MissingIndicatorsMap.IndexToColumn {
+			columns[index] = column
+		}
+	}
+	for index := 0; index < d.CategoricalFeaturesMap.Size(); index++ {
+		column := d.CategoricalFeaturesMap.IndexToColumn[index]
+		for i := 0; i < embeddingDimension; i++ {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// FeatureColumns returns the indexes of the data columns used as features, in data order
+func (d *Metadata) FeatureColumns() []int {
+	columns := make([]int, 0, len(d.Columns))
+	for column := range d.Columns {
+		if d.IsFeatureColumn(column) {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// columnIndex returns the index of the column with the given name
+func (d *Metadata) columnIndex(name string) (int, bool) {
+	for i, column := range d.Columns {
+		if column.Name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
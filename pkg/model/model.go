@@ -1,10 +1,80 @@
 package model
 
-import "github.com/nlpodyssey/spago/pkg/ml/nn"
+import (
+	"fmt"
+
+	"github.com/nlpodyssey/spago/pkg/ml/nn"
+)
 
 type CategoricalFeatureEmbedding map[string]*nn.Param
 
 type Model struct {
 	MetaData *Metadata
 	TabNet   *TabNet
+
+	// Temperature scales the logits of a classification model before computing class probabilities.
+	// It is fitted on held-out data when calibrating the model. Zero means no scaling.
+	Temperature float64
+
+	// OODThreshold is the reconstruction loss above which an example is considered out of distribution.
+	// It is calibrated on the training data. Zero means no threshold has been calibrated.
+	OODThreshold float64
+
+	// Optimizer is the optimizer the model was trained with. It is recorded to reproduce the training.
+	Optimizer Optimizer
+}
+
+// OptimizerMethod identifies the gradient descent method of an optimizer
+type OptimizerMethod int
+
+const (
+	AdamOptimizer OptimizerMethod = iota
+	RAdamOptimizer
+	SGDOptimizer
+	RMSPropOptimizer
+	AdaGradOptimizer
+)
+
+func ParseOptimizerMethod(s string) (OptimizerMethod, error) {
+	switch s {
+	case "adam":
+		return AdamOptimizer, nil
+	case "radam":
+		return RAdamOptimizer, nil
+	case "sgd":
+		return SGDOptimizer, nil
+	case "rmsprop":
+		return RMSPropOptimizer, nil
+	case "adagrad":
+		return AdaGradOptimizer, nil
+	default:
+		return 0, fmt.Errorf("unknown optimizer %s", s)
+	}
+}
+
+// Optimizer is a gradient descent method along with its hyperparameters, the regularization of the parameters
+// and the clipping of the gradients. Hyperparameters not used by the method are zero.
+type Optimizer struct {
+	Method       OptimizerMethod
+	LearningRate float64
+	// Beta1 and Beta2 are the decay rates of the moment estimates of adam and radam
+	Beta1 float64
+	Beta2 float64
+	// Epsilon is added to the denominator of the updates of adam, radam, rmsprop and adagrad for numerical stability
+	Epsilon float64
+	// Momentum is the momentum of sgd, which is Nesterov momentum when Nesterov is set
+	Momentum float64
+	Nesterov bool
+	// Decay is the decay rate of the average of the squared gradients of rmsprop
+	Decay float64
+	// WeightDecay shrinks the parameters after each update by their product with the weight decay and
+	// the learning rate, decoupled from the gradients
+	WeightDecay float64
+	// L2 is the weight of the L2 regularization of the parameters, whose gradient is added to the gradients
+	L2 float64
+	// ClipValue is the maximum absolute value of the gradients, or zero for no clipping by value
+	ClipValue float64
+	// ClipNorm is the maximum L2 norm of all the gradients together, or zero for no clipping by norm.
+	// It replaces the clipping by value when set.
+	ClipNorm float64
 }
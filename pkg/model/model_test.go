@@ -66,3 +66,52 @@ func createInput(g *ag.Graph, config TabNetConfig) []ag.Node {
 	return input
 
 }
+
+func newPretrainingTestModel(columns []string, config TabNetConfig, generator *rand.LockedRand) *Model {
+	metaData := NewMetadata()
+	for _, name := range columns {
+		metaData.Columns = append(metaData.Columns, &Column{Name: name, Type: Categorical})
+	}
+	metaData.TargetColumn = NoTarget
+	for i, name := range columns {
+		if name == "target" {
+			metaData.TargetColumn = i
+			continue
+		}
+		metaData.CategoricalFeaturesMap.Set(i, metaData.CategoricalFeaturesMap.Size())
+		metaData.CategoricalValuesMap.ValueFor(CategoricalValue{Column: i, Value: "x"})
+	}
+	config.NumColumns = metaData.CategoricalFeaturesMap.Size() * config.CategoricalEmbeddingDimension
+	config.NumCategoricalEmbeddings = metaData.CategoricalValuesMap.Size()
+	tabNet := NewTabNet(config)
+	tabNet.Init(generator)
+	return &Model{MetaData: metaData, TabNet: tabNet}
+}
+
+func TestModel_InitFromPretrained(t *testing.T) {
+	config := TabNetConfig{
+		NumDecisionSteps:              3,
+		IntermediateFeatureDimension:  4,
+		OutputDimension:               2,
+		CategoricalEmbeddingDimension: 2,
+		RelaxationFactor:              1.5,
+		BatchMomentum:                 0.9,
+	}
+	generator := rand.NewLockedRand(42)
+	pretrained := newPretrainingTestModel([]string{"a", "b"}, config, generator)
+	m := newPretrainingTestModel([]string{"target", "a", "b"}, config, generator)
+	require.NotEqual(t, pretrained.TabNet.AttentionTransformer[0].W.Value().Data(), m.TabNet.AttentionTransformer[0].W.Value().Data())
+
+	require.NoError(t, m.InitFromPretrained(pretrained))
+	require.Equal(t, pretrained.TabNet.AttentionTransformer[1].W.Value().Data(), m.TabNet.AttentionTransformer[1].W.Value().Data())
+	require.Equal(t, pretrained.TabNet.SharedFeatureTransformer.Layer1.DenseLayer.W.Value().Data(),
+		m.TabNet.SharedFeatureTransformer.Layer1.DenseLayer.W.Value().Data())
+	require.Equal(t, pretrained.TabNet.StepFeatureTransformers[2].Layer2.DenseLayer.W.Value().Data(),
+		m.TabNet.StepFeatureTransformers[2].Layer2.DenseLayer.W.Value().Data())
+	// embeddings are matched by column name and value
+	require.Equal(t, pretrained.TabNet.CategoricalFeatureEmbeddings[1].Value().Data(), m.TabNet.CategoricalFeatureEmbeddings[1].Value().Data())
+	require.NotEqual(t, pretrained.TabNet.OutputLayer.W.Value().Data(), m.TabNet.OutputLayer.W.Value().Data())
+
+	other := newPretrainingTestModel([]string{"b", "a"}, config, generator)
+	require.Error(t, m.InitFromPretrained(other))
+}
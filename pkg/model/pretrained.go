@@ -0,0 +1,89 @@
+package model
+
+import (
+	"fmt"
+
+	"github.com/nlpodyssey/spago/pkg/ml/nn"
+)
+
+// InitFromPretrained initializes the model with the encoder of a pretrained model: the categorical embeddings of
+// the values seen by both models, the shared and step feature transformers and the attentive transformers.
+// Both models must use the same features and architecture.
+func (m *Model) InitFromPretrained(pretrained *Model) error {
+	if err := checkSameFeatures(m, pretrained); err != nil {
+		return err
+	}
+	if err := m.TabNet.InitFromPretrained(pretrained.TabNet); err != nil {
+		return err
+	}
+	for index, value := range pretrained.MetaData.CategoricalValuesMap.IndexToValue {
+		name := pretrained.MetaData.Columns[value.Column].Name
+		column, ok := m.MetaData.columnIndex(name)
+		if !ok {
+			continue
+		}
+		if target, ok := m.MetaData.CategoricalValuesMap.ValueToIndex[CategoricalValue{Column: column, Value: value.Value}]; ok {
+			m.TabNet.CategoricalFeatureEmbeddings[target].ReplaceValue(
+				pretrained.TabNet.CategoricalFeatureEmbeddings[index].Value().Clone())
+		}
+	}
+	return nil
+}
+
+// checkSameFeatures checks that each element of the input of both models comes from a column with the same name
+func checkSameFeatures(m *Model, pretrained *Model) error {
+	if m.TabNet.CategoricalEmbeddingDimension != pretrained.TabNet.CategoricalEmbeddingDimension {
+		return fmt.Errorf("the categorical embedding size of the pretrained model is %d, expected %d",
+			pretrained.TabNet.CategoricalEmbeddingDimension, m.TabNet.CategoricalEmbeddingDimension)
+	}
+	columns := m.MetaData.InputColumns(m.TabNet.CategoricalEmbeddingDimension)
+	pretrainedColumns := pretrained.MetaData.InputColumns(pretrained.TabNet.CategoricalEmbeddingDimension)
+	if len(columns) != len(pretrainedColumns) {
+		return fmt.Errorf("the pretrained model has %d input features, expected %d", len(pretrainedColumns), len(columns))
+	}
+	for i := range columns {
+		name := m.MetaData.Columns[columns[i]].Name
+		pretrainedName := pretrained.MetaData.Columns[pretrainedColumns[i]].Name
+		if name != pretrainedName {
+			return fmt.Errorf("input feature %d of the pretrained model is %s, expected %s", i, pretrainedName, name)
+		}
+	}
+	return nil
+}
+
+// InitFromPretrained copies the weights of the shared and step feature transformers and of the attentive transformers
+// of a pretrained model with the same architecture. The batch normalization momentum is a training option and is
+// not copied.
+func (m *TabNet) InitFromPretrained(pretrained *TabNet) error {
+	if m.NumColumns != pretrained.NumColumns ||
+		m.NumDecisionSteps != pretrained.NumDecisionSteps ||
+		m.IntermediateFeatureDimension != pretrained.IntermediateFeatureDimension {
+		return fmt.Errorf("the pretrained model has %d columns, %d decision steps and feature dimension %d, "+
+			"expected %d, %d and %d", pretrained.NumColumns, pretrained.NumDecisionSteps, pretrained.IntermediateFeatureDimension,
+			m.NumColumns, m.NumDecisionSteps, m.IntermediateFeatureDimension)
+	}
+	copyParams(m.SharedFeatureTransformer, pretrained.SharedFeatureTransformer)
+	for i := range m.StepFeatureTransformers {
+		copyParams(m.StepFeatureTransformers[i], pretrained.StepFeatureTransformers[i])
+	}
+	for i := range m.AttentionTransformer {
+		copyParams(m.AttentionTransformer[i], pretrained.AttentionTransformer[i])
+		copyParams(m.AttentionBatchNorm[i], pretrained.AttentionBatchNorm[i])
+	}
+	return nil
+}
+
+// copyParams copies the parameter values of src into dst, which must have the same structure
+func copyParams(dst, src nn.Model) {
+	var srcParams []nn.Param
+	nn.ForEachParam(src, func(param nn.Param) {
+		srcParams = append(srcParams, param)
+	})
+	i := 0
+	nn.ForEachParam(dst, func(param nn.Param) {
+		if param.Name() != "momentum" {
+			param.ReplaceValue(srcParams[i].Value().Clone())
+		}
+		i++
+	})
+}
@@ -3,6 +3,7 @@ package model
 import (
 	"golem/pkg/model/decoder"
 	"golem/pkg/model/featuretransformer"
+	"golem/pkg/model/ghostbatchnorm"
 
 	mat "github.com/nlpodyssey/spago/pkg/mat32"
 	"github.com/nlpodyssey/spago/pkg/mat32/rand"
@@ -47,12 +48,28 @@ type TabNetConfig struct {
 	SparsityLossWeight            float64
 	ReconstructionLossWeight      float64
 	TargetLossWeight              float64
+
+	// NumUnknownCategoryEmbeddings is the number of out-of-vocabulary embeddings,
+	// placed at the end of the categorical embeddings
+	NumUnknownCategoryEmbeddings int
+
+	// TargetWeights holds the weight of the loss of each target of multi-target models.
+	// All targets have the same weight when empty.
+	TargetWeights []float64
+}
+
+// TargetWeight returns the weight of the loss of the target with the given index
+func (c TabNetConfig) TargetWeight(target int) float64 {
+	if len(c.TargetWeights) == 0 {
+		return 1
+	}
+	return c.TargetWeights[target]
 }
 
 func NewTabNet(config TabNetConfig) *TabNet {
 	return &TabNet{
 		TabNetConfig:                 config,
-		SharedFeatureTransformer:     featuretransformer.New(config.NumColumns, config.IntermediateFeatureDimension, config.NumDecisionSteps, config.BatchMomentum),
+		SharedFeatureTransformer:     featuretransformer.New(config.NumColumns, config.IntermediateFeatureDimension, config.NumDecisionSteps, config.BatchMomentum, config.VirtualBatchSize),
 		StepFeatureTransformers:      newStepFeatureTransformers(config),
 		AttentionTransformer:         createLinearTransformers(config),
 		AttentionBatchNorm:           createBatchNormModels(config),
@@ -65,7 +82,7 @@ func NewTabNet(config TabNetConfig) *TabNet {
 func createDecoders(config TabNetConfig) []*decoder.Model {
 	decoders := make([]*decoder.Model, config.NumDecisionSteps)
 	for i := range decoders {
-		decoders[i] = decoder.NewDecoder(config.IntermediateFeatureDimension, config.IntermediateFeatureDimension, config.NumColumns, config.BatchMomentum)
+		decoders[i] = decoder.NewDecoder(config.IntermediateFeatureDimension, config.IntermediateFeatureDimension, config.NumColumns, config.BatchMomentum, config.VirtualBatchSize)
 	}
 	return decoders
 
@@ -103,7 +120,7 @@ func newCategoricalFeatureEmbeddings(config TabNetConfig) []nn.Param {
 func newStepFeatureTransformers(config TabNetConfig) []*featuretransformer.Model {
 	stepFeatureTransformers := make([]*featuretransformer.Model, config.NumDecisionSteps)
 	for i := range stepFeatureTransformers {
-		stepFeatureTransformers[i] = featuretransformer.New(config.IntermediateFeatureDimension, config.IntermediateFeatureDimension, 1, config.BatchMomentum)
+		stepFeatureTransformers[i] = featuretransformer.New(config.IntermediateFeatureDimension, config.IntermediateFeatureDimension, 1, config.BatchMomentum, config.VirtualBatchSize)
 	}
 	return stepFeatureTransformers
 }
@@ -120,7 +137,8 @@ func (m *TabNet) Init(generator *rand.LockedRand) {
 
 	initializers.XavierUniform(m.OutputLayer.W.Value(), gain, generator)
 
-	for _, p := range m.CategoricalFeatureEmbeddings {
+	numKnownEmbeddings := len(m.CategoricalFeatureEmbeddings) - m.NumUnknownCategoryEmbeddings
+	for _, p := range m.CategoricalFeatureEmbeddings[:numKnownEmbeddings] {
 		initializers.Uniform(p.Value(), -0.1, 0.1, generator)
 	}
 
@@ -128,6 +146,12 @@ func (m *TabNet) Init(generator *rand.LockedRand) {
 		decoder.Init(generator)
 	}
 
+	// Unknown category embeddings are initialized last, so the initialization
+	// of the rest of the model does not depend on them
+	for _, p := range m.CategoricalFeatureEmbeddings[numKnownEmbeddings:] {
+		initializers.Uniform(p.Value(), -0.1, 0.1, generator)
+	}
+
 }
 
 type StepAttentionMask []mat.Float
@@ -146,21 +170,37 @@ type TabNetOutput struct {
 	DecoderOutput    []ag.Node
 	AttentionMasks   []AttentionMask
 	AttentionEntropy []ag.Node
+	// DecisionContributions holds the contribution to the output of the decision step following each attention mask,
+	// computed as the sum of its ReLU outputs (only in inference mode)
+	DecisionContributions [][]mat.Float
 }
 
 func (m *TabNet) Forward(input []ag.Node) *TabNetOutput {
 	g := m.Graph()
+	prior := make([]ag.Node, len(input))
+	for i := range input {
+		prior[i] = g.NewVariable(mat.NewInitVecDense(m.NumColumns, 1.0), true)
+	}
+	return m.ForwardWithPrior(input, prior)
+}
+
+// ForwardWithPrior runs the model with the given initial prior scale of each input feature,
+// which is the relative amount each feature can be attended by the decision steps
+func (m *TabNet) ForwardWithPrior(input []ag.Node, prior []ag.Node) *TabNetOutput {
+	g := m.Graph()
 
 	output := TabNetOutput{}
 
 	if m.Mode() == nn.Inference {
 		output.AttentionMasks = m.allocateAttentionMasks(len(input))
+		output.DecisionContributions = make([][]mat.Float, len(input))
+		for k := range output.DecisionContributions {
+			output.DecisionContributions[k] = make([]mat.Float, m.NumDecisionSteps-1)
+		}
 	}
 
 	complementaryAggregatedMaskValues := make([]ag.Node, len(input))
-	for i := range input {
-		complementaryAggregatedMaskValues[i] = g.NewVariable(mat.NewInitVecDense(m.NumColumns, 1.0), true)
-	}
+	copy(complementaryAggregatedMaskValues, prior)
 
 	output.AttentionEntropy = make([]ag.Node, len(input))
 	outputAggregated := make([]ag.Node, len(input))
@@ -174,7 +214,11 @@ func (m *TabNet) Forward(input []ag.Node) *TabNetOutput {
 
 		if i > 0 {
 			for k := range input {
-				outputAggregated[k] = g.Add(outputAggregated[k], g.ReLU(transformed[k]))
+				decision := g.ReLU(transformed[k])
+				outputAggregated[k] = g.Add(outputAggregated[k], decision)
+				if m.Mode() == nn.Inference {
+					output.DecisionContributions[k][i-1] = decision.Value().Sum()
+				}
 			}
 
 			decoded := m.Decoders[i].Forward(transformed)
@@ -188,7 +232,7 @@ func (m *TabNet) Forward(input []ag.Node) *TabNetOutput {
 			continue // skip attention entropy calculation
 		}
 
-		mask := m.AttentionBatchNorm[i].Forward(m.AttentionTransformer[i].Forward(transformed...)...)
+		mask := ghostbatchnorm.Forward(m.AttentionBatchNorm[i], m.VirtualBatchSize, m.AttentionTransformer[i].Forward(transformed...))
 		for k := range mask {
 			mask[k] = g.Prod(mask[k], complementaryAggregatedMaskValues[k])
 			mask[k] = g.SparseMax(mask[k])
@@ -0,0 +1,202 @@
+package pkg
+
+import (
+	"encoding/csv"
+	"fmt"
+	gio "io"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/nlpodyssey/spago/pkg/mat32/rand"
+	"github.com/nlpodyssey/spago/pkg/ml/ag"
+	"github.com/nlpodyssey/spago/pkg/ml/nn"
+	"github.com/rs/zerolog/log"
+	"gonum.org/v1/gonum/stat"
+
+	"golem/pkg/io"
+	"golem/pkg/model"
+)
+
+// CalibrateOOD sets the out-of-distribution threshold of the model to the given percentile of the reconstruction
+// loss over the data, which should be drawn from the training distribution. The model is saved to the output file.
+func CalibrateOOD(modelFileName, inputFileName, outputFileName string, percentile float64) error {
+	if percentile <= 0 || percentile >= 100 {
+		return fmt.Errorf("the percentile must be between 0 and 100, got %f", percentile)
+	}
+	m, dataSet, err := loadModelAndFeatures(modelFileName, inputFileName)
+	if err != nil {
+		return err
+	}
+	if len(dataSet.Data) == 0 {
+		return fmt.Errorf("no data to calibrate in %s", inputFileName)
+	}
+	if m.MetaData.HasTarget() && m.TabNet.ReconstructionLossWeight == 0 {
+		log.Warn().Msg("The model was trained without reconstruction loss, its decoder may not reconstruct the input")
+	}
+
+	var losses []float64
+	computeReconstructionErrors(m, dataSet, func(reconstruction featureReconstruction) {
+		losses = append(losses, reconstruction.loss)
+	})
+	sort.Float64s(losses)
+	m.OODThreshold = stat.Quantile(percentile/100, stat.Empirical, losses, nil)
+	log.Info().Float64("percentile", percentile).Float64("oodThreshold", m.OODThreshold).Msg("Calibrated out-of-distribution threshold")
+
+	outputFile, err := os.Create(outputFileName)
+	if err != nil {
+		return fmt.Errorf("error creating output file %s: %w", outputFileName, err)
+	}
+	defer outputFile.Close()
+	if err := io.SaveModel(m, outputFile); err != nil {
+		return fmt.Errorf("error saving model to %s: %w", outputFileName, err)
+	}
+	return nil
+}
+
+// ScoreOOD writes the out-of-distribution score of each row of the data, which is its reconstruction loss,
+// whether it exceeds the calibrated threshold of the model, and the numFeatures columns with the largest
+// reconstruction error
+func ScoreOOD(modelFileName, inputFileName, outputFileName string, numFeatures int) error {
+	m, dataSet, err := loadModelAndFeatures(modelFileName, inputFileName)
+	if err != nil {
+		return err
+	}
+	if m.OODThreshold == 0 {
+		return fmt.Errorf("model %s has no out-of-distribution threshold, it must be calibrated first", modelFileName)
+	}
+
+	outputFile, err := os.Create(outputFileName)
+	if err != nil {
+		return fmt.Errorf("error creating output file %s: %w", outputFileName, err)
+	}
+	defer outputFile.Close()
+	writeOODScores(outputFile, m, dataSet, numFeatures)
+	return nil
+}
+
+// loadModelAndFeatures loads a trained or pretrained model and the data of the input file, whose columns are
+// matched to the feature columns of the model by name, so that the data does not need to hold the target and
+// weight columns. Rows that cannot be parsed are logged and skipped.
+func loadModelAndFeatures(modelFileName, inputFileName string) (*model.Model, *io.DataSet, error) {
+	m, err := loadModel(modelFileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	inputFile, err := os.Open(inputFileName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening data file %s: %w", inputFileName, err)
+	}
+	defer inputFile.Close()
+
+	reader := csv.NewReader(inputFile)
+	// rows with missing fields are reported along with the other parsing errors
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading data header from %s: %w", inputFileName, err)
+	}
+	columnIndex := make(map[string]int, len(header))
+	for i, name := range header {
+		columnIndex[name] = i
+	}
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading data from %s: %w", inputFileName, err)
+	}
+	dataSet, _, dataErrors, err := parseFeatures(m.MetaData, featureMetaData(m.MetaData), namedRecords(columnIndex, rows), 1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading data from %s: %w", inputFileName, err)
+	}
+	printDataErrors(dataErrors)
+	return m, dataSet, nil
+}
+
+// writeOODScores writes the out-of-distribution score of each record of the dataset as a CSV line
+func writeOODScores(output gio.Writer, m *model.Model, dataSet *io.DataSet, numFeatures int) {
+	featureColumns := m.MetaData.FeatureColumns()
+	if numFeatures > len(featureColumns) {
+		numFeatures = len(featureColumns)
+	}
+
+	fmt.Fprintf(output, "row,oodScore,ood")
+	for i := 1; i <= numFeatures; i++ {
+		fmt.Fprintf(output, ",feature%d,error%d", i, i)
+	}
+	fmt.Fprintf(output, "\n")
+
+	row := 0
+	numOOD := 0
+	computeReconstructionErrors(m, dataSet, func(reconstruction featureReconstruction) {
+		ood := reconstruction.loss > m.OODThreshold
+		if ood {
+			numOOD++
+		}
+		fmt.Fprintf(output, "%d,%f,%s", row, reconstruction.loss, strconv.FormatBool(ood))
+		for _, i := range topFeatures(reconstruction.featureErrors, numFeatures) {
+			fmt.Fprintf(output, ",%s,%f", m.MetaData.Columns[featureColumns[i]].Name, reconstruction.featureErrors[i])
+		}
+		fmt.Fprintf(output, "\n")
+		row++
+	})
+	log.Info().Int("rows", row).Int("outOfDistribution", numOOD).Float64("oodThreshold", m.OODThreshold).Msg("")
+}
+
+// featureReconstruction holds the reconstruction loss of an example, along with the part of it
+// due to each feature column
+type featureReconstruction struct {
+	loss          float64
+	featureErrors []float64
+}
+
+// computeReconstructionErrors runs the model on each record of the dataset in order, passing its reconstruction
+// loss to the callback. The error of each feature column is the sum of the errors of its input elements, in the
+// order of the feature columns in the data.
+func computeReconstructionErrors(m *model.Model, dataSet *io.DataSet, callback func(featureReconstruction)) {
+	g := ag.NewGraph(ag.Rand(rand.NewLockedRand(42)),
+		ag.ConcurrentComputations(1))
+
+	dataSet.ResetOrder(io.OriginalOrder)
+	ctx := nn.Context{Graph: g, Mode: nn.Inference}
+	proc := nn.Reify(ctx, m.TabNet).(*model.TabNet)
+
+	inputColumns := m.MetaData.InputColumns(m.TabNet.CategoricalEmbeddingDimension)
+	featureColumns := m.MetaData.FeatureColumns()
+	featureIndex := make(map[int]int, len(featureColumns))
+	for i, column := range featureColumns {
+		featureIndex[column] = i
+	}
+
+	for d := dataSet.Next(); len(d) > 0; d = dataSet.Next() {
+		input, output := predict(g, proc, d)
+		for i := range d {
+			reconstruction := featureReconstruction{
+				loss:          float64(reconstructionLoss(g, input[i], output.DecoderOutput[i]).ScalarValue()),
+				featureErrors: make([]float64, len(featureColumns)),
+			}
+			expected := input[i].Value().Data()
+			for j, value := range output.DecoderOutput[i].Value().Data() {
+				diff := float64(value - expected[j])
+				// consistent with the reconstruction loss, which is half the sum of the squared errors
+				reconstruction.featureErrors[featureIndex[inputColumns[j]]] += 0.5 * diff * diff
+			}
+			callback(reconstruction)
+		}
+		g.Clear()
+	}
+}
+
+// topFeatures returns the indexes of the n largest errors, in decreasing order
+func topFeatures(errors []float64, n int) []int {
+	indexes := make([]int, len(errors))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return errors[indexes[i]] > errors[indexes[j]]
+	})
+	if n < len(indexes) {
+		indexes = indexes[:n]
+	}
+	return indexes
+}
@@ -0,0 +1,226 @@
+package pkg
+
+import (
+	"fmt"
+
+	mat "github.com/nlpodyssey/spago/pkg/mat32"
+	"github.com/nlpodyssey/spago/pkg/ml/nn"
+	"github.com/nlpodyssey/spago/pkg/ml/nn/normalization/batchnorm"
+	"github.com/nlpodyssey/spago/pkg/ml/optimizers/gd"
+	"github.com/nlpodyssey/spago/pkg/ml/optimizers/gd/adagrad"
+	"github.com/nlpodyssey/spago/pkg/ml/optimizers/gd/adam"
+	"github.com/nlpodyssey/spago/pkg/ml/optimizers/gd/radam"
+	"github.com/nlpodyssey/spago/pkg/ml/optimizers/gd/rmsprop"
+	"github.com/nlpodyssey/spago/pkg/ml/optimizers/gd/sgd"
+	"github.com/rs/zerolog/log"
+
+	"golem/pkg/model"
+	"golem/pkg/model/featuretransformer"
+)
+
+// parseOptimizer returns the optimizer selected by the training parameters, with the hyperparameters of its method
+func parseOptimizer(trainingParams TrainingParameters) (model.Optimizer, error) {
+	method := model.AdamOptimizer
+	if trainingParams.Optimizer != "" {
+		var err error
+		if method, err = model.ParseOptimizerMethod(trainingParams.Optimizer); err != nil {
+			return model.Optimizer{}, err
+		}
+	}
+	if trainingParams.LearningRate <= 0 {
+		return model.Optimizer{}, fmt.Errorf("invalid learning rate %f", trainingParams.LearningRate)
+	}
+	for _, p := range []struct {
+		name  string
+		value float64
+	}{
+		{"weight decay", trainingParams.WeightDecay},
+		{"L2 regularization", trainingParams.L2Regularization},
+		{"gradient clip value", trainingParams.ClipValue},
+		{"gradient clip norm", trainingParams.ClipNorm},
+		{"beta1", trainingParams.Beta1},
+		{"beta2", trainingParams.Beta2},
+		{"epsilon", trainingParams.Epsilon},
+		{"momentum", trainingParams.Momentum},
+		{"RMSProp decay rate", trainingParams.RMSPropDecay},
+	} {
+		if p.value < 0 {
+			return model.Optimizer{}, fmt.Errorf("invalid %s %f", p.name, p.value)
+		}
+	}
+	result := model.Optimizer{
+		Method:       method,
+		LearningRate: trainingParams.LearningRate,
+		WeightDecay:  trainingParams.WeightDecay,
+		L2:           trainingParams.L2Regularization,
+		ClipValue:    trainingParams.ClipValue,
+		ClipNorm:     trainingParams.ClipNorm,
+	}
+	switch method {
+	case model.AdamOptimizer, model.RAdamOptimizer:
+		if trainingParams.Beta1 >= 1 || trainingParams.Beta2 >= 1 {
+			return result, fmt.Errorf("invalid betas %f and %f, expected values between 0 and 1", trainingParams.Beta1, trainingParams.Beta2)
+		}
+		result.Beta1 = trainingParams.Beta1
+		result.Beta2 = trainingParams.Beta2
+		result.Epsilon = trainingParams.Epsilon
+	case model.SGDOptimizer:
+		if trainingParams.Momentum >= 1 {
+			return result, fmt.Errorf("invalid momentum %f, expected a value between 0 and 1", trainingParams.Momentum)
+		}
+		result.Momentum = trainingParams.Momentum
+		result.Nesterov = trainingParams.Nesterov
+	case model.RMSPropOptimizer:
+		if trainingParams.RMSPropDecay >= 1 {
+			return result, fmt.Errorf("invalid RMSProp decay rate %f, expected a value between 0 and 1", trainingParams.RMSPropDecay)
+		}
+		result.Epsilon = trainingParams.Epsilon
+		result.Decay = trainingParams.RMSPropDecay
+	case model.AdaGradOptimizer:
+		result.Epsilon = trainingParams.Epsilon
+	}
+	return result, nil
+}
+
+// newMethod returns the gradient descent method of the optimizer, along with a function setting its learning rate
+func newMethod(optimizer model.Optimizer) (gd.Method, func(rate float64)) {
+	rate := mat.Float(optimizer.LearningRate)
+	switch optimizer.Method {
+	case model.RAdamOptimizer:
+		method := radam.New(radam.Config{StepSize: rate, Beta1: mat.Float(optimizer.Beta1),
+			Beta2: mat.Float(optimizer.Beta2), Epsilon: mat.Float(optimizer.Epsilon)})
+		return method, func(rate float64) { method.StepSize = mat.Float(rate) }
+	case model.SGDOptimizer:
+		method := sgd.New(sgd.NewConfig(rate, mat.Float(optimizer.Momentum), optimizer.Nesterov))
+		return method, func(rate float64) {
+			method.LR = mat.Float(rate)
+			method.Alpha = mat.Float(rate)
+		}
+	case model.RMSPropOptimizer:
+		method := rmsprop.New(rmsprop.NewConfig(rate, mat.Float(optimizer.Epsilon), mat.Float(optimizer.Decay)))
+		return method, func(rate float64) { method.LR = mat.Float(rate) }
+	case model.AdaGradOptimizer:
+		method := adagrad.New(adagrad.NewConfig(rate, mat.Float(optimizer.Epsilon)))
+		return method, func(rate float64) { method.LR = mat.Float(rate) }
+	default:
+		method := adam.New(adam.Config{StepSize: rate, Beta1: mat.Float(optimizer.Beta1),
+			Beta2: mat.Float(optimizer.Beta2), Epsilon: mat.Float(optimizer.Epsilon)})
+		// Alpha is the step size scaled by the bias correction of the moment estimates
+		biasCorrection := method.Alpha / method.StepSize
+		return method, func(rate float64) {
+			method.StepSize = mat.Float(rate)
+			method.Alpha = mat.Float(rate) * biasCorrection
+		}
+	}
+}
+
+// newOptimizer returns the optimizer of the model selected by the training parameters, which it records in the model,
+// along with the scheduler of its learning rate over epochs of batchesPerEpoch batches
+func newOptimizer(m *model.Model, trainingParams TrainingParameters, batchesPerEpoch int) (*gd.GradientDescent, *learningRateScheduler) {
+	optimizer, err := parseOptimizer(trainingParams)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	schedule, err := newLearningRateSchedule(trainingParams)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	m.Optimizer = optimizer
+
+	method, setMethodRate := newMethod(optimizer)
+	regularized := &regularizedMethod{Method: method, weightDecay: optimizer.WeightDecay, l2: optimizer.L2,
+		rate: optimizer.LearningRate, unregularized: unregularizedParams(m.TabNet)}
+	setRate := func(rate float64) {
+		setMethodRate(rate)
+		regularized.rate = rate
+	}
+	scheduler := newLearningRateScheduler(regularized, setRate, schedule, trainingParams, batchesPerEpoch)
+
+	// the parameters are updated independently of each other, concurrently with multiple workers
+	options := []gd.Option{gd.ConcurrentComputations(numWorkers(trainingParams))}
+	if optimizer.ClipNorm > 0 {
+		options = append(options, gd.ClipGradByNorm(mat.Float(optimizer.ClipNorm), 2))
+	} else if optimizer.ClipValue > 0 {
+		options = append(options, gd.ClipGradByValue(mat.Float(optimizer.ClipValue)))
+	}
+	return gd.NewOptimizer(scheduler, nn.NewDefaultParamsIterator(m.TabNet), options...), scheduler
+}
+
+// regularizedMethod regularizes the parameters updated by a gradient descent method: the gradient of the L2
+// regularization is added to the gradients before the update, and the weight decay, scaled by the learning rate,
+// shrinks the parameters along with the update, as in AdamW. The gradients are clipped before they reach the
+// method, so the L2 gradient is not bounded by the clipping.
+type regularizedMethod struct {
+	gd.Method
+	weightDecay float64
+	l2          float64
+	// rate is the current learning rate
+	rate float64
+	// unregularized holds the parameters updated without regularization
+	unregularized map[nn.Param]bool
+}
+
+// unregularizedParams returns the parameters of the model excluded from the regularization: the scales and shifts of
+// batch normalization, which would otherwise be pulled towards zero rather than one, and the categorical embeddings,
+// which are only updated in the batches holding their value, so that frequent values would be shrunk the most
+func unregularizedParams(m *model.TabNet) map[nn.Param]bool {
+	result := map[nn.Param]bool{}
+	for _, param := range m.CategoricalFeatureEmbeddings {
+		result[param] = true
+	}
+	batchNorms := append([]*batchnorm.Model{}, m.AttentionBatchNorm...)
+	featureTransformers := append([]*featuretransformer.Model{m.SharedFeatureTransformer}, m.StepFeatureTransformers...)
+	for _, d := range m.Decoders {
+		featureTransformers = append(featureTransformers, d.FeatureTransformer)
+	}
+	for _, f := range featureTransformers {
+		batchNorms = append(batchNorms, f.Layer1.BatchNormLayer...)
+		batchNorms = append(batchNorms, f.Layer2.BatchNormLayer...)
+	}
+	for _, b := range batchNorms {
+		nn.ForEachParam(b, func(param nn.Param) {
+			result[param] = true
+		})
+	}
+	return result
+}
+
+func (r *regularizedMethod) Delta(param nn.Param) mat.Matrix {
+	if r.unregularized[param] {
+		return r.Method.Delta(param)
+	}
+	if r.l2 > 0 {
+		l2Grad := param.Value().ProdScalar(mat.Float(r.l2))
+		param.Grad().AddInPlace(l2Grad)
+		mat.ReleaseDense(l2Grad.(*mat.Dense))
+	}
+	delta := r.Method.Delta(param)
+	if r.weightDecay == 0 {
+		return delta
+	}
+	decay := param.Value().ProdScalar(mat.Float(r.rate * r.weightDecay))
+	defer mat.ReleaseDense(decay.(*mat.Dense))
+	return delta.Add(decay)
+}
+
+func (r *regularizedMethod) IncEpoch() {
+	incEpoch(r.Method)
+}
+
+func (r *regularizedMethod) IncBatch() {
+	incBatch(r.Method)
+}
+
+// incEpoch beats a new epoch for the method, when it follows epochs
+func incEpoch(method gd.Method) {
+	if scheduler, ok := method.(gd.EpochScheduler); ok {
+		scheduler.IncEpoch()
+	}
+}
+
+// incBatch beats a new batch for the method, when it follows batches
+func incBatch(method gd.Method) {
+	if scheduler, ok := method.(gd.BatchScheduler); ok {
+		scheduler.IncBatch()
+	}
+}
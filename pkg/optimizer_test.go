@@ -0,0 +1,97 @@
+package pkg
+
+import (
+	"testing"
+
+	mat "github.com/nlpodyssey/spago/pkg/mat32"
+	"github.com/nlpodyssey/spago/pkg/ml/nn"
+	"github.com/nlpodyssey/spago/pkg/ml/optimizers/gd/radam"
+	"github.com/nlpodyssey/spago/pkg/ml/optimizers/gd/sgd"
+	"github.com/stretchr/testify/require"
+
+	"golem/pkg/model"
+)
+
+func TestParseOptimizer(t *testing.T) {
+	params := TrainingParameters{LearningRate: 0.01, Beta1: 0.9, Beta2: 0.999, Epsilon: 1e-8, Momentum: 0.9,
+		RMSPropDecay: 0.95, WeightDecay: 0.1, ClipValue: 2000}
+
+	optimizer, err := parseOptimizer(params)
+	require.NoError(t, err)
+	require.Equal(t, model.Optimizer{Method: model.AdamOptimizer, LearningRate: 0.01, Beta1: 0.9, Beta2: 0.999, Epsilon: 1e-8,
+		WeightDecay: 0.1, ClipValue: 2000}, optimizer)
+
+	// Only the hyperparameters of the method are recorded
+	params.Optimizer = "sgd"
+	params.Nesterov = true
+	optimizer, err = parseOptimizer(params)
+	require.NoError(t, err)
+	require.Equal(t, model.Optimizer{Method: model.SGDOptimizer, LearningRate: 0.01, Momentum: 0.9, Nesterov: true,
+		WeightDecay: 0.1, ClipValue: 2000}, optimizer)
+
+	params.Optimizer = "rmsprop"
+	optimizer, err = parseOptimizer(params)
+	require.NoError(t, err)
+	require.Equal(t, 0.95, optimizer.Decay)
+	require.Equal(t, 0.0, optimizer.Momentum)
+
+	for _, invalid := range []TrainingParameters{
+		{Optimizer: "lbfgs", LearningRate: 0.01},
+		{LearningRate: 0},
+		{LearningRate: 0.01, WeightDecay: -1},
+		{LearningRate: 0.01, Beta1: 1},
+		{Optimizer: "sgd", LearningRate: 0.01, Momentum: 1},
+		{Optimizer: "rmsprop", LearningRate: 0.01, RMSPropDecay: 1.5},
+	} {
+		_, err = parseOptimizer(invalid)
+		require.Error(t, err, "%+v", invalid)
+	}
+}
+
+func TestRegularizedMethod(t *testing.T) {
+	param := nn.NewParam(mat.NewVecDense([]mat.Float{1, -2}))
+	param.PropagateGrad(mat.NewVecDense([]mat.Float{0.5, 0}))
+	method := &regularizedMethod{Method: sgd.New(sgd.NewConfig(0.1, 0, false)), weightDecay: 0.1, l2: 0.2, rate: 0.1}
+
+	// The L2 gradient is added to the gradient, and the weight decay scaled by the learning rate to the update
+	delta := method.Delta(param)
+	require.InDeltaSlice(t, []mat.Float{0.1*(0.5+0.2) + 0.1*0.1, 0.1*(-0.4) - 0.1*0.1*2}, delta.Data(), 1e-6)
+
+	// Unregularized parameters are updated by the method alone
+	param = nn.NewParam(mat.NewVecDense([]mat.Float{1, -2}))
+	param.PropagateGrad(mat.NewVecDense([]mat.Float{0.5, 0}))
+	method.unregularized = map[nn.Param]bool{param: true}
+	delta = method.Delta(param)
+	require.InDeltaSlice(t, []mat.Float{0.1 * 0.5, 0}, delta.Data(), 1e-6)
+	require.InDeltaSlice(t, []mat.Float{0.5, 0}, param.Grad().Data(), 1e-6)
+}
+
+func TestUnregularizedParams(t *testing.T) {
+	m := model.NewTabNet(model.TabNetConfig{NumDecisionSteps: 2, NumColumns: 3, IntermediateFeatureDimension: 4,
+		OutputDimension: 2, CategoricalEmbeddingDimension: 1, NumCategoricalEmbeddings: 2, BatchMomentum: 0.9})
+	unregularized := unregularizedParams(m)
+	for _, param := range m.CategoricalFeatureEmbeddings {
+		require.True(t, unregularized[param])
+	}
+	require.True(t, unregularized[m.AttentionBatchNorm[0].W])
+	require.True(t, unregularized[m.SharedFeatureTransformer.Layer2.BatchNormLayer[1].B])
+	require.True(t, unregularized[m.Decoders[0].FeatureTransformer.Layer1.BatchNormLayer[0].W])
+	require.False(t, unregularized[m.OutputLayer.W])
+	require.False(t, unregularized[m.AttentionTransformer[0].W])
+	require.False(t, unregularized[m.StepFeatureTransformers[0].Layer1.DenseLayer.W])
+}
+
+func TestNewOptimizer(t *testing.T) {
+	params := TrainingParameters{Optimizer: "radam", LearningRate: 0.01, Beta1: 0.9, Beta2: 0.999, Epsilon: 1e-8, ClipNorm: 1}
+	m := &model.Model{TabNet: model.NewTabNet(model.TabNetConfig{})}
+	optimizer, scheduler := newOptimizer(m, params, 2)
+	require.Equal(t, model.RAdamOptimizer, m.Optimizer.Method)
+	require.Equal(t, 1.0, m.Optimizer.ClipNorm)
+
+	// Batches are forwarded to the method through the scheduler and the regularization
+	method := scheduler.Method.(*regularizedMethod).Method.(*radam.RAdam)
+	optimizer.IncEpoch()
+	optimizer.IncBatch()
+	optimizer.IncBatch()
+	require.Equal(t, 3, method.TimeStep)
+}
@@ -0,0 +1,479 @@
+package pkg
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	gio "io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	mat "github.com/nlpodyssey/spago/pkg/mat32"
+	"github.com/nlpodyssey/spago/pkg/mat32/rand"
+	"github.com/nlpodyssey/spago/pkg/ml/ag"
+	"github.com/nlpodyssey/spago/pkg/ml/nn"
+	"github.com/rs/zerolog/log"
+
+	"golem/pkg/io"
+	"golem/pkg/model"
+)
+
+// predictionBatchSize is the number of records run through the model at once by a Predictor
+const predictionBatchSize = 128
+
+// TargetPrediction is the prediction of the model for a single target of a record
+type TargetPrediction struct {
+	// Target is the name of the target column
+	Target string
+	// Class is the predicted class of classification targets
+	Class string
+	// Probabilities holds the probability of each class of classification targets, or of each label
+	// of multi-label targets
+	Probabilities map[string]float64
+	// Labels holds the predicted labels of multi-label targets
+	Labels []string
+	// Value is the predicted value of regression targets, in the original units of the target. It is the median
+	// when several quantiles are predicted.
+	Value float64
+	// Quantiles holds the predicted value of each quantile of regression targets, by quantile, when several
+	// quantiles are predicted
+	Quantiles map[string]float64
+}
+
+// Prediction is the prediction of the model for a single record
+type Prediction struct {
+	// TargetPrediction is the prediction of the first target
+	TargetPrediction
+	// Targets holds the prediction of each target, in the order of the target columns of the model
+	Targets []TargetPrediction
+	// ReconstructionLoss is the loss of the reconstruction of the record features by the decoder
+	ReconstructionLoss float64
+	// Attention holds the attention mask of each decision step
+	Attention model.AttentionMask
+}
+
+// Predictor runs a model on records given by column name, which do not need to hold the target columns.
+// It is safe for concurrent use by multiple goroutines.
+type Predictor struct {
+	model *model.Model
+	// featureMetaData is the metadata of the model without the target and weight columns, used to parse records
+	featureMetaData *model.Metadata
+	// processors pools the graphs and the TabNet instances reified on them, which cannot be shared
+	// by concurrent predictions
+	processors sync.Pool
+}
+
+// processor is a TabNet reified for inference on its own graph
+type processor struct {
+	g      *ag.Graph
+	tabNet *model.TabNet
+}
+
+// NewPredictor returns a predictor for the model, which must have a target
+func NewPredictor(m *model.Model) (*Predictor, error) {
+	if !m.MetaData.HasTarget() {
+		return nil, fmt.Errorf("cannot predict with a pretrained model without a target")
+	}
+	p := &Predictor{
+		model:           m,
+		featureMetaData: featureMetaData(m.MetaData),
+	}
+	p.processors.New = func() interface{} {
+		g := ag.NewGraph(ag.Rand(rand.NewLockedRand(42)),
+			ag.ConcurrentComputations(1))
+		ctx := nn.Context{Graph: g, Mode: nn.Inference}
+		return &processor{
+			g:      g,
+			tabNet: nn.Reify(ctx, m.TabNet).(*model.TabNet),
+		}
+	}
+	return p, nil
+}
+
+// featureMetaData returns a copy of the metadata without the target and weight columns, used to parse records
+// that do not hold them
+func featureMetaData(metaData *model.Metadata) *model.Metadata {
+	features := *metaData
+	features.TargetColumn = model.NoTarget
+	features.ExtraTargets = nil
+	features.Weighted = false
+	return &features
+}
+
+// LoadPredictor returns a predictor for the model saved in the file
+func LoadPredictor(modelFileName string) (*Predictor, error) {
+	m, err := loadModel(modelFileName)
+	if err != nil {
+		return nil, err
+	}
+	return NewPredictor(m)
+}
+
+// Model returns the model of the predictor
+func (p *Predictor) Model() *model.Model {
+	return p.model
+}
+
+// Predict returns the prediction of the model for each record, in the order of the records. Columns missing
+// from a record are parsed as missing values when the model accepts them. Prediction stops with the error of
+// the context when it is done.
+func (p *Predictor) Predict(ctx context.Context, records []map[string]string) ([]Prediction, error) {
+	predictions, _, dataErrors, err := p.predictValid(ctx, records)
+	if err != nil {
+		return nil, err
+	}
+	if len(dataErrors) > 0 {
+		return nil, fmt.Errorf("record %d: %s", dataErrors[0].Line, dataErrors[0].Error)
+	}
+	return predictions, nil
+}
+
+// predictValid returns the predictions of the records that can be parsed along with their indexes,
+// and the errors of the other records
+func (p *Predictor) predictValid(ctx context.Context, records []map[string]string) ([]Prediction, []int, []io.DataError, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	dataSet, indexes, dataErrors, err := p.parse(records)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(dataSet.Data) == 0 {
+		return nil, nil, dataErrors, nil
+	}
+
+	proc := p.processors.Get().(*processor)
+	defer func() {
+		proc.g.Clear()
+		p.processors.Put(proc)
+	}()
+
+	results := make([]Prediction, 0, len(dataSet.Data))
+	dataSet.ResetOrder(io.OriginalOrder)
+	for d := dataSet.Next(); len(d) > 0; d = dataSet.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, nil, err
+		}
+		input, output := predict(proc.g, proc.tabNet, d)
+		for i := range d {
+			result := p.decode(output.Output[i].Value().Data())
+			result.ReconstructionLoss = float64(reconstructionLoss(proc.g, input[i], output.DecoderOutput[i]).ScalarValue())
+			result.Attention = output.AttentionMasks[i]
+			results = append(results, result)
+		}
+		proc.g.Clear()
+	}
+	return results, indexes, dataErrors, nil
+}
+
+// parse converts the records to a dataset, returning the index of each parsed record and the errors of
+// the records that cannot be parsed
+func (p *Predictor) parse(records []map[string]string) (*io.DataSet, []int, []io.DataError, error) {
+	return parseFeatures(p.model.MetaData, p.featureMetaData, records, predictionBatchSize)
+}
+
+// parseFeatures converts records given by column name to a dataset parsed with the feature metadata of the
+// model metadata, returning the index of each parsed record and the errors of the records that cannot be parsed
+func parseFeatures(metaData, featureMetaData *model.Metadata, records []map[string]string, batchSize int) (*io.DataSet, []int, []io.DataError, error) {
+	var dataErrors []io.DataError
+	rows := make([][]string, 0, len(records))
+	indexes := make([]int, 0, len(records))
+	for i, record := range records {
+		row, err := featureRow(metaData, record)
+		if err != nil {
+			dataErrors = append(dataErrors, io.DataError{Line: i, Error: err.Error()})
+			continue
+		}
+		rows = append(rows, row)
+		indexes = append(indexes, i)
+	}
+	dataSet, parseErrors, err := io.ParseRecords(rows, featureMetaData, batchSize)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(parseErrors) > 0 {
+		valid := make([]int, 0, len(indexes))
+		next := 0
+		for row, index := range indexes {
+			if next < len(parseErrors) && parseErrors[next].Line == row {
+				dataErrors = append(dataErrors, io.DataError{Line: index, Error: parseErrors[next].Error})
+				next++
+				continue
+			}
+			valid = append(valid, index)
+		}
+		indexes = valid
+		sort.Slice(dataErrors, func(i, j int) bool {
+			return dataErrors[i].Line < dataErrors[j].Line
+		})
+	}
+	return dataSet, indexes, dataErrors, nil
+}
+
+// featureRow returns the values of the record in the order of the columns of the metadata. The target and
+// weight columns are left empty.
+func featureRow(metaData *model.Metadata, record map[string]string) ([]string, error) {
+	row := make([]string, len(metaData.Columns))
+	for column, c := range metaData.Columns {
+		if !metaData.IsFeatureColumn(column) {
+			continue
+		}
+		value, ok := record[c.Name]
+		if !ok {
+			if len(metaData.MissingValues) == 0 {
+				return nil, fmt.Errorf("missing value for column %s", c.Name)
+			}
+			value = metaData.MissingValues[0]
+		}
+		row[column] = value
+	}
+	return row, nil
+}
+
+// decode converts the output of the model to a prediction
+func (p *Predictor) decode(output []mat.Float) Prediction {
+	metaData := p.model.MetaData
+	var result Prediction
+	offset := 0
+	for _, target := range metaData.Targets() {
+		dimension := metaData.TargetDimension(target)
+		result.Targets = append(result.Targets, p.decodeTarget(target, output[offset:offset+dimension]))
+		offset += dimension
+	}
+	result.TargetPrediction = result.Targets[0]
+	return result
+}
+
+// decodeTarget converts the outputs of the model for the target to its prediction
+func (p *Predictor) decodeTarget(target *model.Target, output []mat.Float) TargetPrediction {
+	targetColumn := p.model.MetaData.Columns[target.Column]
+	switch targetColumn.Type {
+	case model.Continuous:
+		regressionLoss := p.model.MetaData.RegressionLoss
+		if len(regressionLoss.Quantiles) == 0 {
+			return TargetPrediction{
+				Target: targetColumn.Name,
+				Value:  regressionLoss.InverseLink(float64(output[0]))*targetColumn.StdDev + targetColumn.Average,
+			}
+		}
+		result := TargetPrediction{
+			Target:    targetColumn.Name,
+			Quantiles: make(map[string]float64, len(output)),
+		}
+		for i, value := range regressionLoss.QuantileValues(output) {
+			result.Quantiles[quantileName(regressionLoss.Quantiles[i])] = value*targetColumn.StdDev + targetColumn.Average
+		}
+		result.Value = result.Quantiles[quantileName(0.5)]
+		return result
+	case model.MultiLabel:
+		result := TargetPrediction{
+			Target:        targetColumn.Name,
+			Probabilities: make(map[string]float64, len(output)),
+			Labels:        []string{},
+		}
+		for i, probability := range sigmoid(output) {
+			label := target.Map.IndexToName[i]
+			result.Probabilities[label] = probability
+			if probability >= multiLabelThreshold {
+				result.Labels = append(result.Labels, label)
+			}
+		}
+		return result
+	}
+	class, _ := argmax(output)
+	probabilities := softmax(output, p.model.Temperature)
+	result := TargetPrediction{
+		Target:        targetColumn.Name,
+		Class:         target.Map.IndexToName[class],
+		Probabilities: make(map[string]float64, len(probabilities)),
+	}
+	for i, probability := range probabilities {
+		result.Probabilities[target.Map.IndexToName[i]] = probability
+	}
+	return result
+}
+
+// Predict writes the predictions of the model for the rows of the input file, which does not need to hold the
+// target column, to the output file. The values of the passthrough columns, such as a row ID, are copied from
+// the input to each prediction. Rows that cannot be parsed are logged and skipped. Rows are read from stdin
+// when the input file name is empty or "-", and predictions are written to stdout when the output file name
+// is empty or "-", as soon as each batch of rows is predicted.
+func Predict(modelFileName, inputFileName, outputFileName string, passthroughColumns []string) error {
+	p, err := LoadPredictor(modelFileName)
+	if err != nil {
+		return err
+	}
+	input, err := openInput(inputFileName)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	if outputFileName == "" {
+		outputFileName = "-"
+	}
+	output, err := createOutput(outputFileName)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	return p.predictCSV(context.Background(), input, output, passthroughColumns)
+}
+
+// predictCSV reads the records of the CSV input, whose first line is a header, and writes their predictions
+// as CSV to the output, one batch of records at a time, so that memory does not grow with the input
+func (p *Predictor) predictCSV(ctx context.Context, input gio.Reader, output gio.Writer, passthroughColumns []string) error {
+	reader := csv.NewReader(input)
+	// rows with missing fields are reported along with the other parsing errors
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("error reading data header: %w", err)
+	}
+	columnIndex := make(map[string]int, len(header))
+	for i, name := range header {
+		columnIndex[name] = i
+	}
+	for _, name := range passthroughColumns {
+		if _, ok := columnIndex[name]; !ok {
+			return fmt.Errorf("passthrough column %s not found in data header", name)
+		}
+	}
+
+	writer := csv.NewWriter(output)
+	if err := writer.Write(append(append([]string{}, passthroughColumns...), p.predictionColumns()...)); err != nil {
+		return fmt.Errorf("error writing predictions: %w", err)
+	}
+
+	line := 0
+	numPredictions := 0
+	for done := false; !done; {
+		var rows [][]string
+		for len(rows) < predictionBatchSize {
+			row, err := reader.Read()
+			if err == gio.EOF {
+				done = true
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("error reading data: %w", err)
+			}
+			rows = append(rows, row)
+		}
+		records := namedRecords(columnIndex, rows)
+		predictions, indexes, dataErrors, err := p.predictValid(ctx, records)
+		if err != nil {
+			return err
+		}
+		for _, dataError := range dataErrors {
+			log.Error().Msgf("Error parsing data at line %d: %s\n", line+dataError.Line, dataError.Error)
+		}
+		for i, prediction := range predictions {
+			values := make([]string, 0, len(passthroughColumns))
+			for _, name := range passthroughColumns {
+				values = append(values, records[indexes[i]][name])
+			}
+			if err := writer.Write(append(values, p.predictionValues(prediction)...)); err != nil {
+				return fmt.Errorf("error writing predictions: %w", err)
+			}
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return fmt.Errorf("error writing predictions: %w", err)
+		}
+		line += len(rows)
+		numPredictions += len(predictions)
+	}
+	log.Info().Int("rows", line).Int("predictions", numPredictions).Msg("")
+	return nil
+}
+
+// namedRecords returns the values of each CSV row by column name, given the index of each column in the header.
+// Columns missing from a row are left out of its record.
+func namedRecords(columnIndex map[string]int, rows [][]string) []map[string]string {
+	records := make([]map[string]string, len(rows))
+	for i, row := range rows {
+		records[i] = make(map[string]string, len(row))
+		for name, column := range columnIndex {
+			if column < len(row) {
+				records[i][name] = row[column]
+			}
+		}
+	}
+	return records
+}
+
+// predictionColumns returns the names of the prediction values written for each record,
+// consistent with the output of the test command. The columns of each target of multi-target models
+// are prefixed by the name of the target.
+func (p *Predictor) predictionColumns() []string {
+	metaData := p.model.MetaData
+	var columns []string
+	for _, target := range metaData.Targets() {
+		prefix := ""
+		if metaData.IsMultiTarget() {
+			prefix = metaData.Columns[target.Column].Name + "_"
+		}
+		for _, column := range p.targetColumns(target) {
+			columns = append(columns, prefix+column)
+		}
+	}
+	return append(columns, "reconstructionLoss")
+}
+
+func (p *Predictor) targetColumns(target *model.Target) []string {
+	var columns []string
+	switch p.model.MetaData.Columns[target.Column].Type {
+	case model.Continuous:
+		if len(p.model.MetaData.RegressionLoss.Quantiles) > 0 {
+			return []string{"lower", "median", "upper"}
+		}
+		return []string{"prediction"}
+	case model.MultiLabel:
+		columns = []string{"predicted"}
+	default:
+		columns = []string{"predicted", "probability"}
+	}
+	for class := 0; class < target.Map.Size(); class++ {
+		columns = append(columns, "probability_"+target.Map.IndexToName[class])
+	}
+	return columns
+}
+
+func (p *Predictor) predictionValues(prediction Prediction) []string {
+	var values []string
+	for i, target := range p.model.MetaData.Targets() {
+		values = append(values, p.targetValues(target, prediction.Targets[i])...)
+	}
+	return append(values, fmt.Sprintf("%f", prediction.ReconstructionLoss))
+}
+
+func (p *Predictor) targetValues(target *model.Target, prediction TargetPrediction) []string {
+	var values []string
+	switch p.model.MetaData.Columns[target.Column].Type {
+	case model.Continuous:
+		quantiles := p.model.MetaData.RegressionLoss.Quantiles
+		if len(quantiles) > 0 {
+			return []string{
+				fmt.Sprintf("%f", prediction.Quantiles[quantileName(quantiles[0])]),
+				fmt.Sprintf("%f", prediction.Value),
+				fmt.Sprintf("%f", prediction.Quantiles[quantileName(quantiles[len(quantiles)-1])]),
+			}
+		}
+		return []string{fmt.Sprintf("%f", prediction.Value)}
+	case model.MultiLabel:
+		values = []string{strings.Join(prediction.Labels, p.model.MetaData.LabelSeparator)}
+	default:
+		values = []string{prediction.Class, fmt.Sprintf("%.5f", prediction.Probabilities[prediction.Class])}
+	}
+	for class := 0; class < target.Map.Size(); class++ {
+		values = append(values, fmt.Sprintf("%.5f", prediction.Probabilities[target.Map.IndexToName[class]]))
+	}
+	return values
+}
+
+// quantileName returns the name of a quantile in the predictions
+func quantileName(quantile float64) string {
+	return strconv.FormatFloat(quantile, 'g', -1, 64)
+}
@@ -0,0 +1,238 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+
+	mat "github.com/nlpodyssey/spago/pkg/mat32"
+	"github.com/nlpodyssey/spago/pkg/mat32/rand"
+	"github.com/nlpodyssey/spago/pkg/ml/ag"
+	"github.com/nlpodyssey/spago/pkg/ml/nn"
+	"github.com/nlpodyssey/spago/pkg/ml/optimizers/gd"
+	"github.com/rs/zerolog/log"
+
+	"golem/pkg/io"
+	"golem/pkg/model"
+)
+
+// Pretrain trains the encoder and decoder of a model on unlabeled data with self-supervision, as described in the
+// TabNet paper: a random fraction maskingRatio of the features of each example is masked, and the model is trained
+// to reconstruct the masked features from the others. The resulting model can initialize the encoder of supervised
+// models trained on data with the same features.
+func Pretrain(dataFile, outputFileName string, maskingRatio float64, config model.TabNetConfig, trainingParams TrainingParameters) error {
+	if maskingRatio <= 0 || maskingRatio >= 1 {
+		return fmt.Errorf("the masking ratio must be between 0 and 1, got %f", maskingRatio)
+	}
+	if config.NumDecisionSteps < 2 {
+		return fmt.Errorf("pretraining requires at least 2 decision steps")
+	}
+	metaData, dataSet, err := loadTrainingData(dataFile, nil, trainingParams)
+	if err != nil {
+		return err
+	}
+	if metaData.ContinuousFeaturesMap.Size()+metaData.CategoricalFeaturesMap.Size() < 2 {
+		return fmt.Errorf("pretraining requires at least 2 feature columns")
+	}
+
+	m := pretrainModel(metaData, dataSet, maskingRatio, config, trainingParams)
+
+	outputFile, err := os.Create(outputFileName)
+	if err != nil {
+		return fmt.Errorf("error creating output file %s: %w", outputFileName, err)
+	}
+	defer outputFile.Close()
+	if err := io.SaveModel(m, outputFile); err != nil {
+		return fmt.Errorf("error saving model to %s: %w", outputFileName, err)
+	}
+	return nil
+}
+
+// pretrainer trains a model to reconstruct randomly masked features
+type pretrainer struct {
+	params    TrainingParameters
+	optimizer *gd.GradientDescent
+	scheduler *learningRateScheduler
+	model     *model.TabNet
+	workers   *workerPool
+	// inputColumns maps each element of the model input to its data column, so that
+	// all the elements of a categorical embedding are masked together
+	inputColumns   []int
+	maskingRatio   float64
+	rand           *rand.LockedRand
+	categoryMasker *unknownCategoryMasker
+}
+
+func pretrainModel(metaData *model.Metadata, dataSet *io.DataSet, maskingRatio float64, config model.TabNetConfig, trainingParams TrainingParameters) *model.Model {
+	config = configureModel(metaData, config)
+	tabNet := model.NewTabNet(config)
+	rndGen := rand.NewLockedRand(trainingParams.RndSeed)
+	tabNet.Init(rndGen)
+
+	p := &pretrainer{
+		params:       trainingParams,
+		model:        tabNet,
+		inputColumns: metaData.InputColumns(config.CategoricalEmbeddingDimension),
+		maskingRatio: maskingRatio,
+		rand:         rndGen,
+	}
+	m := &model.Model{
+		MetaData: metaData,
+		TabNet:   tabNet,
+	}
+	p.optimizer, p.scheduler = newOptimizer(m, trainingParams, batchesPerEpoch(dataSet.Size(), dataSet.BatchSize))
+	p.workers = newWorkerPool(tabNet, numWorkers(trainingParams))
+	if trainingParams.UnknownCategoryProbability > 0 {
+		p.categoryMasker = newUnknownCategoryMasker(metaData, dataSet, mat.Float(trainingParams.UnknownCategoryProbability),
+			trainingParams.RareCategoryFrequency, rand.NewLockedRand(trainingParams.RndSeed))
+	}
+
+	for epoch := 0; epoch < trainingParams.NumEpochs; epoch++ {
+		dataSet.ResetOrder(io.RandomOrder)
+		p.optimizer.IncEpoch()
+		i := 0
+		for batch := dataSet.Next(); len(batch) > 0; batch = dataSet.Next() {
+			if p.categoryMasker != nil {
+				batch = p.categoryMasker.mask(batch)
+			}
+			out := p.pretrainBatch(batch)
+			p.optimizer.Optimize()
+			if i%trainingParams.ReportInterval == 0 {
+				log.Info().Int("epoch", epoch).Int("batch", i).
+					Float64("learningRate", p.scheduler.rate).
+					Float32("totalLoss", out.TotalLoss).
+					Float32("sparsityLoss", out.SparsityLoss).
+					Float32("reconstructionLoss", out.ReconstructionLoss).Msgf("")
+			}
+			i++
+		}
+	}
+	return m
+}
+
+// sampleMask returns a random binary mask of the input features, where each data column is masked with
+// probability maskingRatio. Masks hiding either none or all of the columns are sampled again.
+func (p *pretrainer) sampleMask() mat.Matrix {
+	for {
+		masked := map[int]bool{}
+		mask := mat.NewEmptyVecDense(len(p.inputColumns))
+		numMasked := 0
+		for i, column := range p.inputColumns {
+			isMasked, ok := masked[column]
+			if !ok {
+				isMasked = float64(p.rand.Float()) < p.maskingRatio
+				masked[column] = isMasked
+				if isMasked {
+					numMasked++
+				}
+			}
+			if isMasked {
+				mask.Set(i, 0, 1.0)
+			}
+		}
+		if numMasked > 0 && numMasked < len(masked) {
+			return mask
+		}
+	}
+}
+
+func (p *pretrainer) pretrainBatch(batch io.DataBatch) trainBatchOutput {
+	p.optimizer.IncBatch()
+
+	// the masks and the feature variances are computed for the whole batch before it is split among the workers
+	masks := make([]mat.Matrix, len(batch))
+	for i := range masks {
+		masks[i] = p.sampleMask()
+	}
+	g := ag.NewGraph(ag.ConcurrentComputations(1))
+	variances := featureVariances(createInputNodes(batch, g, p.model))
+	g.Clear()
+
+	return p.workers.run(batch, func(worker int, m *model.TabNet, shard io.DataBatch, start int) trainBatchOutput {
+		return p.pretrainShard(worker, m, shard, masks[start:start+len(shard)], variances, len(batch))
+	})
+}
+
+// pretrainShard accumulates the gradients of the loss of the shard of a batch of batchSize records into the
+// parameters of the model m of a worker, returning the losses of the shard averaged over the whole batch
+func (p *pretrainer) pretrainShard(worker int, m *model.TabNet, batch io.DataBatch, masks []mat.Matrix, variances mat.Matrix,
+	batchSize int) trainBatchOutput {
+	g := ag.NewGraph(
+		ag.Rand(rand.NewLockedRand(p.params.RndSeed+uint64(worker))),
+		ag.ConcurrentComputations(1))
+	defer g.Clear()
+
+	input := createInputNodes(batch, g, m)
+	ctx := nn.Context{Graph: g, Mode: nn.Training}
+	modelProc := nn.Reify(ctx, m).(*model.TabNet)
+
+	maskedInput := make([]ag.Node, len(batch))
+	prior := make([]ag.Node, len(batch))
+	for i := range batch {
+		// masked features are hidden from the encoder, which is also prevented from attending them
+		prior[i] = g.NewVariable(masks[i].OnesLike().Sub(masks[i]), false)
+		maskedInput[i] = g.Prod(input[i], prior[i])
+	}
+	output := modelProc.ForwardWithPrior(maskedInput, prior)
+
+	var batchLoss, batchSparsityLoss, batchReconstructionLoss ag.Node
+	for i := range batch {
+		reconstructionLoss := maskedReconstructionLoss(g, input[i], output.DecoderOutput[i], masks[i], variances)
+		batchReconstructionLoss = g.Add(batchReconstructionLoss, reconstructionLoss)
+
+		batchSparsityLoss = g.Add(batchSparsityLoss, output.AttentionEntropy[i])
+		weightedSparsityLoss := g.Mul(output.AttentionEntropy[i], g.Constant(mat.Float(m.SparsityLossWeight)))
+
+		batchLoss = g.Add(batchLoss, g.Add(reconstructionLoss, weightedSparsityLoss))
+	}
+	size := g.NewScalar(mat.Float(batchSize))
+	batchLoss = g.Div(batchLoss, size)
+	batchSparsityLoss = g.Div(batchSparsityLoss, size)
+	batchReconstructionLoss = g.Div(batchReconstructionLoss, size)
+
+	g.Backward(batchLoss)
+
+	return trainBatchOutput{
+		TotalLoss:          batchLoss.ScalarValue(),
+		SparsityLoss:       batchSparsityLoss.ScalarValue(),
+		ReconstructionLoss: batchReconstructionLoss.ScalarValue(),
+	}
+}
+
+// featureVariances returns the variance of each input feature over the batch. Features with zero variance
+// are assigned the average variance, or one if all variances are zero.
+func featureVariances(input []ag.Node) mat.Matrix {
+	n := mat.Float(len(input))
+	mean := input[0].Value().ZerosLike()
+	for _, x := range input {
+		mean.AddInPlace(x.Value())
+	}
+	mean.ProdScalarInPlace(1 / n)
+	variances := mean.ZerosLike()
+	for _, x := range input {
+		diff := x.Value().Sub(mean)
+		variances.AddInPlace(diff.Prod(diff))
+	}
+	variances.ProdScalarInPlace(1 / n)
+
+	average := variances.Sum() / mat.Float(variances.Size())
+	if average == 0 {
+		average = 1
+	}
+	data := variances.Data()
+	for i := range data {
+		if data[i] == 0 {
+			data[i] = average
+		}
+	}
+	return variances
+}
+
+// maskedReconstructionLoss is the squared reconstruction error of the masked features, normalized by
+// the variance of each feature and averaged over the masked features
+func maskedReconstructionLoss(g *ag.Graph, input, reconstructed ag.Node, mask, variances mat.Matrix) ag.Node {
+	target := g.NewVariable(g.GetCopiedValue(input), false)
+	weights := g.NewVariable(mask.Div(variances), false)
+	diff := g.Sub(reconstructed, target)
+	loss := g.ReduceSum(g.Prod(g.Prod(diff, diff), weights))
+	return g.DivScalar(loss, g.NewScalar(mask.Sum()))
+}
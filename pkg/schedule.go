@@ -0,0 +1,169 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/nlpodyssey/spago/pkg/ml/optimizers/gd"
+)
+
+// Learning rate schedules selectable in the training parameters
+const (
+	constantSchedule    = "constant"
+	stepSchedule        = "step"
+	exponentialSchedule = "exponential"
+	cosineSchedule      = "cosine"
+	oneCycleSchedule    = "onecycle"
+)
+
+const (
+	// oneCycleWarmupFraction is the fraction of the training over which the one-cycle schedule increases the learning rate
+	oneCycleWarmupFraction = 0.3
+	// oneCycleDivFactor is the ratio of the peak learning rate to the initial learning rate of the one-cycle schedule
+	oneCycleDivFactor = 25.0
+	// oneCycleFinalDivFactor is the ratio of the initial learning rate to the final learning rate of the one-cycle
+	// schedule, when no minimum learning rate is given
+	oneCycleFinalDivFactor = 1e4
+)
+
+// learningRateSchedule returns the factor of the base learning rate after the given number of epochs of training,
+// which includes the fraction of the current epoch
+type learningRateSchedule func(epoch float64) float64
+
+// newLearningRateSchedule returns the learning rate schedule selected by the training parameters:
+//   - constant keeps the base learning rate
+//   - step multiplies the learning rate by the decay every LearningRateDecayEpochs epochs
+//   - exponential multiplies the learning rate by the decay every epoch, continuously
+//   - cosine anneals the learning rate from the base rate to the minimum rate along a half cosine over each cycle,
+//     restarting from the base rate at the end of each cycle (SGDR)
+//   - onecycle increases the learning rate from a fraction of the base rate up to the base rate over the first
+//     part of the training, then anneals it to the minimum rate
+func newLearningRateSchedule(trainingParams TrainingParameters) (learningRateSchedule, error) {
+	minFactor := trainingParams.MinLearningRate / trainingParams.LearningRate
+	if trainingParams.MinLearningRate < 0 || minFactor > 1 {
+		return nil, fmt.Errorf("invalid minimum learning rate %f, expected a value between 0 and the learning rate", trainingParams.MinLearningRate)
+	}
+	if trainingParams.WarmupEpochs < 0 {
+		return nil, fmt.Errorf("invalid number of warmup epochs %f", trainingParams.WarmupEpochs)
+	}
+	decay := trainingParams.LearningRateDecay
+	switch trainingParams.LearningRateSchedule {
+	case "", constantSchedule:
+		return func(float64) float64 { return 1 }, nil
+	case stepSchedule:
+		if decay <= 0 || decay > 1 {
+			return nil, fmt.Errorf("invalid learning rate decay %f, expected a value between 0 and 1", decay)
+		}
+		if trainingParams.LearningRateDecayEpochs <= 0 {
+			return nil, fmt.Errorf("invalid number of learning rate decay epochs %d", trainingParams.LearningRateDecayEpochs)
+		}
+		decayEpochs := float64(trainingParams.LearningRateDecayEpochs)
+		return func(epoch float64) float64 {
+			return math.Pow(decay, math.Floor(epoch/decayEpochs))
+		}, nil
+	case exponentialSchedule:
+		if decay <= 0 || decay > 1 {
+			return nil, fmt.Errorf("invalid learning rate decay %f, expected a value between 0 and 1", decay)
+		}
+		return func(epoch float64) float64 {
+			return math.Pow(decay, epoch)
+		}, nil
+	case cosineSchedule:
+		cycleEpochs := trainingParams.CycleEpochs
+		if cycleEpochs == 0 {
+			cycleEpochs = float64(trainingParams.NumEpochs)
+		}
+		if cycleEpochs <= 0 {
+			return nil, fmt.Errorf("invalid number of cycle epochs %f", trainingParams.CycleEpochs)
+		}
+		if trainingParams.CycleMultiplier < 1 {
+			return nil, fmt.Errorf("invalid cycle multiplier %f, expected a value of at least 1", trainingParams.CycleMultiplier)
+		}
+		return func(epoch float64) float64 {
+			length := cycleEpochs
+			for epoch >= length {
+				epoch -= length
+				length *= trainingParams.CycleMultiplier
+			}
+			return minFactor + (1-minFactor)*(1+math.Cos(math.Pi*epoch/length))/2
+		}, nil
+	case oneCycleSchedule:
+		if trainingParams.NumEpochs <= 0 {
+			return nil, fmt.Errorf("the one-cycle schedule requires a positive number of epochs")
+		}
+		startFactor := 1 / oneCycleDivFactor
+		endFactor := minFactor
+		if endFactor == 0 {
+			endFactor = startFactor / oneCycleFinalDivFactor
+		}
+		return func(epoch float64) float64 {
+			progress := epoch / float64(trainingParams.NumEpochs)
+			if progress < oneCycleWarmupFraction {
+				return startFactor + (1-startFactor)*(1-math.Cos(math.Pi*progress/oneCycleWarmupFraction))/2
+			}
+			progress = (progress - oneCycleWarmupFraction) / (1 - oneCycleWarmupFraction)
+			return endFactor + (1-endFactor)*(1+math.Cos(math.Pi*progress))/2
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown learning rate schedule %s", trainingParams.LearningRateSchedule)
+	}
+}
+
+// learningRateScheduler sets the learning rate of an optimization method before each batch, following a schedule
+// preceded by an optional linear warmup. It forwards the epochs and batches of the optimizer to the method.
+type learningRateScheduler struct {
+	gd.Method
+	schedule     learningRateSchedule
+	baseRate     float64
+	warmupEpochs float64
+	// batchesPerEpoch is the number of batches of an epoch, which gives the fraction of the current epoch
+	batchesPerEpoch int
+	// setRate sets the learning rate of the method
+	setRate func(rate float64)
+	epoch   int
+	batch   int
+	// rate is the learning rate of the current batch
+	rate float64
+}
+
+func newLearningRateScheduler(method gd.Method, setRate func(rate float64), schedule learningRateSchedule,
+	trainingParams TrainingParameters, batchesPerEpoch int) *learningRateScheduler {
+	return &learningRateScheduler{
+		Method:          method,
+		schedule:        schedule,
+		baseRate:        trainingParams.LearningRate,
+		warmupEpochs:    trainingParams.WarmupEpochs,
+		batchesPerEpoch: batchesPerEpoch,
+		setRate:         setRate,
+		epoch:           -1,
+		rate:            trainingParams.LearningRate,
+	}
+}
+
+// IncEpoch beats the start of a new epoch
+func (s *learningRateScheduler) IncEpoch() {
+	s.epoch++
+	s.batch = -1
+	incEpoch(s.Method)
+}
+
+// IncBatch beats the start of a new batch, setting its learning rate
+func (s *learningRateScheduler) IncBatch() {
+	s.batch++
+	elapsed := float64(s.epoch) + float64(s.batch)/float64(s.batchesPerEpoch)
+	s.rate = s.baseRate * s.schedule(elapsed)
+	if s.warmupEpochs > 0 {
+		// the warmup counts the current batch, so that the learning rate is never zero
+		s.rate *= math.Min(1, (elapsed+1/float64(s.batchesPerEpoch))/s.warmupEpochs)
+	}
+	s.setRate(s.rate)
+	incBatch(s.Method)
+}
+
+var _ gd.EpochScheduler = &learningRateScheduler{}
+var _ gd.BatchScheduler = &learningRateScheduler{}
+
+// batchesPerEpoch returns the number of batches of size batchSize covering size records
+func batchesPerEpoch(size, batchSize int) int {
+	return (size + batchSize - 1) / batchSize
+}
@@ -0,0 +1,86 @@
+package pkg
+
+import (
+	"math"
+	"testing"
+
+	"github.com/nlpodyssey/spago/pkg/ml/optimizers/gd/adam"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLearningRateSchedules(t *testing.T) {
+	params := TrainingParameters{LearningRate: 0.1, NumEpochs: 10, LearningRateDecay: 0.5, LearningRateDecayEpochs: 2, CycleMultiplier: 1}
+
+	schedule, err := newLearningRateSchedule(params)
+	require.NoError(t, err)
+	require.Equal(t, 1.0, schedule(7.5))
+
+	params.LearningRateSchedule = stepSchedule
+	schedule, err = newLearningRateSchedule(params)
+	require.NoError(t, err)
+	require.Equal(t, 1.0, schedule(1.9))
+	require.Equal(t, 0.25, schedule(4))
+
+	params.LearningRateSchedule = exponentialSchedule
+	schedule, err = newLearningRateSchedule(params)
+	require.NoError(t, err)
+	require.InDelta(t, math.Pow(0.5, 1.5), schedule(1.5), 1e-9)
+
+	// Cycles of 2 then 4 epochs, restarting from the base rate
+	params.LearningRateSchedule = cosineSchedule
+	params.CycleEpochs = 2
+	params.CycleMultiplier = 2
+	params.MinLearningRate = 0.01
+	schedule, err = newLearningRateSchedule(params)
+	require.NoError(t, err)
+	require.InDelta(t, 1.0, schedule(0), 1e-9)
+	require.InDelta(t, 0.55, schedule(1), 1e-9)
+	require.InDelta(t, 1.0, schedule(2), 1e-9)
+	require.InDelta(t, 0.55, schedule(4), 1e-9)
+	require.InDelta(t, 1.0, schedule(6), 1e-9)
+
+	// Peaks at the base rate after 30% of the training
+	params.LearningRateSchedule = oneCycleSchedule
+	params.MinLearningRate = 0
+	schedule, err = newLearningRateSchedule(params)
+	require.NoError(t, err)
+	require.InDelta(t, 1/oneCycleDivFactor, schedule(0), 1e-9)
+	require.InDelta(t, 1.0, schedule(3), 1e-9)
+	require.InDelta(t, 1/oneCycleDivFactor/oneCycleFinalDivFactor, schedule(10), 1e-9)
+	require.Less(t, schedule(6), schedule(5))
+
+	for _, invalid := range []TrainingParameters{
+		{LearningRate: 0.1, LearningRateSchedule: "linear"},
+		{LearningRateSchedule: stepSchedule, LearningRate: 0.1, LearningRateDecay: 1.5, LearningRateDecayEpochs: 1},
+		{LearningRateSchedule: stepSchedule, LearningRate: 0.1, LearningRateDecay: 0.5},
+		{LearningRateSchedule: cosineSchedule, LearningRate: 0.1, NumEpochs: 10, CycleMultiplier: 0.5},
+		{LearningRateSchedule: cosineSchedule, LearningRate: 0.1, NumEpochs: 10, CycleMultiplier: 1, MinLearningRate: 0.2},
+		{LearningRate: 0.1, WarmupEpochs: -1},
+	} {
+		_, err = newLearningRateSchedule(invalid)
+		require.Error(t, err, "%+v", invalid)
+	}
+}
+
+func TestLearningRateScheduler(t *testing.T) {
+	params := TrainingParameters{LearningRate: 0.1, NumEpochs: 4, LearningRateSchedule: stepSchedule, LearningRateDecay: 0.5,
+		LearningRateDecayEpochs: 1, WarmupEpochs: 1}
+	schedule, err := newLearningRateSchedule(params)
+	require.NoError(t, err)
+	config := adam.NewDefaultConfig()
+	config.StepSize = 0.1
+	updater := adam.New(config)
+	var rates []float64
+	scheduler := newLearningRateScheduler(updater, func(rate float64) { rates = append(rates, rate) }, schedule, params, 2)
+
+	for epoch := 0; epoch < 2; epoch++ {
+		scheduler.IncEpoch()
+		for batch := 0; batch < 2; batch++ {
+			scheduler.IncBatch()
+		}
+	}
+	// The warmup increases the rate over the first epoch, then the rate is halved every epoch
+	require.Equal(t, []float64{0.05, 0.1, 0.05, 0.05}, rates)
+	require.Equal(t, 0.05, scheduler.rate)
+	require.Equal(t, updater.Label(), scheduler.Label())
+}
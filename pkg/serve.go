@@ -0,0 +1,254 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+
+	"golem/pkg/model"
+)
+
+// ServerOptions limits the size of the requests accepted by the prediction server
+type ServerOptions struct {
+	// MaxRequestBytes is the maximum size of a request body
+	MaxRequestBytes int64
+	// MaxBatchSize is the maximum number of records of a batch request
+	MaxBatchSize int
+}
+
+// predictRequest holds a single record to predict, with its values by column name
+type predictRequest struct {
+	Record    map[string]interface{} `json:"record"`
+	Attention bool                   `json:"attention"`
+}
+
+// batchPredictRequest holds the records to predict, with their values by column name
+type batchPredictRequest struct {
+	Records   []map[string]interface{} `json:"records"`
+	Attention bool                     `json:"attention"`
+}
+
+// predictResponse is the prediction for a single record. Prediction holds the predicted class of
+// classification models, the list of predicted labels of multi-label models, or the predicted value
+// of regression models, along with the value of each quantile when several quantiles are predicted. The predictions of the first target
+// of multi-target models are also given by target name along with the predictions of the other targets.
+type predictResponse struct {
+	Prediction         interface{}               `json:"prediction"`
+	Probabilities      map[string]float64        `json:"probabilities,omitempty"`
+	Quantiles          map[string]float64        `json:"quantiles,omitempty"`
+	Targets            map[string]targetResponse `json:"targets,omitempty"`
+	ReconstructionLoss float64                   `json:"reconstructionLoss"`
+	Attention          model.AttentionMask       `json:"attention,omitempty"`
+}
+
+// targetResponse is the prediction for a single target of a record
+type targetResponse struct {
+	Prediction    interface{}        `json:"prediction"`
+	Probabilities map[string]float64 `json:"probabilities,omitempty"`
+	Quantiles     map[string]float64 `json:"quantiles,omitempty"`
+}
+
+type batchPredictResponse struct {
+	Predictions []predictResponse `json:"predictions"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// server serves the predictions of a model over HTTP
+type server struct {
+	predictor *Predictor
+	options   ServerOptions
+}
+
+// NewServer returns an HTTP handler serving the predictions of the predictor as a JSON API:
+//   - POST /predict predicts a single record: {"record": {"column": value, ...}, "attention": false}
+//   - POST /predict/batch predicts several records: {"records": [{"column": value, ...}, ...], "attention": false}
+//   - GET /health reports that the server is alive
+//   - GET /ready reports that the model is loaded and ready to predict
+func NewServer(p *Predictor, options ServerOptions) http.Handler {
+	s := &server{
+		predictor: p,
+		options:   options,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/predict", s.handlePredict)
+	mux.HandleFunc("/predict/batch", s.handleBatchPredict)
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/ready", s.handleReady)
+	return mux
+}
+
+// Serve loads the model and serves its predictions on the address until the server fails
+func Serve(modelFileName, address string, options ServerOptions) error {
+	p, err := LoadPredictor(modelFileName)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("address", address).Str("model", modelFileName).Msg("Serving predictions")
+	return http.ListenAndServe(address, NewServer(p, options))
+}
+
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	metaData := s.predictor.Model().MetaData
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "ready",
+		"target":  metaData.Columns[metaData.TargetColumn].Name,
+		"targets": targetColumnNames(metaData),
+	})
+}
+
+func (s *server) handlePredict(w http.ResponseWriter, r *http.Request) {
+	var request predictRequest
+	if status, err := s.decodeRequest(w, r, &request); err != nil {
+		writeError(w, status, err)
+		return
+	}
+	if request.Record == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("no record to predict"))
+		return
+	}
+	responses, status, err := s.predict(r.Context(), []map[string]interface{}{request.Record}, request.Attention)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, responses[0])
+}
+
+func (s *server) handleBatchPredict(w http.ResponseWriter, r *http.Request) {
+	var request batchPredictRequest
+	if status, err := s.decodeRequest(w, r, &request); err != nil {
+		writeError(w, status, err)
+		return
+	}
+	if s.options.MaxBatchSize > 0 && len(request.Records) > s.options.MaxBatchSize {
+		writeError(w, http.StatusRequestEntityTooLarge,
+			fmt.Errorf("batch of %d records exceeds the maximum of %d", len(request.Records), s.options.MaxBatchSize))
+		return
+	}
+	responses, status, err := s.predict(r.Context(), request.Records, request.Attention)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, batchPredictResponse{Predictions: responses})
+}
+
+// decodeRequest decodes the JSON body of a POST request, returning the response status on error
+func (s *server) decodeRequest(w http.ResponseWriter, r *http.Request, request interface{}) (int, error) {
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method)
+	}
+	body := r.Body
+	if s.options.MaxRequestBytes > 0 {
+		body = http.MaxBytesReader(w, r.Body, s.options.MaxRequestBytes)
+	}
+	decoder := json.NewDecoder(body)
+	// numbers are kept as in the request, so that they are parsed like the values of a data file
+	decoder.UseNumber()
+	if err := decoder.Decode(request); err != nil {
+		if s.options.MaxRequestBytes > 0 && err.Error() == "http: request body too large" {
+			return http.StatusRequestEntityTooLarge, fmt.Errorf("request body exceeds %d bytes", s.options.MaxRequestBytes)
+		}
+		return http.StatusBadRequest, fmt.Errorf("invalid request: %w", err)
+	}
+	return http.StatusOK, nil
+}
+
+// predict returns the predictions of the records, or the response status on error
+func (s *server) predict(ctx context.Context, records []map[string]interface{}, withAttention bool) ([]predictResponse, int, error) {
+	stringRecords := make([]map[string]string, len(records))
+	for i, record := range records {
+		stringRecord, err := toStringRecord(record)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("record %d: %w", i, err)
+		}
+		stringRecords[i] = stringRecord
+	}
+	results, err := s.predictor.Predict(ctx, stringRecords)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	responses := make([]predictResponse, len(results))
+	for i, result := range results {
+		first := newTargetResponse(result.TargetPrediction)
+		responses[i] = predictResponse{
+			Prediction:         first.Prediction,
+			Probabilities:      first.Probabilities,
+			Quantiles:          first.Quantiles,
+			ReconstructionLoss: result.ReconstructionLoss,
+		}
+		if withAttention {
+			responses[i].Attention = result.Attention
+		}
+		if len(result.Targets) > 1 {
+			responses[i].Targets = make(map[string]targetResponse, len(result.Targets))
+			for _, target := range result.Targets {
+				responses[i].Targets[target.Target] = newTargetResponse(target)
+			}
+		}
+	}
+	return responses, http.StatusOK, nil
+}
+
+func newTargetResponse(prediction TargetPrediction) targetResponse {
+	if prediction.Labels != nil {
+		return targetResponse{Prediction: prediction.Labels, Probabilities: prediction.Probabilities}
+	}
+	if prediction.Probabilities != nil {
+		return targetResponse{Prediction: prediction.Class, Probabilities: prediction.Probabilities}
+	}
+	return targetResponse{Prediction: prediction.Value, Quantiles: prediction.Quantiles}
+}
+
+// toStringRecord converts the JSON values of a record to their data file representation.
+// Null values are left out, so that they are parsed as missing values.
+func toStringRecord(record map[string]interface{}) (map[string]string, error) {
+	result := make(map[string]string, len(record))
+	for column, value := range record {
+		switch v := value.(type) {
+		case nil:
+			continue
+		case string:
+			result[column] = v
+		case json.Number:
+			result[column] = v.String()
+		case bool:
+			result[column] = strconv.FormatBool(v)
+		default:
+			return nil, errors.New("unsupported value for column " + column)
+		}
+	}
+	return result, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Error().Msgf("Error writing response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
@@ -3,13 +3,14 @@ package pkg
 import (
 	"fmt"
 	gio "io"
+	"io/ioutil"
 	"math"
 
 	"sort"
+	"strings"
 
 	mat "github.com/nlpodyssey/spago/pkg/mat32"
 	"github.com/rs/zerolog/log"
-	"gonum.org/v1/gonum/stat"
 
 	"golem/pkg/io"
 	"golem/pkg/model"
@@ -19,7 +20,6 @@ import (
 	rand "github.com/nlpodyssey/spago/pkg/mat32/rand"
 	"github.com/nlpodyssey/spago/pkg/ml/ag"
 	"github.com/nlpodyssey/spago/pkg/ml/nn"
-	"github.com/nlpodyssey/spago/pkg/ml/stats"
 )
 
 type NoopWriter struct{}
@@ -34,32 +34,135 @@ func printDataErrors(errors []io.DataError) {
 	}
 }
 
-func Test(modelFileName, inputFileName, outputFileName string, attentionFileName string) error {
+// Test evaluates the model on the data of the input file, or of stdin when the file name is empty or "-".
+// Records are read and evaluated one batch at a time, and their predictions are written as soon as they are
+// produced, to stdout when the output file name is "-", so inputs of any size are evaluated in constant memory.
+// With exactMetrics, the label and the scores of each record are also kept to compute the ROC and precision-recall
+// AUCs, the median absolute error and the residuals by decile, so memory grows with the input.
+func Test(modelFileName, inputFileName, outputFileName, attentionFileName, metricsFileName string, attributions, exactMetrics bool) error {
+	m, err := loadModel(modelFileName)
+	if err != nil {
+		return err
+	}
+	if !m.MetaData.HasTarget() {
+		return fmt.Errorf("model %s is a pretrained model without a target", modelFileName)
+	}
+	input, err := openInput(inputFileName)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	reader, err := io.NewDataReader(input, m.MetaData, testBatchSize)
+	if err != nil {
+		return fmt.Errorf("error loading data from %s: %w", inputFileName, err)
+	}
+	source := &streamingSource{reader: reader}
+	report, err := testBatches(m, source, outputFileName, attentionFileName, attributions, exactMetrics)
+	if source.err != nil {
+		return fmt.Errorf("error loading data from %s: %w", inputFileName, source.err)
+	}
+	if err != nil {
+		return err
+	}
+	if metricsFileName != "" {
+		return writeMetricsReport(metricsFileName, report)
+	}
+	return nil
+}
+
+// testBatchSize is the number of records read and evaluated at once by the test command
+const testBatchSize = 64
+
+// batchSource provides the batches of records to evaluate, in order. An empty batch ends the data.
+type batchSource interface {
+	Next() io.DataBatch
+}
+
+// streamingSource provides the batches of a data reader, logging the records that cannot be parsed.
+// Reading stops at the first read error, which is kept.
+type streamingSource struct {
+	reader *io.DataReader
+	err    error
+}
+
+func (s *streamingSource) Next() io.DataBatch {
+	if s.err != nil {
+		return nil
+	}
+	batch, dataErrors, err := s.reader.Next()
+	printDataErrors(dataErrors)
+	if err != nil {
+		s.err = err
+		return nil
+	}
+	return batch
+}
+
+// openInput opens the named file, or returns stdin when the name is empty or "-"
+func openInput(fileName string) (gio.ReadCloser, error) {
+	if fileName == "" || fileName == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error opening input file %s: %w", fileName, err)
+	}
+	return file, nil
+}
+
+// createOutput creates the named file, or returns stdout when the name is "-"
+func createOutput(fileName string) (gio.WriteCloser, error) {
+	if fileName == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error creating output file %s: %w", fileName, err)
+	}
+	return file, nil
+}
 
+// nopWriteCloser leaves the writer open on Close
+type nopWriteCloser struct {
+	gio.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// loadModel loads a trained model from the file
+func loadModel(modelFileName string) (*model.Model, error) {
 	modelFile, err := os.Open(modelFileName)
 	if err != nil {
-		return fmt.Errorf("error opening model file %s: %w", modelFileName, err)
+		return nil, fmt.Errorf("error opening model file %s: %w", modelFileName, err)
+	}
+	defer modelFile.Close()
+
+	m, err := io.LoadModel(modelFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading model from file %s: %w", modelFileName, err)
 	}
+	return m, nil
+}
 
-	model, err := io.LoadModel(modelFile)
+// loadModelAndData loads a trained model and a dataset parsed with the model's metadata
+func loadModelAndData(modelFileName, inputFileName string) (*model.Model, *io.DataSet, error) {
+	m, err := loadModel(modelFileName)
 	if err != nil {
-		return fmt.Errorf("error loading model from file %s: %w", modelFileName, err)
+		return nil, nil, err
 	}
 	_, dataSet, dataErrors, err := io.LoadData(io.DataParameters{
 		DataFile:           inputFileName,
-		TargetColumn:       model.MetaData.Columns[model.MetaData.TargetColumn].Name,
+		TargetColumns:      targetColumnNames(m.MetaData),
 		CategoricalColumns: nil,
 		BatchSize:          1,
-	}, model.MetaData)
+	}, m.MetaData)
 	if err != nil {
-		return fmt.Errorf("error loading data from %s: %w", inputFileName, err)
+		return nil, nil, fmt.Errorf("error loading data from %s: %w", inputFileName, err)
 	}
 	printDataErrors(dataErrors)
-	if len(dataSet.Data) == 0 {
-		log.Fatal().Msg("No data to test")
-		return nil
-	}
-	return testInternal(model, dataSet, outputFileName, attentionFileName)
+	return m, dataSet, nil
 }
 
 type modelEvaluator interface {
@@ -67,108 +170,481 @@ type modelEvaluator interface {
 	EvaluatePrediction(prediction ag.Node, record *io.DataRecord) []string
 	LogMetrics()
 	Loss() float64
+	// Metrics returns the summary metrics of the evaluated predictions by name
+	Metrics() map[string]float64
+	// Report returns the summary metrics along with detailed metrics, such as per-class metrics
+	Report() metricsReport
 }
 
 type classificationEvaluator struct {
-	predictionCount int
-	loss            float64
-	metrics         map[string]*stats.ClassMetrics
-	model           *model.Model
-	lossFunc        lossFunc
-	g               *ag.Graph
+	// totalWeight is the sum of the sample weights of the predictions, which weight each contribution to the metrics
+	totalWeight float64
+	loss        float64
+	logLoss     float64
+	// confusionMatrix holds the weighted count of the predictions for each label (row) and predicted class (column)
+	confusionMatrix [][]float64
+	// exact keeps the label, the class probabilities and the sample weight of each prediction in labels,
+	// probabilities and weights, from which the ROC and precision-recall AUCs are computed. They grow with the
+	// evaluated records, so the AUCs are left out otherwise.
+	exact         bool
+	labels        []int
+	probabilities [][]float64
+	weights       []float64
+	model         *model.Model
+	// target is the index of the evaluated target, whose classes are mapped by targetMap
+	target    int
+	targetMap *model.NameMap
+	lossFunc  lossFunc
+	g         *ag.Graph
 }
 type classificationPrediction struct {
 	predictedClass string
+	predictedIndex int
 	label          string
 	labelValue     mat.Float
 	logits         mat.Matrix
-	maxLogit       mat.Float
+	probability    float64
+	probabilities  []float64
+}
+
+func newClassificationEvaluator(m *model.Model, target int, lossFunc lossFunc, g *ag.Graph, exact bool) *classificationEvaluator {
+	targetMap := m.MetaData.Targets()[target].Map
+	numClasses := targetMap.Size()
+	confusionMatrix := make([][]float64, numClasses)
+	for i := range confusionMatrix {
+		confusionMatrix[i] = make([]float64, numClasses)
+	}
+	return &classificationEvaluator{
+		confusionMatrix: confusionMatrix,
+		model:           m,
+		target:          target,
+		targetMap:       targetMap,
+		lossFunc:        lossFunc,
+		g:               g,
+		exact:           exact,
+	}
 }
 
 func (c *classificationEvaluator) Columns() []string {
-	return []string{"label", "predicted", "probability"}
+	columns := []string{"label", "predicted", "probability"}
+	for class := 0; class < c.targetMap.Size(); class++ {
+		columns = append(columns, "probability_"+c.targetMap.IndexToName[class])
+	}
+	return columns
 }
 func (c *classificationEvaluator) EvaluatePrediction(node ag.Node, record *io.DataRecord) []string {
 	prediction := c.decode(node, record)
-	c.loss += float64(c.lossFunc(c.g, c.g.NewVariable(prediction.logits, false), prediction.labelValue).ScalarValue())
-	c.predictionCount++
-
-	result := []string{prediction.label, prediction.predictedClass, fmt.Sprintf("%.5f", toProbability(prediction.maxLogit))}
+	weight := sampleWeight(c.model.MetaData.Weighted, record)
+	c.loss += weight * float64(c.lossFunc(c.g, c.g.NewVariable(prediction.logits, false), prediction.labelValue).ScalarValue())
+	c.totalWeight += weight
 
-	labelClassMetrics, ok := c.metrics[prediction.label]
-	if !ok {
-		labelClassMetrics = stats.NewMetricCounter()
-		c.metrics[prediction.label] = labelClassMetrics
-	}
-	predictedClassMetrics, ok := c.metrics[prediction.predictedClass]
-	if !ok {
-		predictedClassMetrics = stats.NewMetricCounter()
-		c.metrics[prediction.predictedClass] = predictedClassMetrics
+	result := []string{prediction.label, prediction.predictedClass, fmt.Sprintf("%.5f", prediction.probability)}
+	for _, p := range prediction.probabilities {
+		result = append(result, fmt.Sprintf("%.5f", p))
 	}
 
-	if prediction.label == prediction.predictedClass {
-		labelClassMetrics.IncTruePos()
-	} else {
-		labelClassMetrics.IncFalseNeg()
-		predictedClassMetrics.IncFalsePos()
+	label := int(prediction.labelValue)
+	c.confusionMatrix[label][prediction.predictedIndex] += weight
+	if c.exact {
+		c.labels = append(c.labels, label)
+		c.probabilities = append(c.probabilities, prediction.probabilities)
+		c.weights = append(c.weights, weight)
 	}
+	c.logLoss -= weight * math.Log(math.Max(prediction.probabilities[label], 1e-15))
 
 	return result
 }
 
+// classMetrics returns the metrics of each class seen as label or prediction, computed from the confusion matrix
+func (c *classificationEvaluator) classMetrics() map[string]*classCounts {
+	result := map[string]*classCounts{}
+	for class := range c.confusionMatrix {
+		metrics := &classCounts{}
+		for other := range c.confusionMatrix {
+			switch {
+			case other == class:
+				metrics.TruePos = c.confusionMatrix[class][class]
+			default:
+				metrics.FalseNeg += c.confusionMatrix[class][other]
+				metrics.FalsePos += c.confusionMatrix[other][class]
+			}
+		}
+		metrics.TrueNeg = c.totalWeight - metrics.TruePos - metrics.FalseNeg - metrics.FalsePos
+		if metrics.TruePos+metrics.FalseNeg+metrics.FalsePos > 0 {
+			result[c.targetMap.IndexToName[class]] = metrics
+		}
+	}
+	return result
+}
+
+// rankingMetrics returns the one-vs-rest ROC-AUC and PR-AUC of each class, when defined. They are only computed
+// by exact evaluators.
+func (c *classificationEvaluator) rankingMetrics() (map[string]float64, map[string]float64) {
+	rocAUCs := map[string]float64{}
+	prAUCs := map[string]float64{}
+	if !c.exact {
+		return rocAUCs, prAUCs
+	}
+	examples := make([]scoredExample, len(c.labels))
+	for class := range c.confusionMatrix {
+		for i := range c.labels {
+			examples[i] = scoredExample{score: c.probabilities[i][class], positive: c.labels[i] == class, weight: c.weights[i]}
+		}
+		name := c.targetMap.IndexToName[class]
+		if auc, ok := rocAUC(examples); ok {
+			rocAUCs[name] = auc
+		}
+		if ap, ok := averagePrecision(examples); ok {
+			prAUCs[name] = ap
+		}
+	}
+	return rocAUCs, prAUCs
+}
+
 func (c *classificationEvaluator) LogMetrics() {
+	metrics := c.classMetrics()
+	rocAUCs, prAUCs := c.rankingMetrics()
 	// Sort class names for deterministic output
-	sortedClasses := sortClasses(c.metrics)
+	sortedClasses := sortClasses(metrics)
 	for _, class := range sortedClasses {
-		result := c.metrics[class]
-		log.Info().Str("Class", class).
-			Int("TP", result.TruePos).
-			Int("FP", result.FalsePos).
-			Int("TN", result.TrueNeg).
-			Int("FN", result.FalseNeg).
-			Float32("Precision", result.Precision()).
-			Float32("Recall", result.Recall()).
-			Float32("F1", result.F1Score()).
-			Msg("")
+		result := metrics[class]
+		event := log.Info().Str("Class", class).
+			Float64("TP", result.TruePos).
+			Float64("FP", result.FalsePos).
+			Float64("TN", result.TrueNeg).
+			Float64("FN", result.FalseNeg).
+			Float64("Precision", zeroIfNaN(result.Precision())).
+			Float64("Recall", zeroIfNaN(result.Recall())).
+			Float64("F1", result.F1Score())
+		if auc, ok := rocAUCs[class]; ok {
+			event = event.Float64("RocAuc", auc)
+		}
+		if ap, ok := prAUCs[class]; ok {
+			event = event.Float64("PrAuc", ap)
+		}
+		event.Msg("")
+	}
+
+	for label := range c.confusionMatrix {
+		log.Info().Str("Label", c.targetMap.IndexToName[label]).
+			Floats64("Predicted", c.confusionMatrix[label]).Msg("Confusion matrix")
+	}
+
+	summary := c.Metrics()
+	event := log.Info().Float64("MacroF1", summary["MacroF1"]).Float64("MicroF1", summary["MicroF1"]).
+		Float64("Accuracy", summary["Accuracy"]).
+		Float64("BalancedAccuracy", summary["BalancedAccuracy"]).
+		Float64("LogLoss", summary["LogLoss"])
+	if c.exact {
+		event = event.Float64("RocAuc", summary["RocAuc"]).
+			Float64("PrAuc", summary["PrAuc"])
+	}
+	event.Msg("")
+}
 
+func (c *classificationEvaluator) Metrics() map[string]float64 {
+	macroF1, microF1 := computeOverallF1(c.classMetrics())
+
+	correct := 0.0
+	recall := 0.0
+	numLabels := 0
+	for class := range c.confusionMatrix {
+		correct += c.confusionMatrix[class][class]
+		labelCount := 0.0
+		for _, count := range c.confusionMatrix[class] {
+			labelCount += count
+		}
+		if labelCount > 0 {
+			recall += c.confusionMatrix[class][class] / labelCount
+			numLabels++
+		}
 	}
 
-	microF1, macroF1 := computeOverallF1(c.metrics)
-	log.Info().Float64("MacroF1", macroF1).Float64("MicroF1", microF1).Msg("")
+	metrics := map[string]float64{
+		"Loss":             c.Loss(),
+		"MacroF1":          macroF1,
+		"MicroF1":          microF1,
+		"Accuracy":         correct / c.totalWeight,
+		"BalancedAccuracy": recall / float64(numLabels),
+		"LogLoss":          c.logLoss / c.totalWeight,
+	}
+	if c.exact {
+		rocAUCs, prAUCs := c.rankingMetrics()
+		metrics["RocAuc"] = average(rocAUCs)
+		metrics["PrAuc"] = average(prAUCs)
+	}
+	return metrics
+}
+
+// classReport holds the metrics of a class. Decisions are counted with the sample weight of their record.
+type classReport struct {
+	Class     string
+	TP        float64
+	FP        float64
+	TN        float64
+	FN        float64
+	Precision float64
+	Recall    float64
+	F1        float64
+	RocAuc    *float64 `json:",omitempty"`
+	PrAuc     *float64 `json:",omitempty"`
+}
 
+type confusionMatrixReport struct {
+	// Classes holds the class names, in the order of the rows (labels) and columns (predictions) of Counts
+	Classes []string
+	Counts  [][]float64
+}
+
+func (c *classificationEvaluator) Report() metricsReport {
+	report := metricsReport{}
+	for name, value := range c.Metrics() {
+		report[name] = value
+	}
+
+	metrics := c.classMetrics()
+	rocAUCs, prAUCs := c.rankingMetrics()
+	var classes []classReport
+	for _, class := range sortClasses(metrics) {
+		result := metrics[class]
+		classMetrics := classReport{
+			Class:     class,
+			TP:        result.TruePos,
+			FP:        result.FalsePos,
+			TN:        result.TrueNeg,
+			FN:        result.FalseNeg,
+			Precision: zeroIfNaN(result.Precision()),
+			Recall:    zeroIfNaN(result.Recall()),
+			F1:        result.F1Score(),
+		}
+		if auc, ok := rocAUCs[class]; ok {
+			classMetrics.RocAuc = &auc
+		}
+		if ap, ok := prAUCs[class]; ok {
+			classMetrics.PrAuc = &ap
+		}
+		classes = append(classes, classMetrics)
+	}
+	report["Classes"] = classes
+
+	confusionMatrix := confusionMatrixReport{Counts: c.confusionMatrix}
+	for class := range c.confusionMatrix {
+		confusionMatrix.Classes = append(confusionMatrix.Classes, c.targetMap.IndexToName[class])
+	}
+	report["ConfusionMatrix"] = confusionMatrix
+	return report
 }
 
 func (c *classificationEvaluator) Loss() float64 {
-	return c.loss / float64(c.predictionCount)
+	return c.loss / c.totalWeight
 }
 
 func (c *classificationEvaluator) decode(modelOutput ag.Node, record *io.DataRecord) classificationPrediction {
-	class, logit := argmax(modelOutput.Value().Data())
-	className := c.model.MetaData.TargetMap.IndexToName[class]
-	label := c.model.MetaData.TargetMap.IndexToName[int(record.Target)]
+	class, _ := argmax(modelOutput.Value().Data())
+	className := c.targetMap.IndexToName[class]
+	label := c.targetMap.IndexToName[int(record.TargetValue(c.target))]
+	probabilities := softmax(modelOutput.Value().Data(), c.model.Temperature)
 	return classificationPrediction{
 		predictedClass: className,
+		predictedIndex: class,
 		label:          label,
-		labelValue:     record.Target,
+		labelValue:     record.TargetValue(c.target),
 		logits:         modelOutput.Value().Clone(),
-		maxLogit:       logit,
+		probability:    probabilities[class],
+		probabilities:  probabilities,
+	}
+}
+
+// multiLabelThreshold is the probability from which a label of a multi-label target is predicted
+const multiLabelThreshold = 0.5
+
+// multiLabelEvaluator evaluates the predictions of a multi-label target, where each label is predicted
+// independently when the sigmoid of its output reaches multiLabelThreshold
+type multiLabelEvaluator struct {
+	// totalWeight is the sum of the sample weights of the predictions, which weight each contribution to the metrics
+	totalWeight float64
+	loss        float64
+	// labelMetrics counts the decisions of each label
+	labelMetrics []*classCounts
+	// labelErrors counts the wrong label decisions, exactMatches the predictions with no wrong label decision
+	labelErrors  float64
+	exactMatches float64
+	sampleF1     float64
+	// weighted is set when the predictions are weighted by the sample weight of their record
+	weighted bool
+	// target is the index of the evaluated target, whose labels are mapped by targetMap
+	target    int
+	targetMap *model.NameMap
+	separator string
+	g         *ag.Graph
+}
+
+func newMultiLabelEvaluator(m *model.Model, target int, g *ag.Graph) *multiLabelEvaluator {
+	targetMap := m.MetaData.Targets()[target].Map
+	labelMetrics := make([]*classCounts, targetMap.Size())
+	for i := range labelMetrics {
+		labelMetrics[i] = &classCounts{}
+	}
+	return &multiLabelEvaluator{
+		labelMetrics: labelMetrics,
+		weighted:     m.MetaData.Weighted,
+		target:       target,
+		targetMap:    targetMap,
+		separator:    m.MetaData.LabelSeparator,
+		g:            g,
+	}
+}
+
+func (e *multiLabelEvaluator) Columns() []string {
+	columns := []string{"label", "predicted"}
+	for label := 0; label < e.targetMap.Size(); label++ {
+		columns = append(columns, "probability_"+e.targetMap.IndexToName[label])
 	}
+	return columns
 }
 
-func toProbability(logit mat.Float) float64 {
-	v := math.Exp(float64(logit))
-	return v / (1.0 + v)
+func (e *multiLabelEvaluator) EvaluatePrediction(node ag.Node, record *io.DataRecord) []string {
+	labels := record.MultiHotTarget(e.target)
+	probabilities := sigmoid(node.Value().Data())
+	weight := sampleWeight(e.weighted, record)
+	e.loss += weight * float64(multiLabelLoss(e.g, e.g.NewVariable(node.Value().Clone(), false), labels).ScalarValue())
+	e.totalWeight += weight
+
+	var actual, predicted []string
+	truePositives := 0
+	labelErrors := 0
+	for label, probability := range probabilities {
+		isLabel := labels.At(label, 0) == 1
+		isPredicted := probability >= multiLabelThreshold
+		metrics := e.labelMetrics[label]
+		switch {
+		case isLabel && isPredicted:
+			metrics.TruePos += weight
+			truePositives++
+		case isPredicted:
+			metrics.FalsePos += weight
+			labelErrors++
+		case isLabel:
+			metrics.FalseNeg += weight
+			labelErrors++
+		default:
+			metrics.TrueNeg += weight
+		}
+		if isLabel {
+			actual = append(actual, e.targetMap.IndexToName[label])
+		}
+		if isPredicted {
+			predicted = append(predicted, e.targetMap.IndexToName[label])
+		}
+	}
+	e.labelErrors += weight * float64(labelErrors)
+	if labelErrors == 0 {
+		e.exactMatches += weight
+	}
+	// Predicting no label for a record without labels is a perfect prediction
+	if len(actual)+len(predicted) == 0 {
+		e.sampleF1 += weight
+	} else {
+		e.sampleF1 += weight * 2 * float64(truePositives) / float64(len(actual)+len(predicted))
+	}
+
+	result := []string{strings.Join(actual, e.separator), strings.Join(predicted, e.separator)}
+	for _, p := range probabilities {
+		result = append(result, fmt.Sprintf("%.5f", p))
+	}
+	return result
+}
 
+// classMetrics returns the metrics of each label seen as label or prediction
+func (e *multiLabelEvaluator) classMetrics() map[string]*classCounts {
+	result := map[string]*classCounts{}
+	for label, metrics := range e.labelMetrics {
+		if metrics.TruePos+metrics.FalseNeg+metrics.FalsePos > 0 {
+			result[e.targetMap.IndexToName[label]] = metrics
+		}
+	}
+	return result
 }
-func testInternal(m *model.Model, dataSet *io.DataSet, outputFileName, attentionFileName string) error {
+
+func (e *multiLabelEvaluator) LogMetrics() {
+	metrics := e.classMetrics()
+	for _, label := range sortClasses(metrics) {
+		result := metrics[label]
+		log.Info().Str("Label", label).
+			Float64("TP", result.TruePos).
+			Float64("FP", result.FalsePos).
+			Float64("TN", result.TrueNeg).
+			Float64("FN", result.FalseNeg).
+			Float64("Precision", zeroIfNaN(result.Precision())).
+			Float64("Recall", zeroIfNaN(result.Recall())).
+			Float64("F1", result.F1Score()).Msg("")
+	}
+
+	summary := e.Metrics()
+	log.Info().Float64("MacroF1", summary["MacroF1"]).Float64("MicroF1", summary["MicroF1"]).
+		Float64("SampleF1", summary["SampleF1"]).
+		Float64("HammingLoss", summary["HammingLoss"]).
+		Float64("SubsetAccuracy", summary["SubsetAccuracy"]).Msg("")
+}
+
+func (e *multiLabelEvaluator) Metrics() map[string]float64 {
+	macroF1, microF1 := computeOverallF1(e.classMetrics())
+	return map[string]float64{
+		"Loss":           e.Loss(),
+		"MacroF1":        macroF1,
+		"MicroF1":        microF1,
+		"SampleF1":       e.sampleF1 / e.totalWeight,
+		"HammingLoss":    e.labelErrors / (e.totalWeight * float64(len(e.labelMetrics))),
+		"SubsetAccuracy": e.exactMatches / e.totalWeight,
+	}
+}
+
+func (e *multiLabelEvaluator) Report() metricsReport {
+	report := metricsReport{}
+	for name, value := range e.Metrics() {
+		report[name] = value
+	}
+	metrics := e.classMetrics()
+	var labels []classReport
+	for _, label := range sortClasses(metrics) {
+		result := metrics[label]
+		labels = append(labels, classReport{
+			Class:     label,
+			TP:        result.TruePos,
+			FP:        result.FalsePos,
+			TN:        result.TrueNeg,
+			FN:        result.FalseNeg,
+			Precision: zeroIfNaN(result.Precision()),
+			Recall:    zeroIfNaN(result.Recall()),
+			F1:        result.F1Score(),
+		})
+	}
+	report["Labels"] = labels
+	return report
+}
+
+func (e *multiLabelEvaluator) Loss() float64 {
+	return e.loss / e.totalWeight
+}
+
+// testInternal evaluates the model on the dataset, logging and returning the resulting metrics.
+// With attributions, the aggregate feature attributions of each prediction are written along with it.
+func testInternal(m *model.Model, dataSet *io.DataSet, outputFileName, attentionFileName string, attributions bool) (metricsReport, error) {
+	dataSet.ResetOrder(io.OriginalOrder)
+	return testBatches(m, dataSet, outputFileName, attentionFileName, attributions, true)
+}
+
+// testBatches evaluates the model on the batches of the source, as testInternal. Unless exact, the metrics that need
+// the scores of every prediction are left out, so that the memory does not grow with the source.
+func testBatches(m *model.Model, source batchSource, outputFileName, attentionFileName string, attributions, exact bool) (metricsReport, error) {
 
 	var predictionOutput gio.Writer
 	var attentionOutput gio.Writer
 
 	if outputFileName != "" {
-		outputFile, err := os.Create(outputFileName)
+		outputFile, err := createOutput(outputFileName)
 		if err != nil {
-			return fmt.Errorf("error opening output file %s: %w", outputFileName, err)
+			return nil, err
 		}
 		defer outputFile.Close()
 		predictionOutput = outputFile
@@ -177,9 +653,9 @@ func testInternal(m *model.Model, dataSet *io.DataSet, outputFileName, attention
 	}
 
 	if attentionFileName != "" {
-		attentionFile, err := os.Create(attentionFileName)
+		attentionFile, err := createOutput(attentionFileName)
 		if err != nil {
-			return fmt.Errorf("error creating attention output file %s:%w", attentionFileName, err)
+			return nil, err
 		}
 		defer attentionFile.Close()
 		attentionOutput = attentionFile
@@ -187,34 +663,175 @@ func testInternal(m *model.Model, dataSet *io.DataSet, outputFileName, attention
 		attentionOutput = NoopWriter{}
 	}
 
-	attnWriter := &attentionWriter{
-		outputWriter: attentionOutput,
-		metaData:     m.MetaData,
+	attnWriter := newAttentionWriter(attentionOutput, m)
+
+	result := evaluateBatches(m, source, &csvPredictionWriter{outputWriter: predictionOutput}, attnWriter, attributions, exact)
+	if result.numPredictions == 0 {
+		return nil, fmt.Errorf("no data to test")
 	}
+	result.evaluator.LogMetrics()
+	log.Info().Float64("Loss", result.evaluator.Loss()).
+		Float64("ReconstructionLoss", result.ReconstructionLoss).
+		Float64("SparsityLoss", result.SparsityLoss).Msg("")
 
-	lossFunc := lossFor(m.MetaData)
+	report := result.evaluator.Report()
+	report["ReconstructionLoss"] = result.ReconstructionLoss
+	report["SparsityLoss"] = result.SparsityLoss
+	return report, nil
+}
 
-	g := ag.NewGraph(ag.Rand(rand.NewLockedRand(42)),
-		ag.ConcurrentComputations(1))
+type evaluationResult struct {
+	evaluator          modelEvaluator
+	ReconstructionLoss float64
+	SparsityLoss       float64
+	numPredictions     int
+}
 
-	var evaluator modelEvaluator
-	switch m.MetaData.TargetType() {
+// newEvaluator returns the evaluator of the predictions of the model. Exact evaluators keep the scores of each
+// prediction to compute the metrics that need all of them, such as the AUCs and the median absolute error.
+func newEvaluator(m *model.Model, g *ag.Graph, exact bool) modelEvaluator {
+	if m.MetaData.IsMultiTarget() {
+		return newMultiTargetEvaluator(m, g, exact)
+	}
+	return newTargetEvaluator(m, 0, g, exact)
+}
+
+// newTargetEvaluator returns the evaluator of the predictions of the target with the given index
+func newTargetEvaluator(m *model.Model, target int, g *ag.Graph, exact bool) modelEvaluator {
+	t := m.MetaData.Targets()[target]
+	switch m.MetaData.Columns[t.Column].Type {
 	case model.Categorical:
-		evaluator = &classificationEvaluator{
-			metrics:  map[string]*stats.ClassMetrics{},
-			model:    m,
-			lossFunc: lossFunc,
-			g:        g,
-		}
+		return newClassificationEvaluator(m, target, lossFor(m.MetaData, t), g, exact)
+	case model.MultiLabel:
+		return newMultiLabelEvaluator(m, target, g)
 	default:
-		evaluator = &regressionEvaluator{
-			lossFunc:     lossFunc,
-			g:            g,
-			targetColumn: m.MetaData.Columns[m.MetaData.TargetColumn],
+		evaluator := &regressionEvaluator{
+			lossFunc:       lossFor(m.MetaData, t),
+			weighted:       m.MetaData.Weighted,
+			regressionLoss: m.MetaData.RegressionLoss,
+			g:              g,
+			target:         target,
+			targetColumn:   m.MetaData.Columns[t.Column],
+			exact:          exact,
+		}
+		if len(m.MetaData.RegressionLoss.Quantiles) > 0 {
+			return newQuantileEvaluator(evaluator)
 		}
+		return evaluator
+	}
+}
+
+// multiTargetEvaluator evaluates the predictions of each target of a multi-target model with its own evaluator.
+// Its columns and metrics are prefixed by the name of the target, and its loss is the weighted sum of
+// the loss of each target.
+type multiTargetEvaluator struct {
+	model      *model.Model
+	names      []string
+	evaluators []modelEvaluator
+	g          *ag.Graph
+}
+
+func newMultiTargetEvaluator(m *model.Model, g *ag.Graph, exact bool) *multiTargetEvaluator {
+	result := &multiTargetEvaluator{
+		model: m,
+		names: targetColumnNames(m.MetaData),
+		g:     g,
+	}
+	for target := range result.names {
+		result.evaluators = append(result.evaluators, newTargetEvaluator(m, target, g, exact))
+	}
+	return result
+}
+
+func (e *multiTargetEvaluator) Columns() []string {
+	var columns []string
+	for i, evaluator := range e.evaluators {
+		for _, column := range evaluator.Columns() {
+			columns = append(columns, e.names[i]+"_"+column)
+		}
+	}
+	return columns
+}
+
+func (e *multiTargetEvaluator) EvaluatePrediction(prediction ag.Node, record *io.DataRecord) []string {
+	var result []string
+	for i, output := range targetOutputs(e.g, e.model.MetaData, prediction) {
+		result = append(result, e.evaluators[i].EvaluatePrediction(output, record)...)
+	}
+	return result
+}
+
+func (e *multiTargetEvaluator) LogMetrics() {
+	for i, evaluator := range e.evaluators {
+		log.Info().Str("Target", e.names[i]).Float64("Loss", evaluator.Loss()).Msg("Target metrics")
+		evaluator.LogMetrics()
+	}
+}
+
+func (e *multiTargetEvaluator) Loss() float64 {
+	loss := 0.0
+	for i, evaluator := range e.evaluators {
+		loss += e.model.TabNet.TargetWeight(i) * evaluator.Loss()
+	}
+	return loss
+}
+
+// Metrics returns the metrics of each target, named <target>.<metric>, along with the overall loss
+func (e *multiTargetEvaluator) Metrics() map[string]float64 {
+	result := map[string]float64{"Loss": e.Loss()}
+	for i, evaluator := range e.evaluators {
+		for name, value := range evaluator.Metrics() {
+			result[e.names[i]+"."+name] = value
+		}
+	}
+	return result
+}
+
+// Report returns the overall loss and the report of each target by target name
+func (e *multiTargetEvaluator) Report() metricsReport {
+	targets := map[string]metricsReport{}
+	for i, evaluator := range e.evaluators {
+		targets[e.names[i]] = evaluator.Report()
 	}
+	return metricsReport{
+		"Loss":    e.Loss(),
+		"Targets": targets,
+	}
+}
+
+// predictionWriter receives the evaluated predictions of a dataset
+type predictionWriter interface {
+	writeHeader(columns []string)
+	writePrediction(record *io.DataRecord, values []string)
+}
+
+// csvPredictionWriter writes each prediction as a CSV line
+type csvPredictionWriter struct {
+	outputWriter gio.Writer
+}
+
+func (w *csvPredictionWriter) writeHeader(columns []string) {
+	fmt.Fprintf(w.outputWriter, "%s\n", strings.Join(columns, ","))
+}
+
+func (w *csvPredictionWriter) writePrediction(record *io.DataRecord, values []string) {
+	fmt.Fprintf(w.outputWriter, "%s\n", strings.Join(values, ","))
+}
 
+// evaluate runs the model on every record of the dataset, writing predictions and attention maps
+// to the provided writers. With attributions, the aggregate feature attributions of each prediction are appended to it.
+func evaluate(m *model.Model, dataSet *io.DataSet, predWriter predictionWriter, attnWriter *attentionWriter, attributions bool) evaluationResult {
 	dataSet.ResetOrder(io.OriginalOrder)
+	return evaluateBatches(m, dataSet, predWriter, attnWriter, attributions, true)
+}
+
+// evaluateBatches runs the model on every batch of the source, as evaluate, with an exact evaluator if requested
+func evaluateBatches(m *model.Model, source batchSource, predWriter predictionWriter, attnWriter *attentionWriter, attributions, exact bool) evaluationResult {
+	g := ag.NewGraph(ag.Rand(rand.NewLockedRand(42)),
+		ag.ConcurrentComputations(1))
+
+	evaluator := newEvaluator(m, g, exact)
+
 	ctx := nn.Context{Graph: g, Mode: nn.Inference}
 	proc := nn.Reify(ctx, m.TabNet).(*model.TabNet)
 	recLoss := 0.0
@@ -223,22 +840,28 @@ func testInternal(m *model.Model, dataSet *io.DataSet, outputFileName, attention
 
 	outputColumns := evaluator.Columns()
 	outputColumns = append(outputColumns, "reconstructionLoss")
-	for i := 0; i < len(outputColumns)-1; i++ {
-		fmt.Fprintf(predictionOutput, "%s,", outputColumns[i])
+	aggregator := newMaskAggregator(m)
+	if attributions {
+		for _, column := range m.MetaData.FeatureColumns() {
+			outputColumns = append(outputColumns, "attribution_"+m.MetaData.Columns[column].Name)
+		}
 	}
-	fmt.Fprintf(predictionOutput, "%s\n", outputColumns[len(outputColumns)-1])
+	predWriter.writeHeader(outputColumns)
 
-	for d := dataSet.Next(); len(d) > 0; d = dataSet.Next() {
+	for d := source.Next(); len(d) > 0; d = source.Next() {
 		normalizedInput, output := predict(g, proc, d)
 		for i, prediction := range output.Output {
 			evalOutput := evaluator.EvaluatePrediction(prediction, d[i])
 			attnWriter.writeStepAttentionMap(output.AttentionMasks[i])
 			predReconstructionLoss := float64(reconstructionLoss(g, normalizedInput[i], output.DecoderOutput[i]).ScalarValue())
 
-			for _, v := range evalOutput {
-				fmt.Fprintf(predictionOutput, "%s,", v)
+			evalOutput = append(evalOutput, fmt.Sprintf("%f", predReconstructionLoss))
+			if attributions {
+				for _, attribution := range aggregator.attributions(output.AttentionMasks[i], output.DecisionContributions[i]) {
+					evalOutput = append(evalOutput, fmt.Sprintf("%f", attribution))
+				}
 			}
-			fmt.Fprintf(predictionOutput, "%f\n", predReconstructionLoss)
+			predWriter.writePrediction(d[i], evalOutput)
 
 			recLoss = recLoss + predReconstructionLoss
 			sparsityLoss = sparsityLoss + float64(output.AttentionEntropy[i].ScalarValue())
@@ -246,35 +869,34 @@ func testInternal(m *model.Model, dataSet *io.DataSet, outputFileName, attention
 		}
 		g.Clear()
 	}
-	evaluator.LogMetrics()
-	recLoss = recLoss / float64(numPredictions)
-	sparsityLoss = sparsityLoss / float64(numPredictions)
-	log.Info().Float64("Loss", evaluator.Loss()).
-		Float64("ReconstructionLoss", recLoss).
-		Float64("SparsityLoss", sparsityLoss).Msg("")
-
-	return nil
+	return evaluationResult{
+		evaluator:          evaluator,
+		ReconstructionLoss: recLoss / float64(numPredictions),
+		SparsityLoss:       sparsityLoss / float64(numPredictions),
+		numPredictions:     numPredictions,
+	}
 }
 
-func computeOverallF1(metrics map[string]*stats.ClassMetrics) (float64, float64) {
+// computeOverallF1 returns the macro and micro averaged F1 scores
+func computeOverallF1(metrics map[string]*classCounts) (float64, float64) {
 	macroF1 := 0.0
 	for _, metric := range metrics {
-		macroF1 += float64(metric.F1Score())
+		macroF1 += metric.F1Score()
 	}
 	macroF1 /= float64(len(metrics))
 
-	micro := stats.NewMetricCounter()
+	micro := &classCounts{}
 	for _, result := range metrics {
 		micro.TruePos += result.TruePos
 		micro.FalsePos += result.FalsePos
 		micro.FalseNeg += result.FalseNeg
 		micro.TrueNeg += result.TrueNeg
 	}
-	return macroF1, float64(micro.F1Score())
+	return macroF1, micro.F1Score()
 
 }
 
-func sortClasses(metrics map[string]*stats.ClassMetrics) []string {
+func sortClasses(metrics map[string]*classCounts) []string {
 	result := make([]string, 0, len(metrics))
 	for class := range metrics {
 		result = append(result, class)
@@ -284,13 +906,33 @@ func sortClasses(metrics map[string]*stats.ClassMetrics) []string {
 }
 
 type regressionEvaluator struct {
-	loss            mat.Float
-	predictionCount int
-	estimated       []mat.Float
-	values          []mat.Float
-	lossFunc        lossFunc
-	g               *ag.Graph
-	targetColumn    *model.Column
+	loss float64
+	// totalWeight is the sum of the sample weights of the predictions, which weight each contribution to the metrics
+	totalWeight float64
+	// absoluteError, squaredError and percentageError are the weighted sums of the errors of the predictions, in
+	// the original units of the target. The percentage error is summed over the nonZeroWeight of the nonzero labels.
+	absoluteError   float64
+	squaredError    float64
+	percentageError float64
+	nonZeroWeight   float64
+	// labels and residuals accumulate the moments of the labels and of the residuals, in the original units
+	labels    weightedMoments
+	residuals weightedMoments
+	// exact keeps the estimated and the actual standardized target of each prediction in estimated and values,
+	// along with its sample weight in weights, from which the median absolute error and the residuals by decile
+	// are computed. They grow with the evaluated records, so these metrics are left out otherwise.
+	exact     bool
+	estimated []mat.Float
+	values    []mat.Float
+	weights   []float64
+	weighted  bool
+	lossFunc  lossFunc
+	// regressionLoss converts the outputs of the model to predictions of the standardized target
+	regressionLoss model.RegressionLoss
+	g              *ag.Graph
+	// target is the index of the evaluated target, whose statistics are held by targetColumn
+	target       int
+	targetColumn *model.Column
 }
 
 func (r *regressionEvaluator) Columns() []string {
@@ -301,32 +943,264 @@ func (r *regressionEvaluator) originalTargetValue(v mat.Float) float64 {
 
 }
 func (r *regressionEvaluator) EvaluatePrediction(prediction ag.Node, record *io.DataRecord) []string {
+	estimated := mat.Float(r.regressionLoss.InverseLink(float64(prediction.ScalarValue())))
+	target, _ := r.add(prediction, estimated, record)
+	return []string{fmt.Sprintf("%f", r.originalTargetValue(target)), fmt.Sprintf("%f", r.originalTargetValue(estimated))}
+}
 
-	result := []string{fmt.Sprintf("%f", r.originalTargetValue(record.Target)), fmt.Sprintf("%f", r.originalTargetValue(prediction.ScalarValue()))}
-
-	r.estimated = append(r.estimated, prediction.ScalarValue())
-	r.values = append(r.values, record.Target)
-	r.loss += r.lossFunc(r.g, prediction, record.Target).ScalarValue()
-	r.predictionCount++
+// add records the estimate of the standardized target of the record made from the prediction of the model,
+// returning the target and the sample weight of the record
+func (r *regressionEvaluator) add(prediction ag.Node, estimated mat.Float, record *io.DataRecord) (mat.Float, float64) {
+	target := record.TargetValue(r.target)
+	weight := sampleWeight(r.weighted, record)
+	if r.exact {
+		r.estimated = append(r.estimated, estimated)
+		r.values = append(r.values, target)
+		r.weights = append(r.weights, weight)
+	}
+	r.loss += weight * float64(r.lossFunc(r.g, prediction, target).ScalarValue())
+	r.totalWeight += weight
 
-	return result
+	value := r.originalTargetValue(target)
+	residual := value - r.originalTargetValue(estimated)
+	r.absoluteError += weight * math.Abs(residual)
+	r.squaredError += weight * residual * residual
+	if value != 0 {
+		r.percentageError += weight * math.Abs(residual) / math.Abs(value)
+		r.nonZeroWeight += weight
+	}
+	r.labels.add(value, weight)
+	r.residuals.add(residual, weight)
+	return target, weight
 }
 
 func (r *regressionEvaluator) LogMetrics() {
+	metrics := r.Metrics()
+	event := log.Info().Float64("R-squared", metrics["R-squared"]).
+		Float64("MAE", metrics["MAE"]).
+		Float64("RMSE", metrics["RMSE"]).
+		Float64("MAPE", metrics["MAPE"])
+	if r.exact {
+		event = event.Float64("MedianAE", metrics["MedianAE"])
+	}
+	event.Float64("ExplainedVariance", metrics["ExplainedVariance"]).Msg("")
+	for _, decile := range r.residualsByDecile() {
+		log.Debug().Int("Decile", decile.Decile).
+			Int("Count", decile.Count).
+			Float64("MeanPrediction", decile.MeanPrediction).
+			Float64("MeanLabel", decile.MeanLabel).
+			Float64("MeanResidual", decile.MeanResidual).
+			Float64("MAE", decile.MAE).Msg("Residuals")
+	}
+}
+
+// originalValues returns the predictions and labels in the original units of the target
+func (r *regressionEvaluator) originalValues() ([]float64, []float64) {
 	estimated := make([]float64, len(r.estimated))
 	values := make([]float64, len(r.values))
 	for i := range r.estimated {
-		estimated[i] = float64(r.estimated[i])
+		estimated[i] = r.originalTargetValue(r.estimated[i])
 	}
 	for i := range r.values {
-		values[i] = float64(r.values[i])
+		values[i] = r.originalTargetValue(r.values[i])
+	}
+	return estimated, values
+}
+
+// Metrics returns the regression metrics. Except for the loss, they are computed in the original units of the target.
+func (r *regressionEvaluator) Metrics() map[string]float64 {
+	mape := 0.0
+	if r.nonZeroWeight > 0 {
+		mape = 100 * r.percentageError / r.nonZeroWeight
+	}
+
+	metrics := map[string]float64{
+		"Loss":              r.Loss(),
+		"R-squared":         1 - r.squaredError/r.labels.squaredDeviations,
+		"MAE":               r.absoluteError / r.totalWeight,
+		"RMSE":              math.Sqrt(r.squaredError / r.totalWeight),
+		"MAPE":              mape,
+		"ExplainedVariance": 1 - r.residuals.squaredDeviations/r.labels.squaredDeviations,
+	}
+	if r.exact {
+		estimated, values := r.originalValues()
+		absoluteErrors := make([]float64, len(values))
+		for i := range values {
+			absoluteErrors[i] = math.Abs(values[i] - estimated[i])
+		}
+		metrics["MedianAE"] = weightedMedian(absoluteErrors, r.weights)
+	}
+	return metrics
+}
+
+type residualDecile struct {
+	Decile         int
+	Count          int
+	MeanPrediction float64
+	MeanLabel      float64
+	MeanResidual   float64
+	MAE            float64
+}
+
+// residualsByDecile summarizes the residuals of the predictions grouped by decile of the predicted value.
+// Deciles hold the same number of predictions, whose means are weighted by their sample weight.
+func (r *regressionEvaluator) residualsByDecile() []residualDecile {
+	estimated, values := r.originalValues()
+	order := make([]int, len(estimated))
+	for i := range order {
+		order[i] = i
 	}
-	r2 := stat.RSquaredFrom(estimated, values, nil)
-	log.Info().Float64("R-squared", r2).Msg("")
+	sort.SliceStable(order, func(i, j int) bool {
+		return estimated[order[i]] < estimated[order[j]]
+	})
+
+	var result []residualDecile
+	for decile := 0; decile < 10; decile++ {
+		start := decile * len(order) / 10
+		end := (decile + 1) * len(order) / 10
+		if start == end {
+			continue
+		}
+		d := residualDecile{Decile: decile + 1, Count: end - start}
+		weight := 0.0
+		for _, i := range order[start:end] {
+			residual := values[i] - estimated[i]
+			d.MeanPrediction += r.weights[i] * estimated[i]
+			d.MeanLabel += r.weights[i] * values[i]
+			d.MeanResidual += r.weights[i] * residual
+			d.MAE += r.weights[i] * math.Abs(residual)
+			weight += r.weights[i]
+		}
+		if weight == 0 {
+			continue
+		}
+		d.MeanPrediction /= weight
+		d.MeanLabel /= weight
+		d.MeanResidual /= weight
+		d.MAE /= weight
+		result = append(result, d)
+	}
+	return result
+}
+
+func (r *regressionEvaluator) Report() metricsReport {
+	report := metricsReport{}
+	for name, value := range r.Metrics() {
+		report[name] = value
+	}
+	if r.exact {
+		report["ResidualsByDecile"] = r.residualsByDecile()
+	}
+	return report
 }
 
 func (r *regressionEvaluator) Loss() float64 {
-	return float64(r.loss) / float64(r.predictionCount)
+	return r.loss / r.totalWeight
+}
+
+// quantileEvaluator evaluates the predictions of several quantiles of a continuous target. The median is evaluated
+// as the prediction of the target by the regression metrics, and the lowest and highest quantiles as the bounds of
+// a prediction interval.
+type quantileEvaluator struct {
+	*regressionEvaluator
+	// covered is the weight of the labels within their prediction interval
+	covered float64
+	// width is the weighted sum of the widths of the prediction intervals, in the original units of the target
+	width float64
+	// below holds the weight of the labels below the prediction of each quantile
+	below []float64
+}
+
+// quantileCalibration is the fraction of the labels below the predictions of a quantile, which is
+// the quantile itself for calibrated predictions
+type quantileCalibration struct {
+	Quantile      float64
+	FractionBelow float64
+}
+
+func newQuantileEvaluator(r *regressionEvaluator) *quantileEvaluator {
+	return &quantileEvaluator{
+		regressionEvaluator: r,
+		below:               make([]float64, len(r.regressionLoss.Quantiles)),
+	}
+}
+
+func (q *quantileEvaluator) Columns() []string {
+	return []string{"label", "lower", "median", "upper"}
+}
+
+func (q *quantileEvaluator) EvaluatePrediction(prediction ag.Node, record *io.DataRecord) []string {
+	quantiles := q.regressionLoss.QuantileValues(prediction.Value().Data())
+	median := mat.Float(quantiles[q.regressionLoss.MedianIndex()])
+	target, weight := q.add(prediction, median, record)
+	for i, quantile := range quantiles {
+		if float64(target) <= quantile {
+			q.below[i] += weight
+		}
+	}
+	lower := mat.Float(quantiles[0])
+	upper := mat.Float(quantiles[len(quantiles)-1])
+	if target >= lower && target <= upper {
+		q.covered += weight
+	}
+	q.width += weight * (q.originalTargetValue(upper) - q.originalTargetValue(lower))
+
+	return []string{
+		fmt.Sprintf("%f", q.originalTargetValue(target)),
+		fmt.Sprintf("%f", q.originalTargetValue(lower)),
+		fmt.Sprintf("%f", q.originalTargetValue(median)),
+		fmt.Sprintf("%f", q.originalTargetValue(upper)),
+	}
+}
+
+// intervalMetrics returns the fraction of the labels within their prediction interval, the fraction expected
+// from the quantiles bounding the intervals, and the mean width of the intervals
+func (q *quantileEvaluator) intervalMetrics() map[string]float64 {
+	quantiles := q.regressionLoss.Quantiles
+	total := q.totalWeight
+	return map[string]float64{
+		"Coverage":          q.covered / total,
+		"ExpectedCoverage":  quantiles[len(quantiles)-1] - quantiles[0],
+		"MeanIntervalWidth": q.width / total,
+	}
+}
+
+func (q *quantileEvaluator) calibration() []quantileCalibration {
+	total := q.totalWeight
+	result := make([]quantileCalibration, len(q.below))
+	for i, quantile := range q.regressionLoss.Quantiles {
+		result[i] = quantileCalibration{Quantile: quantile, FractionBelow: q.below[i] / total}
+	}
+	return result
+}
+
+func (q *quantileEvaluator) Metrics() map[string]float64 {
+	metrics := q.regressionEvaluator.Metrics()
+	for name, value := range q.intervalMetrics() {
+		metrics[name] = value
+	}
+	return metrics
+}
+
+func (q *quantileEvaluator) LogMetrics() {
+	q.regressionEvaluator.LogMetrics()
+	metrics := q.intervalMetrics()
+	log.Info().Float64("Coverage", metrics["Coverage"]).
+		Float64("ExpectedCoverage", metrics["ExpectedCoverage"]).
+		Float64("MeanIntervalWidth", metrics["MeanIntervalWidth"]).Msg("")
+	for _, c := range q.calibration() {
+		log.Debug().Float64("Quantile", c.Quantile).
+			Float64("FractionBelow", c.FractionBelow).Msg("Calibration")
+	}
+}
+
+func (q *quantileEvaluator) Report() metricsReport {
+	report := q.regressionEvaluator.Report()
+	for name, value := range q.intervalMetrics() {
+		report[name] = value
+	}
+	report["QuantileCalibration"] = q.calibration()
+	return report
 }
 
 func predict(g *ag.Graph, m *model.TabNet, data io.DataBatch) ([]ag.Node, *model.TabNetOutput) {
@@ -338,7 +1212,38 @@ type attentionWriter struct {
 	outputWriter gio.Writer
 	line         int
 	wroteHeader  bool
-	metaData     *model.Metadata
+	// columns holds the name of each element of the model input
+	columns []string
+}
+
+func newAttentionWriter(outputWriter gio.Writer, m *model.Model) *attentionWriter {
+	return &attentionWriter{
+		outputWriter: outputWriter,
+		columns:      inputColumnNames(m),
+	}
+}
+
+// inputColumnNames returns a name for each element of the model input, derived from the name of its data column.
+// Missing value indicators are suffixed with "_missing", and each dimension of a categorical embedding
+// is suffixed with its index when embeddings have more than one dimension.
+func inputColumnNames(m *model.Model) []string {
+	embeddingDimension := m.TabNet.CategoricalEmbeddingDimension
+	inputColumns := m.MetaData.InputColumns(embeddingDimension)
+	names := make([]string, len(inputColumns))
+	for i, column := range inputColumns {
+		names[i] = m.MetaData.Columns[column].Name
+	}
+	if m.MetaData.MissingIndicatorsMap != nil {
+		for index := range m.MetaData.MissingIndicatorsMap.IndexToColumn {
+			names[index] += "_missing"
+		}
+	}
+	if embeddingDimension > 1 {
+		for i := m.MetaData.ContinuousFeatureCount(); i < len(names); i++ {
+			names[i] = fmt.Sprintf("%s_%d", names[i], (i-m.MetaData.ContinuousFeatureCount())%embeddingDimension)
+		}
+	}
+	return names
 }
 
 func (w *attentionWriter) writeStepAttentionMap(att model.AttentionMask) {
@@ -361,20 +1266,20 @@ func (w *attentionWriter) writeHeader() {
 	if w.wroteHeader {
 		return
 	}
-	fmt.Fprintf(w.outputWriter, "line,step,")
-	for i := range w.metaData.Columns {
-		if i != w.metaData.TargetColumn {
-			fmt.Fprintf(w.outputWriter, "%s", w.metaData.Columns[i].Name)
-			if i < len(w.metaData.Columns)-2 {
-				fmt.Fprintf(w.outputWriter, ",")
-			}
-		}
-	}
-	fmt.Fprintf(w.outputWriter, "\n")
+	fmt.Fprintf(w.outputWriter, "line,step,%s\n", strings.Join(w.columns, ","))
 	w.wroteHeader = true
 
 }
 
+// sigmoid returns the probability of each label for the logits
+func sigmoid(logits []mat.Float) []float64 {
+	result := make([]float64, len(logits))
+	for i, logit := range logits {
+		result[i] = 1 / (1 + math.Exp(-float64(logit)))
+	}
+	return result
+}
+
 func argmax(data []mat.Float) (int, mat.Float) {
 	maxInd := 0
 	for i := range data {
@@ -1,7 +1,13 @@
 package pkg
 
 import (
+	"bytes"
+	"fmt"
+	"math"
 	mathrand "math/rand"
+	"sort"
+	"strconv"
+	"strings"
 
 	mat "github.com/nlpodyssey/spago/pkg/mat32"
 
@@ -9,6 +15,7 @@ import (
 	"golem/pkg/model"
 
 	"github.com/rs/zerolog/log"
+	"gonum.org/v1/gonum/stat/distuv"
 
 	"os"
 
@@ -17,7 +24,6 @@ import (
 	"github.com/nlpodyssey/spago/pkg/ml/losses"
 	"github.com/nlpodyssey/spago/pkg/ml/nn"
 	"github.com/nlpodyssey/spago/pkg/ml/optimizers/gd"
-	"github.com/nlpodyssey/spago/pkg/ml/optimizers/gd/adam"
 )
 
 type TrainingParameters struct {
@@ -27,7 +33,92 @@ type TrainingParameters struct {
 	ReportInterval     int
 	RndSeed            uint64
 	CategoricalColumns []string
+	// MultiLabelColumns holds the names of the multi-label target columns
+	MultiLabelColumns []string
+	// LabelSeparator separates the labels of multi-label targets
+	LabelSeparator     string
 	InputDropout       float64
+	MissingValues      []string
+	Imputation         string
+	ImputationConstant float64
+	MissingIndicators  bool
+
+	MinCategoryFrequency       int
+	RareCategoryFrequency      int
+	UnknownCategoryProbability float64
+
+	// ValidationSplit is the fraction of the training data held out for validation. Without it, the test file is
+	// used for validation.
+	ValidationSplit float64
+	// Patience is the number of epochs without validation loss improvement before training stops.
+	// Zero disables early stopping.
+	Patience int
+	// Calibrate fits the temperature of classification models on the validation data
+	Calibrate bool
+	// PretrainedModel is the file name of a pretrained model used to initialize the encoder before training
+	PretrainedModel string
+	// TargetWeights holds the weight of the loss of each target of multi-target models, in the order of the
+	// target columns. All targets have the same weight when empty.
+	TargetWeights []float64
+	// WeightColumn is the name of the column holding the sample weight of each row, which scales its loss.
+	// Rows are not weighted when it is empty.
+	WeightColumn string
+	// ClassWeights holds the weight of the classes of the first target in the loss, as class=weight pairs,
+	// or "balanced" to weight each class inversely to its frequency. Classes are not weighted when it is empty.
+	ClassWeights []string
+	// Loss is the name of the loss of continuous targets: mse, huber, quantile, poisson or tweedie
+	Loss string
+	// HuberDelta is the residual, in standardized units of the target, from which the Huber loss is linear
+	HuberDelta float64
+	// Quantile is the quantile of the target predicted with the quantile loss
+	Quantile float64
+	// Quantiles holds the quantiles of the target predicted together with the quantile loss, which must include
+	// the median. Only Quantile is predicted when it is empty.
+	Quantiles []float64
+	// TweediePower is the power of the Tweedie deviance, between 1 and 2
+	TweediePower float64
+	// LearningRateSchedule is the name of the schedule of the learning rate: constant, step, exponential, cosine
+	// or onecycle
+	LearningRateSchedule string
+	// LearningRateDecay multiplies the learning rate every LearningRateDecayEpochs epochs with the step schedule,
+	// and every epoch with the exponential schedule
+	LearningRateDecay       float64
+	LearningRateDecayEpochs int
+	// CycleEpochs is the number of epochs of the first cycle of the cosine schedule, or zero for a single cycle
+	// over all the epochs
+	CycleEpochs float64
+	// CycleMultiplier scales the number of epochs of each cycle of the cosine schedule from the previous cycle
+	CycleMultiplier float64
+	// MinLearningRate is the learning rate at the end of the cycles of the cosine and one-cycle schedules
+	MinLearningRate float64
+	// WarmupEpochs is the number of epochs over which the learning rate increases linearly from zero at the start
+	// of training. There is no warmup when it is zero.
+	WarmupEpochs float64
+	// Optimizer is the name of the gradient descent method: adam, radam, sgd, rmsprop or adagrad
+	Optimizer string
+	// Beta1 and Beta2 are the decay rates of the moment estimates of adam and radam
+	Beta1 float64
+	Beta2 float64
+	// Epsilon is added to the denominator of the updates of adam, radam, rmsprop and adagrad for numerical stability
+	Epsilon float64
+	// Momentum is the momentum of sgd, which is Nesterov momentum when Nesterov is set
+	Momentum float64
+	Nesterov bool
+	// RMSPropDecay is the decay rate of the average of the squared gradients of rmsprop
+	RMSPropDecay float64
+	// WeightDecay shrinks the parameters after each update by their product with the weight decay and the learning
+	// rate, decoupled from the gradients
+	WeightDecay float64
+	// L2Regularization is the weight of the L2 regularization of the parameters in the loss
+	L2Regularization float64
+	// ClipValue is the maximum absolute value of the gradients, or zero for no clipping by value
+	ClipValue float64
+	// ClipNorm is the maximum L2 norm of all the gradients together, which replaces the clipping by value when
+	// it is not zero
+	ClipNorm float64
+	// Workers is the number of goroutines training each batch concurrently, each on a shard of the batch.
+	// Training is reproducible for a given random seed and number of workers.
+	Workers int
 }
 
 type lossFunc func(g *ag.Graph, prediction ag.Node, target mat.Float) ag.Node
@@ -36,10 +127,119 @@ func crossEntropyLoss(g *ag.Graph, prediction ag.Node, target mat.Float) ag.Node
 	return losses.CrossEntropy(g, prediction, int(target))
 }
 
+// weightedCrossEntropyLoss returns the cross-entropy loss scaled by the weight of the target class
+func weightedCrossEntropyLoss(classWeights []float64) lossFunc {
+	return func(g *ag.Graph, prediction ag.Node, target mat.Float) ag.Node {
+		return g.Mul(crossEntropyLoss(g, prediction, target), g.Constant(mat.Float(classWeights[int(target)])))
+	}
+}
+
 func mseLoss(g *ag.Graph, prediction ag.Node, target mat.Float) ag.Node {
 	return losses.MSE(g, prediction, g.NewScalar(target), false)
 }
 
+// huberLoss returns the smooth L1 loss, which is half the squared residual up to delta, as mseLoss,
+// and grows linearly beyond
+func huberLoss(delta float64) lossFunc {
+	return func(g *ag.Graph, prediction ag.Node, target mat.Float) ag.Node {
+		residual := g.SubScalar(prediction, g.NewScalar(target))
+		if math.Abs(float64(residual.ScalarValue())) <= delta {
+			return g.ProdScalar(g.Prod(residual, residual), g.Constant(0.5))
+		}
+		return g.SubScalar(g.ProdScalar(g.Abs(residual), g.Constant(mat.Float(delta))), g.Constant(mat.Float(delta*delta/2)))
+	}
+}
+
+// quantileLoss returns the pinball loss of the prediction of the quantile, which weights the residuals
+// of targets above the prediction by quantile, and the others by 1 - quantile
+func quantileLoss(quantile float64) lossFunc {
+	return func(g *ag.Graph, prediction ag.Node, target mat.Float) ag.Node {
+		residual := g.Neg(g.SubScalar(prediction, g.NewScalar(target)))
+		under := g.ProdScalar(g.ReLU(residual), g.Constant(mat.Float(quantile)))
+		over := g.ProdScalar(g.ReLU(g.Neg(residual)), g.Constant(mat.Float(1-quantile)))
+		return g.Add(under, over)
+	}
+}
+
+// multiQuantileLoss returns the mean of the pinball loss of each quantile, predicted by the outputs of the target
+// as given by quantileNodes
+func multiQuantileLoss(quantiles []float64) lossFunc {
+	return func(g *ag.Graph, prediction ag.Node, target mat.Float) ag.Node {
+		var loss ag.Node
+		for i, value := range quantileNodes(g, prediction, len(quantiles)) {
+			loss = g.Add(loss, quantileLoss(quantiles[i])(g, value, target))
+		}
+		return g.DivScalar(loss, g.Constant(mat.Float(len(quantiles))))
+	}
+}
+
+// quantileNodes converts the outputs of a continuous target to the predicted quantiles, as done by
+// RegressionLoss.QuantileValues
+func quantileNodes(g *ag.Graph, prediction ag.Node, count int) []ag.Node {
+	result := make([]ag.Node, count)
+	result[0] = g.AtVec(prediction, 0)
+	for i := 1; i < count; i++ {
+		gap := g.SoftPlus(g.AtVec(prediction, i), g.Constant(1), g.Constant(model.SoftplusThreshold))
+		result[i] = g.Add(result[i-1], gap)
+	}
+	return result
+}
+
+// poissonLoss is the Poisson deviance 2 * (y * log(y / mu) - y + mu) of the prediction mu = exp(x)
+func poissonLoss(g *ag.Graph, prediction ag.Node, target mat.Float) ag.Node {
+	y := float64(target)
+	constant := -y
+	if y > 0 {
+		constant += y * math.Log(y)
+	}
+	loss := g.Sub(g.Exp(prediction), g.ProdScalar(prediction, g.Constant(target)))
+	return g.ProdScalar(g.AddScalar(loss, g.Constant(mat.Float(constant))), g.Constant(2))
+}
+
+// tweedieLoss returns the Tweedie deviance with the power, between 1 and 2, of the prediction mu = exp(x):
+// 2 * (y^(2-p) / ((1-p) * (2-p)) - y * mu^(1-p) / (1-p) + mu^(2-p) / (2-p))
+func tweedieLoss(power float64) lossFunc {
+	return func(g *ag.Graph, prediction ag.Node, target mat.Float) ag.Node {
+		y := float64(target)
+		constant := math.Pow(y, 2-power) / ((1 - power) * (2 - power))
+		first := g.ProdScalar(g.Exp(g.ProdScalar(prediction, g.Constant(mat.Float(1-power)))), g.Constant(mat.Float(-y/(1-power))))
+		second := g.ProdScalar(g.Exp(g.ProdScalar(prediction, g.Constant(mat.Float(2-power)))), g.Constant(mat.Float(1/(2-power))))
+		loss := g.AddScalar(g.Add(first, second), g.Constant(mat.Float(constant)))
+		return g.ProdScalar(loss, g.Constant(2))
+	}
+}
+
+// regressionLossFunc returns the loss function of continuous targets
+func regressionLossFunc(loss model.RegressionLoss) lossFunc {
+	switch loss.Function {
+	case model.HuberLoss:
+		return huberLoss(loss.HuberDelta)
+	case model.QuantileLoss:
+		if len(loss.Quantiles) > 0 {
+			return multiQuantileLoss(loss.Quantiles)
+		}
+		return quantileLoss(loss.Quantile)
+	case model.PoissonLoss:
+		return poissonLoss
+	case model.TweedieLoss:
+		return tweedieLoss(loss.TweediePower)
+	default:
+		return mseLoss
+	}
+}
+
+// multiLabelLoss is the mean over the labels of the binary cross-entropy of the sigmoid of the prediction,
+// computed as max(x, 0) - x*y + log(1 + exp(-|x|)) for numerical stability
+func multiLabelLoss(g *ag.Graph, prediction ag.Node, labels mat.Matrix) ag.Node {
+	y := g.NewVariable(labels, false)
+	loss := g.Sub(g.ReLU(prediction), g.Prod(prediction, y))
+	loss = g.Add(loss, g.Log(g.AddScalar(g.Exp(g.Neg(g.Abs(prediction))), g.NewScalar(1))))
+	return g.ReduceMean(loss)
+}
+
+// targetLossFunc returns the loss of the prediction of the model for a target of the record
+type targetLossFunc func(g *ag.Graph, prediction ag.Node, record *io.DataRecord) ag.Node
+
 type dataPreProcessor interface {
 	process(g *ag.Graph, input []ag.Node) []ag.Node
 }
@@ -85,85 +285,513 @@ func (d *inputDropoutPreprocessor) process(g *ag.Graph, input []ag.Node) []ag.No
 	return result
 }
 
-func lossFor(metadata *model.Metadata) lossFunc {
+func lossFor(metadata *model.Metadata, target *model.Target) lossFunc {
 
-	switch metadata.TargetType() {
+	targetType := metadata.Columns[target.Column].Type
+	switch targetType {
 	case model.Continuous:
-		return mseLoss
+		return regressionLossFunc(metadata.RegressionLoss)
 	case model.Categorical:
+		if target.Column == metadata.TargetColumn && len(metadata.ClassWeights) > 0 {
+			return weightedCrossEntropyLoss(metadata.ClassWeights)
+		}
 		return crossEntropyLoss
 	default:
-		log.Panic().Msgf("unsupported model type received: %d", metadata.TargetType())
+		log.Panic().Msgf("unsupported model type received: %d", targetType)
 		return nil
 	}
 }
 
+// lossesFor returns the loss function of each target
+func lossesFor(metadata *model.Metadata) []targetLossFunc {
+	targets := metadata.Targets()
+	result := make([]targetLossFunc, len(targets))
+	for i, target := range targets {
+		i := i
+		if metadata.Columns[target.Column].Type == model.MultiLabel {
+			result[i] = func(g *ag.Graph, prediction ag.Node, record *io.DataRecord) ag.Node {
+				return multiLabelLoss(g, prediction, record.MultiHotTarget(i))
+			}
+			continue
+		}
+		lossFunc := lossFor(metadata, target)
+		result[i] = func(g *ag.Graph, prediction ag.Node, record *io.DataRecord) ag.Node {
+			return lossFunc(g, prediction, record.TargetValue(i))
+		}
+	}
+	return result
+}
+
+// targetOutputs splits the output of the model into the output of each target
+func targetOutputs(g *ag.Graph, metadata *model.Metadata, output ag.Node) []ag.Node {
+	targets := metadata.Targets()
+	if len(targets) == 1 {
+		return []ag.Node{output}
+	}
+	result := make([]ag.Node, len(targets))
+	offset := 0
+	for i, target := range targets {
+		dimension := metadata.TargetDimension(target)
+		result[i] = g.View(output, offset, 0, dimension, 1)
+		offset += dimension
+	}
+	return result
+}
+
+// unknownCategoryMasker randomly replaces rare categorical values with the unknown category
+// of their column, so that the unknown category embeddings are trained
+type unknownCategoryMasker struct {
+	P    mat.Float
+	Rand dropoutRand
+	// unknownCategories maps each rare category index to the unknown category index of its column
+	unknownCategories map[int]int
+}
+
+func newUnknownCategoryMasker(metaData *model.Metadata, dataSet *io.DataSet, p mat.Float, rareFrequency int, r dropoutRand) *unknownCategoryMasker {
+	counts := map[int]int{}
+	for _, d := range dataSet.Data {
+		for _, index := range d.CategoricalFeatures {
+			counts[index]++
+		}
+	}
+	unknownCategories := map[int]int{}
+	for index, count := range counts {
+		if count >= rareFrequency {
+			continue
+		}
+		if unknown, ok := metaData.CategoricalValuesMap.UnknownValueFor(metaData.CategoricalValuesMap.IndexToValue[index].Column); ok {
+			unknownCategories[index] = unknown
+		}
+	}
+	return &unknownCategoryMasker{
+		P:                 p,
+		Rand:              r,
+		unknownCategories: unknownCategories,
+	}
+}
+
+// mask returns a copy of the batch where each rare categorical value is replaced by
+// the unknown category with probability P
+func (u *unknownCategoryMasker) mask(batch io.DataBatch) io.DataBatch {
+	result := make(io.DataBatch, len(batch))
+	for i, d := range batch {
+		masked := *d
+		masked.CategoricalFeatures = make([]int, len(d.CategoricalFeatures))
+		for j, index := range d.CategoricalFeatures {
+			masked.CategoricalFeatures[j] = index
+			if unknown, ok := u.unknownCategories[index]; ok && u.Rand.Float() < u.P {
+				masked.CategoricalFeatures[j] = unknown
+			}
+		}
+		result[i] = &masked
+	}
+	return result
+}
+
 type Trainer struct {
-	params       TrainingParameters
-	optimizer    *gd.GradientDescent
-	model        *model.TabNet
-	lossFunc     lossFunc
-	preProcessor dataPreProcessor
+	params         TrainingParameters
+	optimizer      *gd.GradientDescent
+	scheduler      *learningRateScheduler
+	model          *model.TabNet
+	metaData       *model.Metadata
+	lossFuncs      []targetLossFunc
+	workers        *workerPool
+	preProcessors  []dataPreProcessor
+	categoryMasker *unknownCategoryMasker
 }
 
-func Train(trainFile, testFile, outputFileName, targetColumn string, config model.TabNetConfig, trainingParams TrainingParameters) {
-	t := &Trainer{params: trainingParams}
+func Train(trainFile, testFile, outputFileName, metricsFileName string, targetColumns []string, config model.TabNetConfig, trainingParams TrainingParameters) {
+	metaData, dataSet, err := loadTrainingData(trainFile, targetColumns, trainingParams)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+		return
+	}
 
-	rndGen := rand.NewLockedRand(trainingParams.RndSeed)
+	var testDataSet, validationDataSet *io.DataSet
+	if trainingParams.ValidationSplit > 0 {
+		dataSet, validationDataSet, err = splitValidationData(dataSet, trainingParams.ValidationSplit)
+		if err != nil {
+			log.Fatal().Msg(err.Error())
+			return
+		}
+	}
+	if testFile != "" {
+		var testDataErrors []io.DataError
+		_, testDataSet, testDataErrors, err = io.LoadData(io.DataParameters{
+			DataFile:           testFile,
+			TargetColumns:      targetColumnNames(metaData),
+			CategoricalColumns: nil,
+			BatchSize:          trainingParams.BatchSize,
+		}, metaData)
+		if err != nil {
+			log.Fatal().Msgf("error loading data from %s: %s", testFile, err)
+			return
+		}
+		printDataErrors(testDataErrors)
+		if validationDataSet == nil {
+			log.Warn().Msgf("No validation split: %s is used to select the model and is reported as validation, "+
+				"so there are no held-out test metrics", testFile)
+			validationDataSet, testDataSet = testDataSet, nil
+		}
+	}
+
+	if trainingParams.Calibrate && validationDataSet == nil {
+		log.Fatal().Msg("Calibration requires a test file or a validation split")
+		return
+	}
+
+	m := trainModel(metaData, dataSet, validationDataSet, config, trainingParams)
+
+	outputFile, err := os.Create(outputFileName)
+	if err != nil {
+		log.Fatal().Msgf("Error creating output file %s: %s", outputFileName, err)
+	}
+	defer outputFile.Close()
+
+	err = io.SaveModel(m, outputFile)
+	if err != nil {
+		log.Fatal().Msgf("Error saving model to %s: %s", outputFileName, err)
+	}
+
+	reports := map[string]metricsReport{}
+	log.Info().Msgf("Train set metrics:")
+	reports["train"], err = testInternal(m, dataSet, "", "", false)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
 
-	metaData, dataSet, dataErrors, err := io.LoadData(io.DataParameters{
-		DataFile:           trainFile,
-		TargetColumn:       targetColumn,
+	if validationDataSet != nil {
+		log.Info().Msgf("Validation set metrics:")
+		reports["validation"], err = testInternal(m, validationDataSet, "", "", false)
+		if err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+	}
+
+	if testDataSet != nil {
+		log.Info().Msgf("Test set metrics:")
+		reports["test"], err = testInternal(m, testDataSet, "", "", false)
+		if err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+	}
+
+	if metricsFileName != "" {
+		if err := writeMetricsReport(metricsFileName, reports); err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+	}
+
+}
+
+// loadTrainingData loads the training data file, computing new metadata from it
+func loadTrainingData(trainFile string, targetColumns []string, trainingParams TrainingParameters) (*model.Metadata, *io.DataSet, error) {
+	p, err := trainingDataParameters(targetColumns, trainingParams)
+	if err != nil {
+		return nil, nil, err
+	}
+	header, rows, err := io.ReadRows(trainFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading training data: %w", err)
+	}
+	return loadTrainingRows(p, header, rows, trainingParams)
+}
+
+// trainingDataParameters checks the training parameters, returning the parameters of the training data
+func trainingDataParameters(targetColumns []string, trainingParams TrainingParameters) (io.DataParameters, error) {
+	imputation, err := model.ParseImputationStrategy(trainingParams.Imputation)
+	if err != nil {
+		return io.DataParameters{}, err
+	}
+	regressionLoss, err := parseRegressionLoss(trainingParams)
+	if err != nil {
+		return io.DataParameters{}, err
+	}
+	if _, err := parseOptimizer(trainingParams); err != nil {
+		return io.DataParameters{}, err
+	}
+	if _, err := newLearningRateSchedule(trainingParams); err != nil {
+		return io.DataParameters{}, err
+	}
+	if trainingParams.Workers < 1 {
+		return io.DataParameters{}, fmt.Errorf("invalid number of workers %d", trainingParams.Workers)
+	}
+	if len(trainingParams.TargetWeights) > 0 && len(trainingParams.TargetWeights) != len(targetColumns) {
+		return io.DataParameters{}, fmt.Errorf("expected %d target weights, got %d", len(targetColumns), len(trainingParams.TargetWeights))
+	}
+	for _, weight := range trainingParams.TargetWeights {
+		if weight < 0 {
+			return io.DataParameters{}, fmt.Errorf("invalid target weight %f", weight)
+		}
+	}
+	if trainingParams.Calibrate && len(targetColumns) > 1 {
+		return io.DataParameters{}, fmt.Errorf("calibration is not supported for multi-target models")
+	}
+	if trainingParams.Calibrate && len(targetColumns) == 1 && !isClassificationColumn(targetColumns[0], trainingParams) {
+		return io.DataParameters{}, fmt.Errorf("calibration requires a classification target, %s is not a categorical column", targetColumns[0])
+	}
+	if len(trainingParams.MultiLabelColumns) > 0 && trainingParams.LabelSeparator == "" {
+		return io.DataParameters{}, fmt.Errorf("multi-label columns require a label separator")
+	}
+	for _, column := range targetColumns {
+		if column == trainingParams.WeightColumn {
+			return io.DataParameters{}, fmt.Errorf("weight column %s is a target column", column)
+		}
+	}
+
+	return io.DataParameters{
+		TargetColumns:      targetColumns,
 		CategoricalColumns: io.NewSet(trainingParams.CategoricalColumns...),
-		BatchSize:          trainingParams.BatchSize}, nil)
+		MultiLabelColumns:  io.NewSet(trainingParams.MultiLabelColumns...),
+		LabelSeparator:     trainingParams.LabelSeparator,
+		WeightColumn:       trainingParams.WeightColumn,
+		RegressionLoss:     regressionLoss,
+		BatchSize:          trainingParams.BatchSize,
+		MissingValues:      io.NewSet(trainingParams.MissingValues...),
+		Imputation:         imputation,
+		ImputationConstant: trainingParams.ImputationConstant,
+		MissingIndicators:  trainingParams.MissingIndicators,
+
+		MinCategoryFrequency: trainingParams.MinCategoryFrequency,
+	}, nil
+}
 
+// loadTrainingRows parses the rows of training data read with their header, computing new metadata from them
+func loadTrainingRows(p io.DataParameters, header []string, rows [][]string, trainingParams TrainingParameters) (*model.Metadata, *io.DataSet, error) {
+	metaData, dataSet, dataErrors, err := io.LoadRows(p, header, rows, nil)
 	if err != nil {
-		log.Fatal().Msgf("Error reading training data: %s", err)
-		return
+		return nil, nil, fmt.Errorf("error reading training data: %w", err)
 	}
 	printDataErrors(dataErrors)
 	if len(dataSet.Data) == 0 {
-		log.Fatal().Msgf("No data to train")
-		return
+		return nil, nil, fmt.Errorf("no data to train")
+	}
+	if p.RegressionLoss.Function != model.MSELoss && !hasContinuousTarget(metaData) {
+		return nil, nil, fmt.Errorf("loss %s requires a continuous target", trainingParams.Loss)
+	}
+	if len(trainingParams.ClassWeights) > 0 {
+		metaData.ClassWeights, err = classWeights(metaData, dataSet, trainingParams.ClassWeights)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 	dataSet.Rand = mathrand.New(mathrand.NewSource(int64(trainingParams.RndSeed)))
+	return metaData, dataSet, nil
+}
 
-	//Overwrite values that are  only known after parsing the dataset
-	config.NumColumns = metaData.FeatureCount()
-	config.NumCategoricalEmbeddings = len(metaData.CategoricalValuesMap.ValueToIndex)
-	switch metaData.TargetType() {
-	case model.Categorical:
-		config.OutputDimension = metaData.TargetMap.Size()
-	case model.Continuous:
-		config.OutputDimension = 1
+// isClassificationColumn returns whether the column is parsed as a single-label categorical column
+func isClassificationColumn(column string, trainingParams TrainingParameters) bool {
+	if _, ok := io.NewSet(trainingParams.MultiLabelColumns...)[column]; ok {
+		return false
 	}
+	_, ok := io.NewSet(trainingParams.CategoricalColumns...)[column]
+	return ok
+}
 
+// parseRegressionLoss returns the loss of continuous targets selected by the training parameters
+func parseRegressionLoss(trainingParams TrainingParameters) (model.RegressionLoss, error) {
+	function := model.MSELoss
+	if trainingParams.Loss != "" {
+		var err error
+		if function, err = model.ParseLossFunction(trainingParams.Loss); err != nil {
+			return model.RegressionLoss{}, err
+		}
+	}
+	result := model.RegressionLoss{Function: function}
+	if len(trainingParams.Quantiles) > 0 && function != model.QuantileLoss {
+		return result, fmt.Errorf("quantiles require the quantile loss")
+	}
+	switch function {
+	case model.HuberLoss:
+		if trainingParams.HuberDelta <= 0 {
+			return result, fmt.Errorf("invalid Huber delta %f", trainingParams.HuberDelta)
+		}
+		result.HuberDelta = trainingParams.HuberDelta
+	case model.QuantileLoss:
+		if len(trainingParams.Quantiles) > 0 {
+			quantiles, err := parseQuantiles(trainingParams.Quantiles)
+			if err != nil {
+				return result, err
+			}
+			result.Quantiles = quantiles
+			break
+		}
+		if trainingParams.Quantile <= 0 || trainingParams.Quantile >= 1 {
+			return result, fmt.Errorf("invalid quantile %f", trainingParams.Quantile)
+		}
+		result.Quantile = trainingParams.Quantile
+	case model.TweedieLoss:
+		if trainingParams.TweediePower <= 1 || trainingParams.TweediePower >= 2 {
+			return result, fmt.Errorf("invalid Tweedie power %f, expected a value between 1 and 2", trainingParams.TweediePower)
+		}
+		result.TweediePower = trainingParams.TweediePower
+	}
+	return result, nil
+}
+
+// parseQuantiles returns the quantiles in increasing order, checking that they are distinct, include the median,
+// and that there are quantiles on both sides of the median to bound prediction intervals
+func parseQuantiles(quantiles []float64) ([]float64, error) {
+	result := append([]float64(nil), quantiles...)
+	sort.Float64s(result)
+	for i, quantile := range result {
+		if quantile <= 0 || quantile >= 1 {
+			return nil, fmt.Errorf("invalid quantile %f", quantile)
+		}
+		if i > 0 && quantile == result[i-1] {
+			return nil, fmt.Errorf("duplicate quantile %f", quantile)
+		}
+	}
+	median := sort.SearchFloat64s(result, 0.5)
+	if median == len(result) || result[median] != 0.5 {
+		return nil, fmt.Errorf("quantiles must include the median 0.5")
+	}
+	if median == 0 || median == len(result)-1 {
+		return nil, fmt.Errorf("quantiles must include quantiles below and above the median")
+	}
+	return result, nil
+}
+
+// hasContinuousTarget returns whether one of the targets of the metadata is continuous
+func hasContinuousTarget(metaData *model.Metadata) bool {
+	for _, target := range metaData.Targets() {
+		if metaData.Columns[target.Column].Type == model.Continuous {
+			return true
+		}
+	}
+	return false
+}
+
+// balancedClassWeights is the class weights option weighting each class inversely to its frequency
+const balancedClassWeights = "balanced"
+
+// classWeights returns the weight of each class of the first target, given as class=weight pairs or
+// as balancedClassWeights. Balanced weights are n / (k * n_c), where n is the weight of all the rows of the
+// dataset, k the number of classes and n_c the weight of the rows of class c. Classes without a weight are
+// weighted 1.
+func classWeights(metaData *model.Metadata, dataSet *io.DataSet, spec []string) ([]float64, error) {
+	if !metaData.HasTarget() || metaData.TargetType() != model.Categorical {
+		return nil, fmt.Errorf("class weights require a categorical target")
+	}
+	numClasses := metaData.TargetMap.Size()
+	result := make([]float64, numClasses)
+	for class := range result {
+		result[class] = 1
+	}
+	if len(spec) == 1 && spec[0] == balancedClassWeights {
+		counts := make([]float64, numClasses)
+		total := 0.0
+		for _, d := range dataSet.Data {
+			weight := sampleWeight(metaData.Weighted, d)
+			counts[int(d.Target)] += weight
+			total += weight
+		}
+		for class, count := range counts {
+			if count > 0 {
+				result[class] = total / (float64(numClasses) * count)
+			}
+		}
+		return result, nil
+	}
+	for _, pair := range spec {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid class weight %s, expected class=weight or %s", pair, balancedClassWeights)
+		}
+		class, ok := metaData.TargetMap.ContainsName(parts[0])
+		if !ok {
+			return nil, fmt.Errorf("unknown class %s in class weights", parts[0])
+		}
+		weight, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight %s for class %s", parts[1], parts[0])
+		}
+		result[class] = weight
+	}
+	return result, nil
+}
+
+// targetColumnNames returns the names of the target columns of the metadata
+func targetColumnNames(metaData *model.Metadata) []string {
+	var result []string
+	for _, target := range metaData.Targets() {
+		result = append(result, metaData.Columns[target.Column].Name)
+	}
+	return result
+}
+
+// trainModel trains a new model on the dataset. When a validation dataset is provided, the model
+// is evaluated on it after each epoch and the weights of the epoch with the lowest validation loss are returned.
+// The validation dataset is also used to calibrate classification models.
+func trainModel(metaData *model.Metadata, dataSet, validationDataSet *io.DataSet, config model.TabNetConfig, trainingParams TrainingParameters) *model.Model {
+	t := &Trainer{params: trainingParams, metaData: metaData}
+
+	rndGen := rand.NewLockedRand(trainingParams.RndSeed)
+
+	config = configureModel(metaData, config)
+	if metaData.IsMultiTarget() {
+		config.TargetWeights = trainingParams.TargetWeights
+	}
 	t.model = model.NewTabNet(config)
-	t.lossFunc = lossFor(metaData)
+	t.lossFuncs = lossesFor(metaData)
 
 	if trainingParams.InputDropout > 0 {
-		t.preProcessor = NewDropoutPreprocessor(mat.Float(1.0-trainingParams.InputDropout), rndGen, config.NumColumns, trainingParams.BatchSize)
+		// each worker draws its dropout masks from its own random generator, the first one sharing the generator
+		// of the initialization of the model
+		t.preProcessors = make([]dataPreProcessor, numWorkers(trainingParams))
+		for i := range t.preProcessors {
+			r := rndGen
+			if i > 0 {
+				r = rand.NewLockedRand(trainingParams.RndSeed + uint64(i))
+			}
+			t.preProcessors[i] = NewDropoutPreprocessor(mat.Float(1.0-trainingParams.InputDropout), r, config.NumColumns, trainingParams.BatchSize)
+		}
+	}
+
+	if trainingParams.UnknownCategoryProbability > 0 {
+		t.categoryMasker = newUnknownCategoryMasker(metaData, dataSet, mat.Float(trainingParams.UnknownCategoryProbability),
+			trainingParams.RareCategoryFrequency, rand.NewLockedRand(trainingParams.RndSeed))
 	}
 
 	t.model.Init(rndGen)
+	if metaData.RegressionLoss.LogLink() {
+		initLogLinkOutputs(metaData, dataSet, t.model)
+	}
+	if len(metaData.RegressionLoss.Quantiles) > 0 {
+		initQuantileOutputs(metaData, t.model)
+	}
+
+	m := &model.Model{
+		MetaData: metaData,
+		TabNet:   t.model,
+	}
+
+	if trainingParams.PretrainedModel != "" {
+		if err := initFromPretrained(m, trainingParams.PretrainedModel); err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+	}
 
-	updaterConfig := adam.NewDefaultConfig() // TODO: `radam` may provide better results
-	updaterConfig.StepSize = mat.Float(trainingParams.LearningRate)
-	updater := adam.New(updaterConfig)
-	const GradientClipThreshold = 2000.0 // TODO: get from configuration
-	t.optimizer = gd.NewOptimizer(updater, nn.NewDefaultParamsIterator(t.model),
-		gd.ClipGradByValue(GradientClipThreshold),
-		gd.ConcurrentComputations(1))
+	t.optimizer, t.scheduler = newOptimizer(m, trainingParams, batchesPerEpoch(dataSet.Size(), dataSet.BatchSize))
+	t.workers = newWorkerPool(t.model, numWorkers(trainingParams))
+
+	var bestModel *bytes.Buffer
+	bestEpoch := -1
+	bestLoss := math.Inf(1)
 
 	for epoch := 0; epoch < trainingParams.NumEpochs; epoch++ {
 		dataSet.ResetOrder(io.RandomOrder)
 		t.optimizer.IncEpoch()
 		i := 0
 		for batch := dataSet.Next(); len(batch) > 0; batch = dataSet.Next() {
+			if t.categoryMasker != nil {
+				batch = t.categoryMasker.mask(batch)
+			}
 			out := t.trainBatch(batch)
 			t.optimizer.Optimize()
 			if i%t.params.ReportInterval == 0 {
 				log.Info().Int("epoch", epoch).Int("batch", i).
+					Float64("learningRate", t.scheduler.rate).
 					Float32("totalLoss", out.TotalLoss).
 					Float32("targetLoss", out.TargetLoss).
 					Float32("sparsityLoss", out.SparsityLoss).
@@ -171,48 +799,130 @@ func Train(trainFile, testFile, outputFileName, targetColumn string, config mode
 			}
 			i++
 		}
+
+		if validationDataSet == nil {
+			continue
+		}
+		validationLoss := validate(m, validationDataSet)
+		log.Info().Int("epoch", epoch).Float64("validationLoss", validationLoss).Msg("")
+		if validationLoss < bestLoss {
+			bestLoss = validationLoss
+			bestEpoch = epoch
+			bestModel = &bytes.Buffer{}
+			if err := io.SaveModel(m, bestModel); err != nil {
+				log.Fatal().Msgf("Error saving best model: %s", err)
+			}
+		} else if trainingParams.Patience > 0 && epoch-bestEpoch >= trainingParams.Patience {
+			log.Info().Int("epoch", epoch).Msgf("No validation loss improvement for %d epochs, stopping", trainingParams.Patience)
+			break
+		}
 	}
 
-	m := model.Model{
-		MetaData: metaData,
-		TabNet:   t.model,
+	if bestModel != nil {
+		best, err := io.LoadModel(bestModel)
+		if err != nil {
+			log.Fatal().Msgf("Error restoring best model: %s", err)
+		}
+		m = best
+		log.Info().Int("bestEpoch", bestEpoch).Float64("validationLoss", bestLoss).Msg("Selected best epoch")
 	}
 
-	outputFile, err := os.Create(outputFileName)
-	if err != nil {
-		log.Fatal().Msgf("Error creating output file %s: %s", outputFileName, err)
+	if trainingParams.Calibrate && validationDataSet != nil {
+		calibrate(m, validationDataSet)
+		log.Info().Float64("temperature", m.Temperature).Msg("Calibrated class probabilities")
 	}
-	defer outputFile.Close()
+	return m
+}
 
-	err = io.SaveModel(&m, outputFile)
-	if err != nil {
-		log.Fatal().Msgf("Error saving model to %s: %s", outputFileName, err)
+// initLogLinkOutputs sets the bias of the outputs of the continuous targets, whose logarithm is predicted,
+// to the logarithm of their average, so that training starts from the average prediction
+func initLogLinkOutputs(metaData *model.Metadata, dataSet *io.DataSet, m *model.TabNet) {
+	offset := 0
+	for i, target := range metaData.Targets() {
+		if metaData.Columns[target.Column].Type == model.Continuous {
+			sum := 0.0
+			for _, d := range dataSet.Data {
+				sum += float64(d.TargetValue(i))
+			}
+			if average := sum / float64(len(dataSet.Data)); average > 0 {
+				m.OutputLayer.B.Value().Set(offset, 0, mat.Float(math.Log(average)))
+			}
+		}
+		offset += metaData.TargetDimension(target)
 	}
+}
 
-	log.Info().Msgf("Train set metrics:")
-	err = testInternal(&m, dataSet, "", "")
+// initQuantileOutputs sets the bias of the outputs of the continuous targets, whose quantiles are predicted,
+// to the quantiles of the standard normal distribution, so that training starts from the quantiles
+// of the standardized targets of a normal distribution
+func initQuantileOutputs(metaData *model.Metadata, m *model.TabNet) {
+	quantiles := metaData.RegressionLoss.Quantiles
+	offset := 0
+	for _, target := range metaData.Targets() {
+		if metaData.Columns[target.Column].Type == model.Continuous {
+			previous := 0.0
+			for i, quantile := range quantiles {
+				value := distuv.UnitNormal.Quantile(quantile)
+				bias := value
+				if i > 0 {
+					// inverse of the softplus of the difference with the previous quantile
+					bias = math.Log(math.Expm1(value - previous))
+				}
+				m.OutputLayer.B.Value().Set(offset+i, 0, mat.Float(bias))
+				previous = value
+			}
+		}
+		offset += metaData.TargetDimension(target)
+	}
+}
+
+// configureModel overwrites the model configuration values that are only known after parsing the dataset
+func configureModel(metaData *model.Metadata, config model.TabNetConfig) model.TabNetConfig {
+	config.NumColumns = len(metaData.InputColumns(config.CategoricalEmbeddingDimension))
+	config.NumCategoricalEmbeddings = len(metaData.CategoricalValuesMap.ValueToIndex)
+	config.NumUnknownCategoryEmbeddings = metaData.CategoricalFeaturesMap.Size()
+	if !metaData.HasTarget() {
+		return config
+	}
+	config.OutputDimension = metaData.OutputDimension()
+	return config
+}
+
+// initFromPretrained initializes the encoder of the model from the pretrained model file
+func initFromPretrained(m *model.Model, pretrainedModelFileName string) error {
+	pretrainedFile, err := os.Open(pretrainedModelFileName)
 	if err != nil {
-		log.Fatal().Msg(err.Error())
+		return fmt.Errorf("error opening pretrained model file %s: %w", pretrainedModelFileName, err)
+	}
+	defer pretrainedFile.Close()
+	pretrained, err := io.LoadModel(pretrainedFile)
+	if err != nil {
+		return fmt.Errorf("error loading pretrained model from file %s: %w", pretrainedModelFileName, err)
 	}
+	if err := m.InitFromPretrained(pretrained); err != nil {
+		return fmt.Errorf("error initializing from pretrained model %s: %w", pretrainedModelFileName, err)
+	}
+	log.Info().Str("pretrainedModel", pretrainedModelFileName).Msg("Initialized encoder from pretrained model")
+	return nil
+}
 
-	if testFile != "" {
-		log.Info().Msgf("Test set metrics:")
-		_, testDataset, testDataErrors, err := io.LoadData(io.DataParameters{
-			DataFile:           testFile,
-			TargetColumn:       m.MetaData.Columns[m.MetaData.TargetColumn].Name,
-			CategoricalColumns: nil,
-			BatchSize:          1,
-		}, m.MetaData)
-		if err != nil {
-			log.Fatal().Msgf("error loading data from %s: %s", testFile, err)
-		}
-		printDataErrors(testDataErrors)
-		err = testInternal(&m, testDataset, "", "")
-		if err != nil {
-			log.Fatal().Msg(err.Error())
-		}
+// splitValidationData randomly holds out a fraction of the dataset for validation
+func splitValidationData(dataSet *io.DataSet, fraction float64) (*io.DataSet, *io.DataSet, error) {
+	validationSize := int(math.Round(float64(dataSet.Size()) * fraction))
+	if validationSize == 0 || validationSize == dataSet.Size() {
+		return nil, nil, fmt.Errorf("not enough data for a validation split of %f", fraction)
+	}
+	splits := dataSet.RandomSplit(dataSet.Size()-validationSize, validationSize)
+	for _, split := range splits {
+		split.Rand = dataSet.Rand
 	}
+	return splits[0], splits[1], nil
+}
 
+// validate returns the average target loss of the model on the validation dataset
+func validate(m *model.Model, validationDataSet *io.DataSet) float64 {
+	attnWriter := newAttentionWriter(NoopWriter{}, m)
+	return evaluate(m, validationDataSet, &csvPredictionWriter{outputWriter: NoopWriter{}}, attnWriter, false).evaluator.Loss()
 }
 
 type trainBatchOutput struct {
@@ -224,22 +934,29 @@ type trainBatchOutput struct {
 
 func (t *Trainer) trainBatch(batch io.DataBatch) trainBatchOutput {
 	t.optimizer.IncBatch()
+	return t.workers.run(batch, func(worker int, m *model.TabNet, shard io.DataBatch, _ int) trainBatchOutput {
+		return t.trainShard(worker, m, shard, len(batch))
+	})
+}
 
+// trainShard accumulates the gradients of the loss of the shard of a batch of batchSize records into the parameters
+// of the model m of a worker, returning the losses of the shard averaged over the whole batch
+func (t *Trainer) trainShard(worker int, m *model.TabNet, batch io.DataBatch, batchSize int) trainBatchOutput {
 	g := ag.NewGraph(
-		ag.Rand(rand.NewLockedRand(t.params.RndSeed)),
-		ag.ConcurrentComputations(1)) // TODO: we might use the same random generator among the batches until we run them concurrently
+		ag.Rand(rand.NewLockedRand(t.params.RndSeed+uint64(worker))),
+		ag.ConcurrentComputations(1))
 	defer g.Clear()
 
-	input := createInputNodes(batch, g, t.model)
+	input := createInputNodes(batch, g, m)
 
 	ctx := nn.Context{Graph: g, Mode: nn.Training}
-	modelProc := nn.Reify(ctx, t.model).(*model.TabNet)
+	modelProc := nn.Reify(ctx, m).(*model.TabNet)
 
 	//normalizedInput := modelProc.FeatureBatchNorm.Forward(input...)
 	normalizedInput := input
 	var modelInput []ag.Node
-	if t.preProcessor != nil {
-		modelInput = t.preProcessor.process(g, normalizedInput)
+	if t.preProcessors != nil {
+		modelInput = t.preProcessors[worker].process(g, normalizedInput)
 	} else {
 		modelInput = normalizedInput
 	}
@@ -247,27 +964,30 @@ func (t *Trainer) trainBatch(batch io.DataBatch) trainBatchOutput {
 
 	var batchLoss, batchTargetLoss, batchSparsityLoss, batchReconstructionLoss ag.Node
 	for i := range batch {
-		targetLoss := t.lossFunc(g, output.Output[i], batch[i].Target)
-		weightedTargetLoss := g.Mul(targetLoss, g.Constant(mat.Float(t.model.TargetLossWeight)))
+		targetLoss := t.targetLoss(g, output.Output[i], batch[i])
+		if t.metaData.Weighted {
+			targetLoss = g.Mul(targetLoss, g.Constant(batch[i].Weight))
+		}
+		weightedTargetLoss := g.Mul(targetLoss, g.Constant(mat.Float(m.TargetLossWeight)))
 		batchTargetLoss = g.Add(batchTargetLoss, targetLoss)
 
 		batchSparsityLoss = g.Add(batchSparsityLoss, output.AttentionEntropy[i])
-		weightedSparsityLoss := g.Mul(output.AttentionEntropy[i], g.Constant(mat.Float(t.model.SparsityLossWeight)))
+		weightedSparsityLoss := g.Mul(output.AttentionEntropy[i], g.Constant(mat.Float(m.SparsityLossWeight)))
 
 		reconstructionLoss := reconstructionLoss(g, normalizedInput[i], output.DecoderOutput[i])
 		batchReconstructionLoss = g.Add(batchReconstructionLoss, reconstructionLoss)
-		weightedReconstructionLoss := g.Mul(reconstructionLoss, g.Constant(mat.Float(t.model.ReconstructionLossWeight)))
+		weightedReconstructionLoss := g.Mul(reconstructionLoss, g.Constant(mat.Float(m.ReconstructionLossWeight)))
 
 		exampleLoss := g.Add(weightedTargetLoss, weightedSparsityLoss)
 		exampleLoss = g.Add(exampleLoss, weightedReconstructionLoss)
 
 		batchLoss = g.Add(batchLoss, exampleLoss)
 	}
-	batchSize := g.NewScalar(mat.Float(len(batch)))
-	batchLoss = g.Div(batchLoss, batchSize)
-	batchTargetLoss = g.Div(batchTargetLoss, batchSize)
-	batchSparsityLoss = g.Div(batchSparsityLoss, batchSize)
-	batchReconstructionLoss = g.Div(batchReconstructionLoss, batchSize)
+	size := g.NewScalar(mat.Float(batchSize))
+	batchLoss = g.Div(batchLoss, size)
+	batchTargetLoss = g.Div(batchTargetLoss, size)
+	batchSparsityLoss = g.Div(batchSparsityLoss, size)
+	batchReconstructionLoss = g.Div(batchReconstructionLoss, size)
 
 	g.Backward(batchLoss)
 
@@ -279,6 +999,29 @@ func (t *Trainer) trainBatch(batch io.DataBatch) trainBatchOutput {
 	}
 }
 
+// sampleWeight returns the sample weight of the record when the data is weighted, and 1 otherwise
+func sampleWeight(weighted bool, record *io.DataRecord) float64 {
+	if !weighted {
+		return 1
+	}
+	return float64(record.Weight)
+}
+
+// targetLoss returns the loss of the output of the model for the targets of the record. The loss of multi-target
+// models is the weighted sum of the loss of each target.
+func (t *Trainer) targetLoss(g *ag.Graph, output ag.Node, record *io.DataRecord) ag.Node {
+	outputs := targetOutputs(g, t.metaData, output)
+	if len(outputs) == 1 {
+		return t.lossFuncs[0](g, output, record)
+	}
+	var loss ag.Node
+	for i, targetOutput := range outputs {
+		targetLoss := t.lossFuncs[i](g, targetOutput, record)
+		loss = g.Add(loss, g.Mul(targetLoss, g.Constant(mat.Float(t.model.TargetWeight(i)))))
+	}
+	return loss
+}
+
 func reconstructionLoss(g *ag.Graph, input ag.Node, output ag.Node) ag.Node {
 	detachedInput := g.NewVariable(g.GetCopiedValue(input), false)
 	return losses.MSE(g, output, detachedInput, false)
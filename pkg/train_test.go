@@ -1,8 +1,12 @@
 package pkg
 
 import (
+	"math"
 	"testing"
 
+	"golem/pkg/io"
+	"golem/pkg/model"
+
 	mat "github.com/nlpodyssey/spago/pkg/mat32"
 	"github.com/nlpodyssey/spago/pkg/mat32/rand"
 	"github.com/nlpodyssey/spago/pkg/ml/ag"
@@ -44,3 +48,166 @@ func TestInputDropout(t *testing.T) {
 	}
 
 }
+
+func TestUnknownCategoryMasker(t *testing.T) {
+	metaData := model.NewMetadata()
+	values := metaData.CategoricalValuesMap
+	common := values.ValueFor(model.CategoricalValue{Column: 0, Value: "common"})
+	rare := values.ValueFor(model.CategoricalValue{Column: 0, Value: "rare"})
+	unknown := values.ValueFor(model.CategoricalValue{Column: 0, Value: model.UnknownCategory})
+
+	data := []*io.DataRecord{
+		{CategoricalFeatures: []int{common}},
+		{CategoricalFeatures: []int{common}},
+		{CategoricalFeatures: []int{common}},
+		{CategoricalFeatures: []int{rare}},
+		{CategoricalFeatures: []int{rare}},
+	}
+	tr := testRand{values: []float32{0.1, 0.9}}
+	masker := newUnknownCategoryMasker(metaData, io.NewDataSet(data, 5), 0.5, 3, &tr)
+
+	masked := masker.mask(data)
+	require.Equal(t, []int{common}, masked[0].CategoricalFeatures)
+	require.Equal(t, []int{common}, masked[1].CategoricalFeatures)
+	require.Equal(t, []int{common}, masked[2].CategoricalFeatures)
+	require.Equal(t, []int{unknown}, masked[3].CategoricalFeatures)
+	require.Equal(t, []int{rare}, masked[4].CategoricalFeatures)
+
+	// The original data is left untouched
+	require.Equal(t, []int{rare}, data[3].CategoricalFeatures)
+}
+
+func TestClassWeights(t *testing.T) {
+	metaData := model.NewMetadata()
+	metaData.Columns = []*model.Column{{Name: "class", Type: model.Categorical}}
+	metaData.TargetColumn = 0
+	for _, class := range []string{"a", "b"} {
+		metaData.TargetMap.ValueFor(class)
+	}
+	data := []*io.DataRecord{{Target: 0, Weight: 1}, {Target: 0, Weight: 1}, {Target: 0, Weight: 1}, {Target: 1, Weight: 3}}
+	dataSet := io.NewDataSet(data, 4)
+
+	weights, err := classWeights(metaData, dataSet, []string{"balanced"})
+	require.NoError(t, err)
+	require.InDeltaSlice(t, []float64{4.0 / (2 * 3), 4.0 / (2 * 1)}, weights, 1e-9)
+
+	// balanced weights use the sample weights of the rows
+	metaData.Weighted = true
+	weights, err = classWeights(metaData, dataSet, []string{"balanced"})
+	require.NoError(t, err)
+	require.InDeltaSlice(t, []float64{1, 1}, weights, 1e-9)
+
+	weights, err = classWeights(metaData, dataSet, []string{"b=2.5"})
+	require.NoError(t, err)
+	require.Equal(t, []float64{1, 2.5}, weights)
+
+	for _, spec := range [][]string{{"c=2"}, {"a"}, {"a=-1"}, {"a=x"}} {
+		_, err = classWeights(metaData, dataSet, spec)
+		require.Error(t, err, spec)
+	}
+
+	// class weights scale the cross-entropy of the target class
+	metaData.ClassWeights = []float64{1, 2.5}
+	g := ag.NewGraph()
+	loss := lossFor(metaData, metaData.Targets()[0])
+	logits := g.NewVariable(mat.NewVecDense([]mat.Float{1, 0}), false)
+	require.InDelta(t, 2.5*float64(crossEntropyLoss(g, logits, 1).ScalarValue()), float64(loss(g, logits, 1).ScalarValue()), 1e-5)
+	require.InDelta(t, float64(crossEntropyLoss(g, logits, 0).ScalarValue()), float64(loss(g, logits, 0).ScalarValue()), 1e-5)
+}
+
+func TestRegressionLosses(t *testing.T) {
+	g := ag.NewGraph()
+	value := func(loss lossFunc, prediction, target mat.Float) (float64, float64) {
+		x := g.NewVariable(mat.NewScalar(prediction), true)
+		l := loss(g, x, target)
+		g.Backward(l)
+		return float64(l.ScalarValue()), float64(x.Grad().Scalar())
+	}
+
+	// Huber is half the squared residual up to delta, then linear
+	loss, grad := value(huberLoss(1), 0.5, 0)
+	require.InDelta(t, 0.125, loss, 1e-6)
+	require.InDelta(t, 0.5, grad, 1e-6)
+	loss, grad = value(huberLoss(1), -3, 0)
+	require.InDelta(t, 2.5, loss, 1e-6)
+	require.InDelta(t, -1, grad, 1e-6)
+
+	// Underestimates are weighted by the quantile
+	loss, _ = value(quantileLoss(0.9), 1, 3)
+	require.InDelta(t, 1.8, loss, 1e-6)
+	loss, _ = value(quantileLoss(0.9), 3, 1)
+	require.InDelta(t, 0.2, loss, 1e-6)
+
+	// Deviances are zero when predicting the target, with predictions on a log scale
+	for _, loss := range []lossFunc{poissonLoss, tweedieLoss(1.5)} {
+		deviance, grad := value(loss, mat.Float(math.Log(4)), 4)
+		require.InDelta(t, 0, deviance, 1e-5)
+		require.InDelta(t, 0, grad, 1e-5)
+		deviance, grad = value(loss, 0, 4)
+		require.Greater(t, deviance, 0.0)
+		require.Less(t, grad, 0.0)
+	}
+	loss, _ = value(poissonLoss, 0, 2)
+	require.InDelta(t, 2*(2*math.Log(2)-2+1), loss, 1e-5)
+	loss, _ = value(tweedieLoss(1.5), 0, 0)
+	require.InDelta(t, 2*(1/0.5), loss, 1e-5)
+
+	_, err := parseRegressionLoss(TrainingParameters{Loss: "tweedie", TweediePower: 2})
+	require.Error(t, err)
+	_, err = parseRegressionLoss(TrainingParameters{Loss: "quantile", Quantile: 1})
+	require.Error(t, err)
+	_, err = parseRegressionLoss(TrainingParameters{Loss: "absolute"})
+	require.Error(t, err)
+	regressionLoss, err := parseRegressionLoss(TrainingParameters{Loss: "huber", HuberDelta: 2})
+	require.NoError(t, err)
+	require.Equal(t, model.RegressionLoss{Function: model.HuberLoss, HuberDelta: 2}, regressionLoss)
+}
+
+func TestMultiQuantileLoss(t *testing.T) {
+	g := ag.NewGraph()
+	outputs := []mat.Float{1, -2, 3}
+	x := g.NewVariable(mat.NewVecDense(outputs), true)
+
+	// The quantiles of the graph match those of the model, and never cross
+	regressionLoss := model.RegressionLoss{Function: model.QuantileLoss, Quantiles: []float64{0.1, 0.5, 0.9}}
+	values := regressionLoss.QuantileValues(outputs)
+	for i, node := range quantileNodes(g, x, 3) {
+		require.InDelta(t, values[i], float64(node.ScalarValue()), 1e-5)
+	}
+	require.InDelta(t, 1+math.Log1p(math.Exp(-2)), values[1], 1e-9)
+	require.Less(t, values[0], values[1])
+	require.Less(t, values[1], values[2])
+
+	loss := multiQuantileLoss(regressionLoss.Quantiles)(g, x, 2)
+	expected := 0.0
+	for i, quantile := range regressionLoss.Quantiles {
+		expected += float64(quantileLoss(quantile)(g, g.NewScalar(mat.Float(values[i])), 2).ScalarValue())
+	}
+	require.InDelta(t, expected/3, float64(loss.ScalarValue()), 1e-5)
+	g.Backward(loss)
+	require.Equal(t, 3, x.Grad().Size())
+
+	regressionLoss, err := parseRegressionLoss(TrainingParameters{Loss: "quantile", Quantiles: []float64{0.95, 0.05, 0.5}})
+	require.NoError(t, err)
+	require.Equal(t, []float64{0.05, 0.5, 0.95}, regressionLoss.Quantiles)
+	require.Equal(t, 1, regressionLoss.MedianIndex())
+	for _, quantiles := range [][]float64{{0.1, 0.9}, {0.5, 0.9}, {0.1, 0.5, 0.5, 0.9}, {0, 0.5, 0.9}} {
+		_, err = parseRegressionLoss(TrainingParameters{Loss: "quantile", Quantiles: quantiles})
+		require.Error(t, err, "%v", quantiles)
+	}
+	_, err = parseRegressionLoss(TrainingParameters{Loss: "mse", Quantiles: []float64{0.1, 0.5, 0.9}})
+	require.Error(t, err)
+}
+
+func TestCalibrationTarget(t *testing.T) {
+	trainingParams := TrainingParameters{Calibrate: true, BatchSize: 16, Workers: 1, Imputation: "mean", LearningRate: 0.02,
+		CategoricalColumns: []string{"species"}, MultiLabelColumns: []string{"species"}, LabelSeparator: "|"}
+	_, _, err := loadTrainingData("../datasets/iris/iris.train", []string{"sepal_length"}, trainingParams)
+	require.EqualError(t, err, "calibration requires a classification target, sepal_length is not a categorical column")
+	_, _, err = loadTrainingData("../datasets/iris/iris.train", []string{"species"}, trainingParams)
+	require.EqualError(t, err, "calibration requires a classification target, species is not a categorical column")
+
+	trainingParams.MultiLabelColumns = nil
+	_, _, err = loadTrainingData("../datasets/iris/iris.train", []string{"species"}, trainingParams)
+	require.NoError(t, err)
+}
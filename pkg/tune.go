@@ -0,0 +1,381 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	gio "io"
+	"io/ioutil"
+	"math"
+	mathrand "math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"golem/pkg/io"
+	"golem/pkg/model"
+)
+
+// TuningParameters controls the hyperparameter search
+type TuningParameters struct {
+	// Method is the search method: random or halving (successive halving)
+	Method string
+	// NumTrials is the number of sampled configurations
+	NumTrials int
+	// Workers is the number of trials trained concurrently
+	Workers int
+	// MinEpochs is the number of epochs of the first successive halving round
+	MinEpochs int
+	// ReductionFactor is the fraction of trials discarded at each successive halving round,
+	// and the factor by which the number of epochs grows between rounds
+	ReductionFactor int
+}
+
+// ParameterRange is the search space of a single parameter. Values are sampled from Choices
+// when present, otherwise uniformly between Min and Max, in log scale if Log is set.
+type ParameterRange struct {
+	Choices []float64 `json:"choices"`
+	Min     float64   `json:"min"`
+	Max     float64   `json:"max"`
+	Log     bool      `json:"log"`
+}
+
+// SearchSpace maps the name of each tuned flag to its range
+type SearchSpace map[string]ParameterRange
+
+type tunableParameter struct {
+	integer bool
+	set     func(t *TrainingParameters, c *model.TabNetConfig, v float64)
+}
+
+// tunableParameters maps the flag name of each tunable parameter to its setter
+var tunableParameters = map[string]tunableParameter{
+	"batch-size": {
+		integer: true,
+		set: func(t *TrainingParameters, c *model.TabNetConfig, v float64) {
+			t.BatchSize = int(v)
+		},
+	},
+	"learning-rate": {
+		set: func(t *TrainingParameters, c *model.TabNetConfig, v float64) {
+			t.LearningRate = v
+		},
+	},
+	"weight-decay": {
+		set: func(t *TrainingParameters, c *model.TabNetConfig, v float64) {
+			t.WeightDecay = v
+		},
+	},
+	"input-dropout-probability": {
+		set: func(t *TrainingParameters, c *model.TabNetConfig, v float64) {
+			t.InputDropout = v
+		},
+	},
+	"categorical-embedding-size": {
+		integer: true,
+		set: func(t *TrainingParameters, c *model.TabNetConfig, v float64) {
+			c.CategoricalEmbeddingDimension = int(v)
+		},
+	},
+	"num-decision-steps": {
+		integer: true,
+		set: func(t *TrainingParameters, c *model.TabNetConfig, v float64) {
+			c.NumDecisionSteps = int(v)
+		},
+	},
+	"feature-dimension": {
+		integer: true,
+		set: func(t *TrainingParameters, c *model.TabNetConfig, v float64) {
+			c.IntermediateFeatureDimension = int(v)
+		},
+	},
+	"relaxation-factor": {
+		set: func(t *TrainingParameters, c *model.TabNetConfig, v float64) {
+			c.RelaxationFactor = v
+		},
+	},
+	"batch-momentum": {
+		set: func(t *TrainingParameters, c *model.TabNetConfig, v float64) {
+			c.BatchMomentum = v
+		},
+	},
+	"virtual-batch-size": {
+		integer: true,
+		set: func(t *TrainingParameters, c *model.TabNetConfig, v float64) {
+			c.VirtualBatchSize = int(v)
+		},
+	},
+	"sparsity-loss-weight": {
+		set: func(t *TrainingParameters, c *model.TabNetConfig, v float64) {
+			c.SparsityLossWeight = v
+		},
+	},
+	"reconstruction-loss-weight": {
+		set: func(t *TrainingParameters, c *model.TabNetConfig, v float64) {
+			c.ReconstructionLossWeight = v
+		},
+	},
+}
+
+// LoadSearchSpace reads a JSON search space, e.g.
+//
+//	{"learning-rate": {"min": 0.001, "max": 0.1, "log": true}, "num-decision-steps": {"choices": [2, 3, 4]}}
+func LoadSearchSpace(input gio.Reader) (SearchSpace, error) {
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, fmt.Errorf("error reading search space: %w", err)
+	}
+	space := SearchSpace{}
+	if err := json.Unmarshal(data, &space); err != nil {
+		return nil, fmt.Errorf("error decoding search space: %w", err)
+	}
+	for name, r := range space {
+		if _, ok := tunableParameters[name]; !ok {
+			return nil, fmt.Errorf("parameter %s cannot be tuned", name)
+		}
+		if len(r.Choices) == 0 && (r.Min > r.Max || (r.Log && r.Min <= 0)) {
+			return nil, fmt.Errorf("invalid range for parameter %s", name)
+		}
+	}
+	return space, nil
+}
+
+func (s SearchSpace) names() []string {
+	result := make([]string, 0, len(s))
+	for name := range s {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (s SearchSpace) sample(r *mathrand.Rand) map[string]float64 {
+	values := make(map[string]float64, len(s))
+	for _, name := range s.names() {
+		p := s[name]
+		switch {
+		case len(p.Choices) > 0:
+			values[name] = p.Choices[r.Intn(len(p.Choices))]
+		case p.Log:
+			values[name] = math.Exp(math.Log(p.Min) + r.Float64()*(math.Log(p.Max)-math.Log(p.Min)))
+		default:
+			values[name] = p.Min + r.Float64()*(p.Max-p.Min)
+		}
+		if tunableParameters[name].integer {
+			values[name] = math.Round(values[name])
+		}
+	}
+	return values
+}
+
+type trial struct {
+	id      int
+	values  map[string]float64
+	epochs  int
+	metrics map[string]float64
+	model   *model.Model
+}
+
+// Tune searches the hyperparameters in the search space, scoring each trial by its loss on a validation split.
+// It writes a leaderboard of all trials to leaderboardFileName, and the best model to outputFileName.
+func Tune(dataFile string, targetColumns []string, searchSpaceFileName, outputFileName, leaderboardFileName string, tuningParams TuningParameters,
+	config model.TabNetConfig, trainingParams TrainingParameters) error {
+
+	if trainingParams.ValidationSplit <= 0 {
+		return fmt.Errorf("tuning requires a validation split")
+	}
+	if tuningParams.NumTrials < 1 {
+		return fmt.Errorf("invalid number of trials %d", tuningParams.NumTrials)
+	}
+	if tuningParams.Workers < 1 {
+		return fmt.Errorf("invalid number of workers %d", tuningParams.Workers)
+	}
+	// trials are trained concurrently, each by a single worker
+	trainingParams.Workers = 1
+	searchSpaceFile, err := os.Open(searchSpaceFileName)
+	if err != nil {
+		return fmt.Errorf("error opening search space file %s: %w", searchSpaceFileName, err)
+	}
+	defer searchSpaceFile.Close()
+	space, err := LoadSearchSpace(searchSpaceFile)
+	if err != nil {
+		return err
+	}
+
+	metaData, dataSet, err := loadTrainingData(dataFile, targetColumns, trainingParams)
+	if err != nil {
+		return err
+	}
+	trainDataSet, validationDataSet, err := splitValidationData(dataSet, trainingParams.ValidationSplit)
+	if err != nil {
+		return err
+	}
+
+	r := mathrand.New(mathrand.NewSource(int64(trainingParams.RndSeed)))
+	trials := make([]*trial, tuningParams.NumTrials)
+	for i := range trials {
+		trials[i] = &trial{id: i, values: space.sample(r)}
+	}
+
+	tuner := &tuner{
+		metaData:          metaData,
+		trainDataSet:      trainDataSet,
+		validationDataSet: validationDataSet,
+		config:            config,
+		trainingParams:    trainingParams,
+		workers:           tuningParams.Workers,
+	}
+
+	var finalists []*trial
+	switch tuningParams.Method {
+	case "random":
+		tuner.run(trials, trainingParams.NumEpochs)
+		finalists = trials
+	case "halving":
+		if tuningParams.ReductionFactor < 2 || tuningParams.MinEpochs < 1 {
+			return fmt.Errorf("successive halving requires a reduction factor of at least 2 and at least one epoch")
+		}
+		finalists = tuner.successiveHalving(trials, tuningParams.MinEpochs, tuningParams.ReductionFactor)
+	default:
+		return fmt.Errorf("unknown search method %s", tuningParams.Method)
+	}
+
+	leaderboard := tuner.trials
+	sortTrials(leaderboard)
+	sortTrials(finalists)
+	best := finalists[0]
+	log.Info().Int("trial", best.id).Int("epochs", best.epochs).Float64("Loss", best.metrics["Loss"]).Msg("Best trial")
+
+	if leaderboardFileName != "" {
+		leaderboardFile, err := os.Create(leaderboardFileName)
+		if err != nil {
+			return fmt.Errorf("error creating leaderboard file %s: %w", leaderboardFileName, err)
+		}
+		defer leaderboardFile.Close()
+		writeLeaderboard(leaderboardFile, space, leaderboard)
+	}
+
+	outputFile, err := os.Create(outputFileName)
+	if err != nil {
+		return fmt.Errorf("error creating output file %s: %w", outputFileName, err)
+	}
+	defer outputFile.Close()
+	if err := io.SaveModel(best.model, outputFile); err != nil {
+		return fmt.Errorf("error saving model to %s: %w", outputFileName, err)
+	}
+	return nil
+}
+
+type tuner struct {
+	metaData          *model.Metadata
+	trainDataSet      *io.DataSet
+	validationDataSet *io.DataSet
+	config            model.TabNetConfig
+	trainingParams    TrainingParameters
+	workers           int
+
+	// trials holds every trained trial, including the ones trained in earlier successive halving rounds
+	trials []*trial
+}
+
+// successiveHalving trains all trials with minEpochs, then repeatedly keeps the best 1/reductionFactor of them
+// and multiplies the number of epochs by reductionFactor, until a single trial is left or the maximum number
+// of epochs is reached. It returns the trials of the last round.
+func (t *tuner) successiveHalving(trials []*trial, minEpochs, reductionFactor int) []*trial {
+	epochs := minEpochs
+	for {
+		if epochs > t.trainingParams.NumEpochs {
+			epochs = t.trainingParams.NumEpochs
+		}
+		t.run(trials, epochs)
+		if len(trials) == 1 || epochs == t.trainingParams.NumEpochs {
+			return trials
+		}
+		sortTrials(trials)
+		survivors := len(trials) / reductionFactor
+		if survivors < 1 {
+			survivors = 1
+		}
+		next := make([]*trial, survivors)
+		for i := range next {
+			next[i] = &trial{id: trials[i].id, values: trials[i].values}
+		}
+		for _, tr := range trials {
+			tr.model = nil
+		}
+		trials = next
+		epochs *= reductionFactor
+	}
+}
+
+// run trains the trials concurrently with the specified number of epochs
+func (t *tuner) run(trials []*trial, epochs int) {
+	jobs := make(chan *trial)
+	wg := sync.WaitGroup{}
+	for w := 0; w < t.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tr := range jobs {
+				t.runTrial(tr, epochs)
+			}
+		}()
+	}
+	for _, tr := range trials {
+		jobs <- tr
+	}
+	close(jobs)
+	wg.Wait()
+	t.trials = append(t.trials, trials...)
+}
+
+func (t *tuner) runTrial(tr *trial, epochs int) {
+	trainingParams := t.trainingParams
+	config := t.config
+	for name, value := range tr.values {
+		tunableParameters[name].set(&trainingParams, &config, value)
+	}
+	trainingParams.NumEpochs = epochs
+	tr.epochs = epochs
+
+	trainDataSet := t.trainDataSet.Copy(trainingParams.BatchSize)
+	trainDataSet.Rand = mathrand.New(mathrand.NewSource(int64(trainingParams.RndSeed)))
+	validationDataSet := t.validationDataSet.Copy(trainingParams.BatchSize)
+
+	tr.model = trainModel(t.metaData, trainDataSet, validationDataSet, config, trainingParams)
+	attnWriter := newAttentionWriter(NoopWriter{}, tr.model)
+	result := evaluate(tr.model, validationDataSet, &csvPredictionWriter{outputWriter: NoopWriter{}}, attnWriter, false)
+	tr.metrics = result.evaluator.Metrics()
+
+	event := log.Info().Int("trial", tr.id).Int("epochs", epochs)
+	for _, name := range sortedMetricNames(tr.metrics) {
+		event = event.Float64(name, tr.metrics[name])
+	}
+	event.Msg("Trial metrics")
+}
+
+// sortTrials sorts trials by increasing validation loss
+func sortTrials(trials []*trial) {
+	sort.SliceStable(trials, func(i, j int) bool {
+		return trials[i].metrics["Loss"] < trials[j].metrics["Loss"]
+	})
+}
+
+func writeLeaderboard(w gio.Writer, space SearchSpace, trials []*trial) {
+	parameterNames := space.names()
+	metricNames := sortedMetricNames(trials[0].metrics)
+	fmt.Fprintf(w, "rank,trial,epochs,%s,%s\n", strings.Join(parameterNames, ","), strings.Join(metricNames, ","))
+	for rank, tr := range trials {
+		values := []string{strconv.Itoa(rank + 1), strconv.Itoa(tr.id), strconv.Itoa(tr.epochs)}
+		for _, name := range parameterNames {
+			values = append(values, strconv.FormatFloat(tr.values[name], 'g', -1, 64))
+		}
+		for _, name := range metricNames {
+			values = append(values, fmt.Sprintf("%f", tr.metrics[name]))
+		}
+		fmt.Fprintf(w, "%s\n", strings.Join(values, ","))
+	}
+}
@@ -0,0 +1,34 @@
+package pkg
+
+import (
+	mathrand "math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchSpace(t *testing.T) {
+	space, err := LoadSearchSpace(strings.NewReader(`{
+		"learning-rate": {"min": 0.001, "max": 0.1, "log": true},
+		"feature-dimension": {"min": 4, "max": 16},
+		"num-decision-steps": {"choices": [2, 4]}
+	}`))
+	require.NoError(t, err)
+	require.Equal(t, []string{"feature-dimension", "learning-rate", "num-decision-steps"}, space.names())
+
+	r := mathrand.New(mathrand.NewSource(42))
+	for i := 0; i < 100; i++ {
+		values := space.sample(r)
+		require.True(t, values["learning-rate"] >= 0.001 && values["learning-rate"] <= 0.1)
+		require.True(t, values["feature-dimension"] >= 4 && values["feature-dimension"] <= 16)
+		// Integer parameters are rounded
+		require.Equal(t, float64(int(values["feature-dimension"])), values["feature-dimension"])
+		require.Contains(t, []float64{2, 4}, values["num-decision-steps"])
+	}
+
+	_, err = LoadSearchSpace(strings.NewReader(`{"target-column": {"choices": [1]}}`))
+	require.Error(t, err)
+	_, err = LoadSearchSpace(strings.NewReader(`{"learning-rate": {"min": 0, "max": 0.1, "log": true}}`))
+	require.Error(t, err)
+}
@@ -0,0 +1,154 @@
+package pkg
+
+import (
+	"sync"
+
+	mat "github.com/nlpodyssey/spago/pkg/mat32"
+	"github.com/nlpodyssey/spago/pkg/ml/nn"
+
+	"golem/pkg/io"
+	"golem/pkg/model"
+)
+
+// shardFunc trains the model m of a worker on a shard of a batch, starting at index start of the batch,
+// accumulating the gradients into the parameters of m
+type shardFunc func(worker int, m *model.TabNet, shard io.DataBatch, start int) trainBatchOutput
+
+// workerPool trains a model with data parallelism: each batch is split into contiguous shards trained concurrently
+// by the workers, each on its own replica of the model. The gradients of the replicas are then accumulated into the
+// parameters of the model in the order of the workers, and the running statistics of batch normalization move by the
+// average of their updates by the replicas, so that a given random seed and number of workers always give the same
+// weights. Batch normalization statistics are computed over the shard of each worker.
+type workerPool struct {
+	model *model.TabNet
+	// params holds the parameters of the model, in the same order as the parameters of each replica
+	params   []nn.Param
+	replicas []*replica
+}
+
+// replica is the copy of the model trained by a worker
+type replica struct {
+	model  *model.TabNet
+	params []nn.Param
+}
+
+// newWorkerPool returns a pool of workers training m. With a single worker, batches are trained on m directly.
+func newWorkerPool(m *model.TabNet, workers int) *workerPool {
+	pool := &workerPool{model: m}
+	if workers <= 1 {
+		return pool
+	}
+	pool.params = modelParams(m)
+	pool.replicas = make([]*replica, workers)
+	for i := range pool.replicas {
+		replicaModel := model.NewTabNet(m.TabNetConfig)
+		pool.replicas[i] = &replica{model: replicaModel, params: modelParams(replicaModel)}
+	}
+	return pool
+}
+
+// numWorkers returns the number of workers training each batch
+func numWorkers(trainingParams TrainingParameters) int {
+	if trainingParams.Workers < 1 {
+		return 1
+	}
+	return trainingParams.Workers
+}
+
+// modelParams returns all the parameters of m, in a fixed order
+func modelParams(m *model.TabNet) []nn.Param {
+	var params []nn.Param
+	nn.ForEachParam(m, func(param nn.Param) {
+		params = append(params, param)
+	})
+	return params
+}
+
+// run trains the batch with the workers, returning the losses of the whole batch
+func (w *workerPool) run(batch io.DataBatch, train shardFunc) trainBatchOutput {
+	if len(w.replicas) == 0 {
+		return train(0, w.model, batch, 0)
+	}
+	bounds := shardBounds(len(batch), len(w.replicas))
+	outputs := make([]trainBatchOutput, len(bounds)-1)
+	var wg sync.WaitGroup
+	for i := range outputs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := w.replicas[i]
+			r.load(w.params)
+			start, end := bounds[i], bounds[i+1]
+			outputs[i] = train(i, r.model, batch[start:end], start)
+		}(i)
+	}
+	wg.Wait()
+	w.accumulate(w.replicas[:len(outputs)])
+
+	var result trainBatchOutput
+	for _, out := range outputs {
+		result = result.add(out)
+	}
+	return result
+}
+
+// minShardSize is the minimum number of records of a shard, as batch normalization is undefined for a single record
+const minShardSize = 2
+
+// shardBounds returns the bounds of the shards of a batch of the given size trained by at most workers workers,
+// which hold nearly the same number of records, and at least minShardSize records unless the batch is smaller
+func shardBounds(size, workers int) []int {
+	if maxShards := size / minShardSize; workers > maxShards {
+		workers = maxShards
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	bounds := make([]int, workers+1)
+	for i := 0; i < workers; i++ {
+		bounds[i+1] = bounds[i] + (size-bounds[i])/(workers-i)
+	}
+	return bounds
+}
+
+// load copies the values of params into the parameters of the replica
+func (r *replica) load(params []nn.Param) {
+	for i, param := range params {
+		copy(r.params[i].Value().Data(), param.Value().Data())
+	}
+}
+
+// accumulate adds the gradients of the replicas to the parameters of the model, and moves the parameters without
+// gradients, such as the running statistics of batch normalization, by the average of their updates by the replicas.
+// The replicas are visited in order, so that the sums do not depend on the scheduling of the workers.
+func (w *workerPool) accumulate(replicas []*replica) {
+	for i, param := range w.params {
+		if param.RequiresGrad() {
+			for _, r := range replicas {
+				if replicaParam := r.params[i]; replicaParam.HasGrad() {
+					param.PropagateGrad(replicaParam.Grad())
+					replicaParam.ZeroGrad()
+				}
+			}
+			continue
+		}
+		value := param.Value()
+		update := value.ZerosLike()
+		for _, r := range replicas {
+			diff := r.params[i].Value().Sub(value)
+			update.AddInPlace(diff)
+			mat.ReleaseDense(diff.(*mat.Dense))
+		}
+		value.AddInPlace(update.ProdScalarInPlace(1 / mat.Float(len(replicas))))
+	}
+}
+
+// add returns the sum of the losses of o and other
+func (o trainBatchOutput) add(other trainBatchOutput) trainBatchOutput {
+	return trainBatchOutput{
+		TotalLoss:          o.TotalLoss + other.TotalLoss,
+		TargetLoss:         o.TargetLoss + other.TargetLoss,
+		SparsityLoss:       o.SparsityLoss + other.SparsityLoss,
+		ReconstructionLoss: o.ReconstructionLoss + other.ReconstructionLoss,
+	}
+}
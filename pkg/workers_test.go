@@ -0,0 +1,89 @@
+package pkg
+
+import (
+	"testing"
+
+	mat "github.com/nlpodyssey/spago/pkg/mat32"
+	"github.com/nlpodyssey/spago/pkg/mat32/rand"
+	"github.com/nlpodyssey/spago/pkg/ml/ag"
+	"github.com/nlpodyssey/spago/pkg/ml/nn"
+	"github.com/stretchr/testify/require"
+
+	"golem/pkg/io"
+	"golem/pkg/model"
+)
+
+func TestShardBounds(t *testing.T) {
+	require.Equal(t, []int{0, 2, 4, 7, 10}, shardBounds(10, 4))
+	require.Equal(t, []int{0, 2, 5}, shardBounds(5, 4))
+	require.Equal(t, []int{0, 1}, shardBounds(1, 4))
+	require.Equal(t, []int{0, 16}, shardBounds(16, 1))
+}
+
+func TestWorkerPool(t *testing.T) {
+	config := model.TabNetConfig{NumDecisionSteps: 2, NumColumns: 3, IntermediateFeatureDimension: 4, OutputDimension: 2,
+		BatchMomentum: 0.9}
+	newModel := func() *model.TabNet {
+		m := model.NewTabNet(config)
+		m.Init(rand.NewLockedRand(1))
+		return m
+	}
+	batch := make(io.DataBatch, 5)
+	for i := range batch {
+		batch[i] = &io.DataRecord{ContinuousFeatures: mat.NewVecDense([]mat.Float{mat.Float(i), 1, -mat.Float(i * i), 0.5})}
+	}
+	// the loss goes through a linear layer followed by batch normalization, which updates the running statistics
+	var train shardFunc = func(worker int, m *model.TabNet, shard io.DataBatch, start int) trainBatchOutput {
+		g := ag.NewGraph(ag.ConcurrentComputations(1))
+		defer g.Clear()
+		proc := nn.Reify(nn.Context{Graph: g, Mode: nn.Training}, m).(*model.TabNet)
+		xs := make([]ag.Node, len(shard))
+		for i, record := range shard {
+			xs[i] = g.NewVariable(record.ContinuousFeatures, false)
+		}
+		var loss ag.Node
+		for _, y := range proc.AttentionBatchNorm[0].Forward(proc.AttentionTransformer[0].Forward(xs...)...) {
+			loss = g.Add(loss, g.ReduceSum(g.Exp(y)))
+		}
+		g.Backward(loss)
+		return trainBatchOutput{TotalLoss: loss.ScalarValue()}
+	}
+
+	m := newModel()
+	pool := newWorkerPool(m, 2)
+	out := pool.run(batch, train)
+
+	// the gradients are the sum of the gradients of the shards, and the running statistics move by the average
+	// of their updates on each shard
+	first, second := newModel(), newModel()
+	expected := train(0, first, batch[:2], 0).add(train(0, second, batch[2:], 2))
+	require.InDelta(t, expected.TotalLoss, out.TotalLoss, 1e-4)
+	firstParams, secondParams := modelParams(first), modelParams(second)
+	for i, param := range modelParams(m) {
+		if param.RequiresGrad() {
+			if !firstParams[i].HasGrad() {
+				require.False(t, param.HasGrad())
+				continue
+			}
+			require.InDeltaSlice(t, firstParams[i].Grad().Add(secondParams[i].Grad()).Data(), param.Grad().Data(), 1e-4)
+			continue
+		}
+		average := firstParams[i].Value().Add(secondParams[i].Value()).ProdScalar(0.5)
+		require.InDeltaSlice(t, average.Data(), param.Value().Data(), 1e-5)
+	}
+	for _, r := range pool.replicas {
+		for _, param := range r.params {
+			require.False(t, param.HasGrad())
+		}
+	}
+	require.NotEqual(t, 0.0, float64(m.AttentionBatchNorm[0].Mean.Value().Sum()))
+
+	// the replicas are loaded with the parameters of the model before each batch
+	nn.ZeroGrad(m)
+	initial := newModel()
+	initialParams := modelParams(initial)
+	for i, param := range modelParams(m) {
+		param.ReplaceValue(initialParams[i].Value().Clone())
+	}
+	require.Equal(t, out, pool.run(batch, train))
+}